@@ -18,53 +18,79 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
 	"github.com/bwmarrin/discordgo"
-	"jlortiz.org/jlort2/modules/clickart"
 	"jlortiz.org/jlort2/modules/commands"
-	"jlortiz.org/jlort2/modules/kek"
+	"jlortiz.org/jlort2/modules/config"
 	"jlortiz.org/jlort2/modules/log"
-	"jlortiz.org/jlort2/modules/quotes"
-	"jlortiz.org/jlort2/modules/reminder"
-	"jlortiz.org/jlort2/modules/zip"
+
+	// Modules register themselves when imported
+	_ "jlortiz.org/jlort2/modules/kek"
+	_ "jlortiz.org/jlort2/modules/quotes"
+	_ "jlortiz.org/jlort2/modules/reminder"
+	_ "jlortiz.org/jlort2/modules/zip"
 )
 
-func initModules(self *discordgo.Session, guildId string) {
-	if len(guildId) > 0 && guildId[0] == '-' {
-		commands.ClearGuildCommands(self, self.State.Application.ID, guildId[1:])
-		log.Info("Cleared commands for " + guildId[1:])
+func initModules(self *discordgo.Session, cfg *config.Config) {
+	if cfg.ClearGuild != "" {
+		commands.ClearGuildCommands(self, self.State.Application.ID, cfg.ClearGuild)
+		log.Info("Cleared commands for " + cfg.ClearGuild)
 		sc <- nil
 		return
 	}
-	commands.Init(self)
-	log.Info("Loaded commands")
-	quotes.Init(self)
-	log.Info("Loaded quotes")
-	kek.Init(self)
-	log.Info("Loaded kek")
-	zip.Init(self)
-	log.Info("Loaded zip")
-	reminder.Init(self)
-	log.Info("Loaded remind")
-	clickart.Init(self)
-	log.Info("Loaded clickart")
-	voiceStatement, _ = commands.GetDatabase().Prepare("SELECT cid FROM vachan WHERE gid=?001 AND vid=?002;")
-	commands.PrepareCommand("vachan", "Change voice join announcer").Guild().Perms(discordgo.PermissionManageGuild).Register(vachan, []*discordgo.ApplicationCommandOption{
-		commands.NewCommandOption("channel", "Voice join announcements will be posted here, select a category to disable").AsChannel([]discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildCategory}).Required().Finalize(),
-		commands.NewCommandOption("voice", "Voice channel to modify announcements for, omit to modify for entire server").AsChannel([]discordgo.ChannelType{discordgo.ChannelTypeGuildVoice}).Finalize(),
-	})
-	testMode := len(guildId) > 0 && guildId[0] == 't'
-	if testMode {
-		guildId = guildId[1:]
+	commands.Use(commands.Logging, commands.Recover)
+	err := commands.StartModules(commands.WrapSession(self))
+	if err != nil {
+		log.Warn("Some modules are disabled:\n" + err.Error())
+	}
+	for _, m := range commands.ModuleStatuses() {
+		// Without it nothing works, and uploading would delete every command
+		if m.Name == "commands" && !m.Running {
+			panic(m.Err)
+		}
+	}
+	guildId, testMode := cfg.GSMGuild, false
+	if cfg.TestGuild != "" {
+		guildId, testMode = cfg.TestGuild, true
 	}
 	commands.UploadCommands(self, self.State.Application.ID, guildId, testMode)
 }
 
-func cleanup(self *discordgo.Session) {
-	voiceStatement.Close()
-	clickart.Cleanup(self)
-	reminder.Cleanup(self)
-	zip.Cleanup(self)
-	kek.Cleanup(self)
-	quotes.Cleanup(self)
-	commands.Cleanup(self)
+// shutdown stops taking commands, waits up to timeout for the running ones, then cleans up every module.
+// A second signal stops the wait early. It returns the exit status.
+func shutdown(self *discordgo.Session, timeout time.Duration) int {
+	status := 0
+	err := stopServers()
+	if err != nil {
+		log.Error(fmt.Errorf("failed to stop HTTP servers: %w", err))
+		status = 1
+	}
+	abort := make(chan struct{})
+	go func() {
+		<-sc
+		close(abort)
+	}()
+	if !commands.Drain(timeout, abort) {
+		log.Warn("Stopped waiting for running commands")
+		status = 1
+	}
+	err = commands.StopModules(commands.WrapSession(self))
+	if err != nil {
+		status = 1
+	}
+	self.RLock()
+	vcs := slices.Collect(maps.Values(self.VoiceConnections))
+	self.RUnlock()
+	for _, vc := range vcs {
+		err = vc.Disconnect()
+		if err != nil {
+			log.Error(fmt.Errorf("failed to leave voice in %s: %w", vc.GuildID, err))
+			status = 1
+		}
+	}
+	return status
 }
@@ -30,6 +30,7 @@ import (
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/nathan-fiscaletti/consolesize-go"
+	"jlortiz.org/jlort2/modules/config"
 )
 
 func checkFatal(e error) {
@@ -75,17 +76,15 @@ func main() {
 	_, height = consolesize.GetConsoleSize()
 	input = bufio.NewReader(os.Stdin)
 	output = bufio.NewWriterSize(os.Stdout, 20480)
-	strBytes, err := os.ReadFile("key.txt")
+	cfg, err := config.Load()
 	if err != nil {
-		panic(err)
-	}
-	key, _, _ := strings.Cut(string(strBytes), "\n")
-	if key[len(key)-1] == '\r' {
-		key = key[:len(key)-1]
+		fmt.Println("Invalid configuration:")
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	fmt.Println("Starting...")
-	client, err = discordgo.New("Bot " + key)
+	client, err = discordgo.New("Bot " + cfg.Token)
 	checkFatal(err)
 	client.AddHandlerOnce(ready)
 	intent := discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages
@@ -50,3 +50,53 @@ CREATE TABLE userTz (
 	uid INTEGER PRIMARY KEY,
 	tz VARCHAR(31) NOT NULL
 );
+
+CREATE TABLE guildCommands (
+	gid INTEGER,
+	name VARCHAR(32),
+	PRIMARY KEY (gid, name)
+);
+
+CREATE TABLE disabledModules (
+	name VARCHAR(32) PRIMARY KEY
+);
+
+CREATE TABLE cmdStats (
+	ts INTEGER,
+	name VARCHAR(100),
+	gid INTEGER,
+	uhash INTEGER,
+	latency INTEGER,
+	outcome VARCHAR(8),
+	class VARCHAR(64)
+);
+CREATE INDEX cmdStatsTs ON cmdStats (ts);
+
+CREATE TABLE cmdStatsDaily (
+	day INTEGER,
+	name VARCHAR(100),
+	uses INTEGER,
+	errors INTEGER,
+	p50 INTEGER,
+	p95 INTEGER,
+	PRIMARY KEY (day, name)
+);
+
+CREATE TABLE errorReports (
+	id INTEGER PRIMARY KEY,
+	fingerprint VARCHAR(16) UNIQUE NOT NULL,
+	command VARCHAR(100),
+	options TEXT,
+	message TEXT,
+	stack TEXT,
+	gid UNSIGNED BIGINT,
+	first INTEGER,
+	last INTEGER,
+	count INTEGER,
+	notified INTEGER
+);
+
+CREATE TABLE guildPrefix (
+	gid UNSIGNED BIGINT PRIMARY KEY,
+	prefix VARCHAR(10) NOT NULL
+);
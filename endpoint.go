@@ -0,0 +1,130 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/config"
+	"jlortiz.org/jlort2/modules/log"
+	"jlortiz.org/jlort2/modules/metrics"
+)
+
+// The HTTP servers that are running
+var servers []*http.Server
+var serversLock sync.Mutex
+
+// listen serves h on addr in the background.
+func listen(name, addr string, h http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for %s: %w", name, err)
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	serversLock.Lock()
+	servers = append(servers, srv)
+	serversLock.Unlock()
+	go func() {
+		err := srv.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error(fmt.Errorf("%s stopped: %w", name, err))
+		}
+	}()
+	log.Info("Listening for " + name + " on " + listener.Addr().String())
+	return nil
+}
+
+// stopServers stops taking requests and waits for the ones that came in to be answered.
+func stopServers() error {
+	serversLock.Lock()
+	ls := servers
+	servers = nil
+	serversLock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*commands.InteractionDeadline)
+	defer cancel()
+	var errs []error
+	for _, srv := range ls {
+		errs = append(errs, srv.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// startEndpoint listens for interactions over HTTP on cfg.InteractionsAddr.
+// The URL to give Discord is that address with /interactions on the end.
+func startEndpoint(self *discordgo.Session, cfg *config.Config) error {
+	key := cfg.VerifyKey()
+	if key == nil {
+		var err error
+		key, err = hex.DecodeString(self.State.Application.VerifyKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("the application has no usable public key, set publicKey in the config")
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/interactions", commands.InteractionHandler(commands.WrapSession(self), key, dispatchInteraction))
+	return listen("interactions", cfg.InteractionsAddr, mux)
+}
+
+// startMonitor serves /healthz and /metrics on cfg.MetricsAddr, for whatever is watching the bot.
+func startMonitor(self *discordgo.Session, cfg *config.Config) error {
+	metrics.NewGaugeFunc("jlort_gateway_heartbeat_seconds", "Gateway heartbeat latency.", func() float64 {
+		return self.HeartbeatLatency().Seconds()
+	})
+	metrics.NewGaugeFunc("jlort_gateway_connected", "Whether the gateway connection is ready.", func() float64 {
+		if gatewayReady(self) {
+			return 1
+		}
+		return 0
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		var problems []string
+		if !gatewayReady(self) {
+			problems = append(problems, "gateway: not connected")
+		}
+		if err := commands.PingDatabase(); err != nil {
+			problems = append(problems, "database: "+err.Error())
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(problems) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return listen("monitoring", cfg.MetricsAddr, mux)
+}
+
+func gatewayReady(self *discordgo.Session) bool {
+	self.RLock()
+	defer self.RUnlock()
+	return self.DataReady
+}
@@ -18,56 +18,56 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime/debug"
-	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/mattn/go-isatty"
+	"jlortiz.org/jlort2/modules/clickart"
 	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/config"
 	"jlortiz.org/jlort2/modules/log"
 )
 
 var sc chan os.Signal
 
 func main() {
-	if !isatty.IsTerminal(os.Stdout.Fd()) {
-		log.SetLevel(log.LevelWARN)
+	replayFile := flag.String("replay", "", "replay the gateway events recorded in this `file` offline, then exit")
+	flag.Parse()
+	if *replayFile != "" {
+		os.Exit(replay(*replayFile))
 	}
-	log.Init()
-	defer log.Cleanup()
-	strBytes, err := os.ReadFile("key.txt")
+	os.Exit(run())
+}
+
+// run returns the exit status, so that everything it defers happens before exiting.
+func run() int {
+	cfg, err := config.Load()
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	// GSM_GUILD or tTEST_GUILD, KEY
-	key, guildId, _ := strings.Cut(string(strBytes), "\n")
-	guildId, motd, _ := strings.Cut(guildId, "\n")
-	motd, _, _ = strings.Cut(motd, "\n")
-	if key[len(key)-1] == '\r' {
-		key = key[:len(key)-1]
-		guildId = guildId[:len(guildId)-1]
-		if motd[len(motd)-1] == '\r' {
-			motd = motd[:len(motd)-1]
-		}
+	if level, ok := cfg.Level(); ok {
+		log.SetLevel(level)
+	} else if !isatty.IsTerminal(os.Stdout.Fd()) {
+		log.SetLevel(log.LevelWARN)
 	}
-	if len(guildId) > 0 {
-		s := guildId
-		if s[0] == 't' || s[0] == '-' {
-			s = s[1:]
-		}
-		_, err = strconv.ParseUint(s, 10, 64)
-		if err != nil {
-			panic("key.txt: line 2: could not parse test/gsm guild id")
-		}
+	log.Init()
+	defer log.Cleanup()
+	if cfg.Legacy() {
+		log.Warn(config.LegacyFile + " is deprecated, move its settings to " + config.DefaultFile)
 	}
+	commands.SetDatabaseFile(cfg.Database)
+	clickart.AssetDir = cfg.ClickartDir
 
 	// f, err = os.Create("/run/user/1000/cpu.prof")
 	// if err != nil {
@@ -80,31 +80,67 @@ func main() {
 	// }
 	// defer pprof.StopCPUProfile()
 
-	client, err := discordgo.New("Bot " + key)
+	stateKey := sha256.Sum256([]byte("component state\x00" + cfg.Token))
+	commands.SetStateKey(stateKey[:])
+
+	client, err := discordgo.New("Bot " + cfg.Token)
+	if err != nil {
+		panic(err)
+	}
+
+	// Fetched up front so that modules and the interactions endpoint don't have to wait for READY
+	app, err := client.Application("@me")
+	if err != nil {
+		panic(err)
+	}
+	client.State.Application = app
+	client.State.User, err = client.User("@me")
 	if err != nil {
 		panic(err)
 	}
 
-	client.AddHandlerOnce(func(self *discordgo.Session, event *discordgo.Ready) { ready(self, event, guildId, motd) })
-	client.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMembers | discordgo.IntentsGuildVoiceStates | discordgo.IntentsGuildMessages | discordgo.IntentsGuildMessageReactions | discordgo.IntentMessageContent
+	client.AddHandlerOnce(func(self *discordgo.Session, event *discordgo.Ready) { ready(self, event, cfg, app) })
+	client.Identify.Intents = cfg.IntentMask()
 	client.State.MaxMessageCount = 100
 	client.State.TrackVoice = true
+	if cfg.RecordFile != "" {
+		stopRecording, err := startRecording(client, cfg.RecordFile)
+		if err != nil {
+			log.Error(err)
+		} else {
+			defer stopRecording()
+		}
+	}
+	if cfg.MetricsAddr != "" {
+		err = startMonitor(client, cfg)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+	// Made before initModules, which can send on it
+	sc = make(chan os.Signal, 1)
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+	initModules(client, cfg)
+	if cfg.InteractionsAddr != "" && cfg.ClearGuild == "" {
+		err = startEndpoint(client, cfg)
+		if err != nil {
+			log.Error(err)
+		}
+	}
 	err = client.Open()
 	if err != nil {
 		panic(err)
 	}
 	defer client.Close()
 
-	sc = make(chan os.Signal)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
 	<-sc
 	log.Info("Stopping...")
-	if len(guildId) > 0 && guildId[0] != '-' {
-		cleanup(client)
-	}
+	return shutdown(client, cfg.ShutdownWait())
 }
 
-func ready(self *discordgo.Session, event *discordgo.Ready, guildId string, motd string) {
+func ready(self *discordgo.Session, event *discordgo.Ready, cfg *config.Config, app *discordgo.Application) {
+	// READY only has part of the application
+	self.State.Application = app
 	var err error
 	time.Sleep(5 * time.Millisecond)
 	for _, x := range event.Guilds {
@@ -113,12 +149,7 @@ func ready(self *discordgo.Session, event *discordgo.Ready, guildId string, motd
 			panic(err)
 		}
 	}
-	self.State.Application, err = self.Application("@me")
-	if err != nil {
-		panic(err)
-	}
-	go updatePfp(self)
-	initModules(self, guildId)
+	go updatePfp(self, cfg.PfpDir)
 	f, err := os.Open("avatar.png")
 	if err == nil {
 		defer f.Close()
@@ -138,11 +169,10 @@ func ready(self *discordgo.Session, event *discordgo.Ready, guildId string, motd
 	}
 
 	self.AddHandler(interactionCreate)
-	self.AddHandler(voiceStateUpdate)
+	self.AddHandler(messageCreate)
 	self.AddHandler(newGuild)
-	self.AddHandler(oldGuild)
-	if motd != "" {
-		motd = strings.Clone(motd)
+	if cfg.MOTD != "" {
+		motd := cfg.MOTD
 		setMotd(self, motd)
 		self.AddHandler(func(self *discordgo.Session, _ *discordgo.Resumed) {
 			setMotd(self, motd)
@@ -156,86 +186,141 @@ func setMotd(self *discordgo.Session, motd string) {
 }
 
 func interactionCreate(self *discordgo.Session, event *discordgo.InteractionCreate) {
-	if event.Type == discordgo.InteractionPing {
-		self.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{Type: discordgo.InteractionResponsePong})
-		return
-	}
-	if event.Type == discordgo.InteractionApplicationCommandAutocomplete {
-		data := event.ApplicationCommandData()
-		cmd := commands.GetCommandAutocomplete(data.Name)
-		out := cmd(commands.MakeContext(self, event.Interaction))
-		self.InteractionRespond(event.Interaction, &discordgo.InteractionResponse{
+	dispatchInteraction(commands.WrapSession(self), event.Interaction)
+}
+
+// dispatchInteraction handles an interaction from either the gateway or the interactions endpoint.
+func dispatchInteraction(self commands.Session, i *discordgo.Interaction) {
+	if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		out := commands.Autocomplete(commands.MakeContext(self, i))
+		self.InteractionRespond(i, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionApplicationCommandAutocompleteResult,
 			Data: &discordgo.InteractionResponseData{Choices: out},
 		})
-	}
-	if event.Type != discordgo.InteractionApplicationCommand && event.Type != discordgo.InteractionMessageComponent {
 		return
 	}
 	var cmd commands.Command
-	if event.Type == discordgo.InteractionMessageComponent {
-		data := event.MessageComponentData()
-		cmd = commands.GetCommandComponentHandler(data)
-	} else {
-		data := event.ApplicationCommandData()
-		cmd = commands.GetCommand(data.Name)
+	switch i.Type {
+	case discordgo.InteractionMessageComponent:
+		cmd = commands.GetCommandComponentHandler(i.MessageComponentData())
+	case discordgo.InteractionModalSubmit:
+		cmd = commands.GetCommandModalHandler(i.ModalSubmitData())
+	case discordgo.InteractionApplicationCommand:
+		cmd = commands.GetCommand(commands.CommandPath(i.ApplicationCommandData()))
+	default:
+		return
 	}
 	if cmd != nil {
-		ctx := commands.MakeContext(self, event.Interaction)
-		var err error
-		var stack string
-		defer func() {
-			if err == nil {
-				x := recover()
-				var ok bool
-				err, ok = x.(error)
-				if !ok {
-					s, _ := x.(string)
-					if s != "" {
-						err = errors.New(s)
-					}
-				}
-				stack = string(debug.Stack())
-			}
-			if err != nil {
-				handleCommandError(err, ctx, stack)
-			}
-		}()
-		err = cmd(ctx)
+		runCommand(commands.MakeContext(self, i), cmd)
 	}
 }
 
-func handleCommandError(err error, ctx *commands.Context, stack string) {
-	if ctx.Type == discordgo.InteractionMessageComponent {
-		log.Errors("Error in message component")
-		log.Error(err)
-		if stack != "" {
-			log.Errors(stack)
+func messageCreate(self *discordgo.Session, event *discordgo.MessageCreate) {
+	ctx, cmd, err := commands.ParseTextCommand(commands.WrapSession(self), event.Message)
+	if ctx == nil {
+		return
+	}
+	if err != nil {
+		handleCommandError(err, ctx, "")
+		return
+	}
+	runCommand(ctx, cmd)
+}
+
+// runCommand runs a command from an interaction or a text command, after checking it is allowed to run.
+func runCommand(ctx *commands.Context, cmd commands.Command) {
+	start := time.Now()
+	done, ok := commands.Track()
+	if !ok {
+		ctx.RespondPrivate(ctx.T("commands.shuttingDown"))
+		commands.RecordInvocation(ctx, time.Since(start), commands.OutcomeRefused, "shutdown")
+		return
+	}
+	defer done()
+	// Commands panic into a *PanicError through the Recover middleware, but the checks around them run outside it
+	defer func() {
+		x := recover()
+		if x == nil {
+			return
 		}
+		err := &commands.PanicError{Value: x, Stack: string(debug.Stack())}
+		log.Errors(fmt.Sprintf("Panic while running command %s", ctx.Path()))
+		log.Error(err)
+		log.Errors(err.Stack)
+		commands.RecordInvocation(ctx, time.Since(start), commands.OutcomePanic, commands.ErrorClass(err))
+		handleCommandError(err, ctx, err.Stack)
+	}()
+	release, reason, ok := commands.Admit(ctx)
+	if !ok {
+		commands.RecordInvocation(ctx, time.Since(start), commands.OutcomeRefused, reason)
 		return
 	}
-	log.Errors(fmt.Sprintf("Error in command %s", ctx.ApplicationCommandData().Name))
-	log.Error(err)
-	if stack != "" {
-		log.Errors(stack)
+	defer release()
+	stopDefer := ctx.DeferAfter(commands.AutoDeferDelay)
+	err := cmd(ctx)
+	stopDefer()
+	outcome := commands.OutcomeOK
+	var stack string
+	var panicErr *commands.PanicError
+	if errors.As(err, &panicErr) {
+		outcome = commands.OutcomePanic
+		stack = panicErr.Stack
+	} else if err != nil {
+		outcome = commands.OutcomeError
+	}
+	class := commands.ErrorClass(err)
+	if class == "option" || class == "expired" {
+		// The user's mistake, not the bot's
+		outcome = commands.OutcomeRefused
 	}
-	if ctx.User != nil && ctx.User.ID == ctx.State.Application.Owner.ID {
-		if len(err.Error()) < 1990 {
-			ctx.RespondPrivate(fmt.Sprintf("Error: %s", err.Error()))
+	commands.RecordInvocation(ctx, time.Since(start), outcome, class)
+	if err != nil {
+		handleCommandError(err, ctx, stack)
+	}
+}
+
+func handleCommandError(err error, ctx *commands.Context, stack string) {
+	if errors.Is(err, commands.ErrStateExpired) {
+		ctx.RespondPrivate(ctx.T("commands.expired"))
+		return
+	}
+	var optErr *commands.OptionError
+	if errors.As(err, &optErr) {
+		ctx.RespondPrivate(ctx.T("commands.badOption", optErr.Option, optErr.Msg))
+		return
+	}
+	// Already logged by the Logging middleware
+	id := commands.ReportError(ctx, err, stack)
+	if ctx.Type == discordgo.InteractionMessageComponent {
+		return
+	}
+	if commands.IsOwner(ctx) {
+		if id != 0 {
+			ctx.RespondPrivate(fmt.Sprintf("Error #%d: %s", id, truncateError(err.Error(), 1900)))
 		} else {
-			ctx.RespondPrivate("A lengthy error occured.")
-		}
-	} else {
-		err2 := ctx.RespondPrivate("Sorry, something went wrong. An error report was sent to " + ctx.State.Application.Owner.DisplayName())
-		if err2 == nil {
-			channel, err2 := ctx.Bot.UserChannelCreate(ctx.State.Application.Owner.ID)
-			if err2 == nil {
-				if len(err.Error()) < 1965 {
-					ctx.Bot.ChannelMessageSend(channel.ID, fmt.Sprintf("Error in command %s: %s", ctx.ApplicationCommandData().Name, err.Error()))
-				} else {
-					ctx.Bot.ChannelMessageSend(channel.ID, "A lengthy error occured.")
-				}
-			}
+			ctx.RespondPrivate(fmt.Sprintf("Error: %s", truncateError(err.Error(), 1990)))
 		}
+		return
+	}
+	owner := commands.Owner(ctx.State.Application)
+	if owner == nil {
+		ctx.RespondPrivate(ctx.T("commands.errorNoOwner"))
+		return
+	}
+	err2 := ctx.RespondPrivate(ctx.T("commands.error", owner.DisplayName()))
+	// The errors module sends the owner a digest instead
+	if err2 != nil || id != 0 {
+		return
+	}
+	channel, err2 := ctx.Bot.UserChannelCreate(owner.ID)
+	if err2 == nil {
+		ctx.Bot.ChannelMessageSend(channel.ID, truncateError(fmt.Sprintf("Error in command %s: %s", ctx.Path(), err.Error()), 1990))
+	}
+}
+
+func truncateError(s string, n int) string {
+	if len(s) <= n {
+		return s
 	}
+	return s[:n-3] + "..."
 }
@@ -1,8 +1,11 @@
 package clickart
 
 import (
+	"embed"
 	"fmt"
+	"maps"
 	"math/rand/v2"
+	"slices"
 	"sync"
 	"time"
 
@@ -10,6 +13,9 @@ import (
 	"jlortiz.org/jlort2/modules/commands"
 )
 
+//go:embed locales/*.json
+var catalog embed.FS
+
 type activity struct {
 	reminder   string
 	minBetween time.Duration
@@ -66,6 +72,10 @@ var activities map[string]*activity = map[string]*activity{
 	// 	expected:   time.Minute / 4,
 	// },
 }
+
+// AssetDir holds clicker.ogg and the affirmations folder. It is set from the config before the module starts.
+var AssetDir = "modules/clickart"
+
 var affirmations map[string]affirmationEntry = map[string]affirmationEntry{
 	"cynthia_boy":      {11, 2},
 	"cynthia_girl":     {7, 0},
@@ -79,34 +89,30 @@ var guildUsersMap map[string]string = make(map[string]string)
 var activeUsersLock sync.RWMutex
 
 func clickart(ctx *commands.Context) error {
-	data := ctx.ApplicationCommandData()
-	activity := activities[data.Options[0].StringValue()]
+	var args struct {
+		Activity    string `option:"activity,required"`
+		Training    bool   `option:"training"`
+		Affirmation string `option:"affirmation"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	activity := activities[args.Activity]
 	if activity == nil {
-		return ctx.RespondPrivate("Somehow, you sent an invalid activity called " + data.Options[1].StringValue())
+		return ctx.RespondPrivate(ctx.T("clickart.badActivity", args.Activity))
 	}
-	var training bool
-	var affirmation string
-	for _, opt := range data.Options[1:] {
-		if opt.Name == "training" {
-			training = opt.BoolValue()
-		} else {
-			affirmation = opt.StringValue()
-			_, ok := affirmations[affirmation]
-			if !ok {
-				return ctx.RespondPrivate("Somehow, you sent an invalid affirmation called " + affirmation)
-			}
-		}
+	training, affirmation := args.Training, args.Affirmation
+	if _, ok := affirmations[affirmation]; affirmation != "" && !ok {
+		return ctx.RespondPrivate(ctx.T("clickart.badAffirmation", affirmation))
 	}
 
 	authorVoice, err := ctx.State.VoiceState(ctx.GuildID, ctx.User.ID)
 	if err != nil || authorVoice.ChannelID == "" {
-		return ctx.RespondPrivate("You must be in a voice channel to use this command.")
+		return ctx.RespondPrivate(ctx.T("clickart.notInVoice"))
 	}
-	ctx.Bot.RLock()
-	_, ok := ctx.Bot.VoiceConnections[ctx.GuildID]
-	ctx.Bot.RUnlock()
-	if ok {
-		return ctx.RespondPrivate("There is already a Clickart session active in this server.")
+	if ctx.Bot.VoiceConnection(ctx.GuildID) != nil {
+		return ctx.RespondPrivate(ctx.T("clickart.alreadyActive"))
 	}
 	ch, err := ctx.Bot.UserChannelCreate(ctx.User.ID)
 	if err != nil {
@@ -135,14 +141,14 @@ func clickart(ctx *commands.Context) error {
 	activeUsersLock.Unlock()
 	if training {
 		if affirmation != "" {
-			return ctx.RespondPrivate("ClickArt session started. I will DM you reminders to do the activity; when you do it, use /praiseme to get a click and your chosen affirmation.")
+			return ctx.RespondPrivate(ctx.T("clickart.startedTrainingAffirmation"))
 		}
-		return ctx.RespondPrivate("ClickArt session started. I will DM you reminders to do the activity; when you do it, use /praiseme to get a click.")
+		return ctx.RespondPrivate(ctx.T("clickart.startedTraining"))
 	}
 	if affirmation != "" {
-		return ctx.RespondPrivate("ClickArt session started. When you hear the click, do the activity and use /praiseme to receive an affirmation.")
+		return ctx.RespondPrivate(ctx.T("clickart.startedAffirmation"))
 	}
-	return ctx.RespondPrivate("ClickArt session started. When you hear the click, do the activity and use /praiseme or you won't get a star.")
+	return ctx.RespondPrivate(ctx.T("clickart.started"))
 }
 
 func clickoff(ctx *commands.Context) error {
@@ -162,38 +168,33 @@ func clickoff(ctx *commands.Context) error {
 		total := act.total
 		score := act.score
 		act.Unlock()
-		ctx.Bot.RLock()
-		vc := ctx.Bot.VoiceConnections[ctx.GuildID]
-		ctx.Bot.RUnlock()
-		if vc != nil {
-			vc.Disconnect()
-		}
+		ctx.Bot.VoiceDisconnect(ctx.GuildID)
 		percent := float32(score) / float32(total)
 		var msg string
 		if total < 3 {
-			return ctx.RespondPrivate("ClickArt session finished.\nThis session was too short for a star. Try again next time!")
+			return ctx.RespondPrivate(ctx.T("clickart.tooShort"))
 		} else if percent == 1 {
-			msg = "You got a foil star! Incredible! "
-			if !act.training {
-				msg = " How about switching off training mode next time?"
+			msg = ctx.T("clickart.foil")
+			if act.training {
+				msg += " " + ctx.T("clickart.trainingOff")
 			}
 		} else if percent > 0.95 {
-			msg = "You got a gold star. Excellent work!"
+			msg = ctx.T("clickart.gold")
 			if act.training {
-				msg += " How about switching off training mode next time?"
+				msg += " " + ctx.T("clickart.trainingOff")
 			}
 		} else if percent > 0.9 {
-			msg = "You got a silver star. Good job."
+			msg = ctx.T("clickart.silver")
 		} else if percent > 0.8 {
-			msg = "You got a bronze star."
+			msg = ctx.T("clickart.bronze")
 		} else if percent > 0.2 {
-			msg = "You did not get a star."
+			msg = ctx.T("clickart.noStar")
 		} else {
-			msg = "You tried... I hope."
+			msg = ctx.T("clickart.tried")
 		}
-		return ctx.RespondPrivate(fmt.Sprintf("ClickArt session finished.\nYour score was %d/%d, or %.0f%%.\n%s", score, total, percent*100, msg))
+		return ctx.RespondPrivate(ctx.T("clickart.finished", score, total, percent*100, msg))
 	}
-	return ctx.RespondPrivate("You do not have a ClickArt session.")
+	return ctx.RespondPrivate(ctx.T("clickart.noSession"))
 }
 
 func praiseme(ctx *commands.Context) error {
@@ -216,25 +217,44 @@ func praiseme(ctx *commands.Context) error {
 			go clickItGood(ctx.Bot, ctx.GuildID, act.training, act.affirmation)
 			return ctx.RespondEmpty()
 		}
-		return ctx.RespondPrivate("Good work.")
+		return ctx.RespondPrivate(ctx.T("clickart.goodWork"))
 	} else if !ok {
-		return ctx.RespondPrivate("You do not have a ClickArt session.")
+		return ctx.RespondPrivate(ctx.T("clickart.noSession"))
 	} else if !training {
-		return ctx.RespondPrivate("You have to wait for the clicker, you know.")
+		return ctx.RespondPrivate(ctx.T("clickart.waitClicker"))
 	}
-	return ctx.RespondPrivate("You have to wait for me to tell you to do something, you know.")
+	return ctx.RespondPrivate(ctx.T("clickart.waitPrompt"))
 }
 
-func Init(self *discordgo.Session) {
+type module struct{}
+
+func init() {
+	commands.RegisterModule(module{})
+}
+
+func (module) Name() string {
+	return "clickart"
+}
+
+func (module) Deps() []string {
+	return []string{"commands"}
+}
+
+func (module) Init(self commands.Session) error {
+	err := commands.LoadCatalog(catalog)
+	if err != nil {
+		return err
+	}
 	activityChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(activities))
-	for k := range activities {
+	// Sorted so the choices don't look changed to UploadCommands on every start
+	for _, k := range slices.Sorted(maps.Keys(activities)) {
 		activityChoices = append(activityChoices, &discordgo.ApplicationCommandOptionChoice{
 			Name:  k,
 			Value: k,
 		})
 	}
 	affirmationChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(affirmations))
-	for k := range affirmations {
+	for _, k := range slices.Sorted(maps.Keys(affirmations)) {
 		affirmationChoices = append(affirmationChoices, &discordgo.ApplicationCommandOptionChoice{
 			Name:  k,
 			Value: k,
@@ -249,17 +269,25 @@ func Init(self *discordgo.Session) {
 	})
 	commands.PrepareCommand("clickoff", "Stop your clickart session").Guild().Register(clickoff, nil)
 	commands.PrepareCommand("praiseme", "Did you do your task? Get some praise, then!").Register(praiseme, nil)
+	return nil
 }
 
-func Cleanup(self *discordgo.Session) {
+func (module) Cleanup(self commands.Session) {
 	activeUsersLock.Lock()
 	for k, v := range guildUsersMap {
 		delete(activeUsers, v)
 		delete(guildUsersMap, k)
-		vc := self.VoiceConnections[k]
-		if vc != nil {
-			vc.Disconnect()
-		}
+		self.VoiceDisconnect(k)
 	}
 	activeUsersLock.Unlock()
 }
+
+func (module) Health() error {
+	return nil
+}
+
+func (module) Status() string {
+	activeUsersLock.RLock()
+	defer activeUsersLock.RUnlock()
+	return fmt.Sprintf("%d active sessions", len(activeUsers))
+}
@@ -6,13 +6,15 @@ import (
 	"io"
 	"math/rand/v2"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
 	"jlortiz.org/jlort2/modules/log"
 )
 
-func doClick(self *discordgo.Session, uid string) {
+func doClick(self commands.Session, uid string) {
 	activeUsersLock.RLock()
 	usr := activeUsers[uid]
 	activeUsersLock.RUnlock()
@@ -94,21 +96,21 @@ func cancelOnDc(self *discordgo.Session, event *discordgo.VoiceStateUpdate) {
 	}
 }
 
-func clickItGood(self *discordgo.Session, gid string, click bool, affirmation string) {
-	vc := self.VoiceConnections[gid]
+func clickItGood(self commands.Session, gid string, click bool, affirmation string) {
+	vc := self.VoiceConnection(gid)
 	if vc == nil {
 		return
 	}
 	if click {
-		musicStreamer(vc, "modules/clickart/clicker.ogg")
+		musicStreamer(vc, filepath.Join(AssetDir, "clicker.ogg"))
 	}
 	if affirmation != "" {
 		possible := affirmations[affirmation]
 		var loc string
 		if possible.rare != 0 && rand.N(64) == 0 {
-			loc = fmt.Sprintf("modules/clickart/affirmations/%s_rare_%d.ogg", affirmation, rand.N(possible.rare)+1)
+			loc = filepath.Join(AssetDir, "affirmations", fmt.Sprintf("%s_rare_%d.ogg", affirmation, rand.N(possible.rare)+1))
 		} else {
-			loc = fmt.Sprintf("modules/clickart/affirmations/%s_%d.ogg", affirmation, rand.N(possible.common)+1)
+			loc = filepath.Join(AssetDir, "affirmations", fmt.Sprintf("%s_%d.ogg", affirmation, rand.N(possible.common)+1))
 		}
 		musicStreamer(vc, loc)
 	}
@@ -0,0 +1,169 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package clock lets the time be swapped out, so that recorded events can be replayed as if they were happening now.
+// Code on the paths that replays go through should use it instead of time.Now and time.AfterFunc.
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and runs functions later.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a function waiting to be run. Stop reports whether it was stopped before running.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Real follows the system time. It is the clock in use until Use is called.
+var Real Clock = realClock{}
+
+var lock sync.RWMutex
+var current = Real
+
+// Use replaces the clock. It should be called before anything is started.
+func Use(c Clock) {
+	lock.Lock()
+	defer lock.Unlock()
+	current = c
+}
+
+func get() Clock {
+	lock.RLock()
+	defer lock.RUnlock()
+	return current
+}
+
+// Now returns the current time.
+func Now() time.Time {
+	return get().Now()
+}
+
+// Since returns how long it has been since t.
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// AfterFunc runs f once d has passed.
+func AfterFunc(d time.Duration, f func()) Timer {
+	return get().AfterFunc(d, f)
+}
+
+// Virtual is a clock that only moves when told to.
+// Its timers run on the goroutine that moves it, in the order they come due.
+type Virtual struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers []*virtualTimer
+}
+
+type virtualTimer struct {
+	c    *Virtual
+	when time.Time
+	// Breaks ties so that timers due at the same time run in the order they were made
+	seq uint64
+	f   func()
+}
+
+// NewVirtual returns a clock stopped at start.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+func (c *Virtual) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	t := &virtualTimer{c, c.now.Add(d), c.seq, f}
+	ind, _ := slices.BinarySearchFunc(c.timers, t, compareTimers)
+	c.timers = slices.Insert(c.timers, ind, t)
+	return t
+}
+
+func compareTimers(a, b *virtualTimer) int {
+	if x := a.when.Compare(b.when); x != 0 {
+		return x
+	}
+	if a.seq < b.seq {
+		return -1
+	} else if a.seq > b.seq {
+		return 1
+	}
+	return 0
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.c.lock.Lock()
+	defer t.c.lock.Unlock()
+	ind, found := slices.BinarySearchFunc(t.c.timers, t, compareTimers)
+	if !found {
+		return false
+	}
+	t.c.timers = slices.Delete(t.c.timers, ind, ind+1)
+	return true
+}
+
+// AdvanceTo moves the clock forward to t, running each timer that comes due with the clock set to when it was due.
+// Timers started along the way run too if they come due before t. The clock never moves backwards.
+func (c *Virtual) AdvanceTo(t time.Time) {
+	for {
+		c.lock.Lock()
+		if len(c.timers) == 0 || c.timers[0].when.After(t) {
+			if t.After(c.now) {
+				c.now = t
+			}
+			c.lock.Unlock()
+			return
+		}
+		next := c.timers[0]
+		c.timers = c.timers[1:]
+		if next.when.After(c.now) {
+			c.now = next.when
+		}
+		c.lock.Unlock()
+		next.f()
+	}
+}
+
+// Advance moves the clock forward by d, like AdvanceTo.
+func (c *Virtual) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
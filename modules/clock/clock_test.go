@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clock
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1700000000, 0)
+
+func TestVirtualOrder(t *testing.T) {
+	c := NewVirtual(start)
+	var ran []string
+	at := make(map[string]time.Duration)
+	add := func(name string, d time.Duration) Timer {
+		return c.AfterFunc(d, func() {
+			ran = append(ran, name)
+			at[name] = c.Now().Sub(start)
+		})
+	}
+	add("c", 3*time.Second)
+	add("a", time.Second)
+	add("b1", 2*time.Second)
+	// Same time as b1, so it runs after it
+	add("b2", 2*time.Second)
+	stopped := add("never", 1500*time.Millisecond)
+	add("late", time.Minute)
+
+	if !stopped.Stop() {
+		t.Error("Stop on a waiting timer returned false")
+	}
+	c.Advance(5 * time.Second)
+	want := []string{"a", "b1", "b2", "c"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+	for name, d := range map[string]time.Duration{"a": time.Second, "b1": 2 * time.Second, "b2": 2 * time.Second, "c": 3 * time.Second} {
+		if at[name] != d {
+			t.Errorf("%s ran at %v, want %v", name, at[name], d)
+		}
+	}
+	if got := c.Now().Sub(start); got != 5*time.Second {
+		t.Errorf("clock is at %v after advancing, want 5s", got)
+	}
+	if stopped.Stop() {
+		t.Error("Stop on a stopped timer returned true")
+	}
+}
+
+func TestVirtualNestedTimers(t *testing.T) {
+	c := NewVirtual(start)
+	var ran []string
+	c.AfterFunc(time.Second, func() {
+		ran = append(ran, "outer")
+		// Due before the clock reaches its target, so it runs during the same Advance
+		c.AfterFunc(time.Second, func() { ran = append(ran, "inner") })
+		c.AfterFunc(time.Hour, func() { ran = append(ran, "later") })
+	})
+	c.Advance(3 * time.Second)
+	want := []string{"outer", "inner"}
+	if !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+}
+
+func TestVirtualNeverBackwards(t *testing.T) {
+	c := NewVirtual(start)
+	ran := false
+	timer := c.AfterFunc(time.Second, func() { ran = true })
+	c.AdvanceTo(start.Add(-time.Hour))
+	if !c.Now().Equal(start) {
+		t.Errorf("clock moved back to %v", c.Now())
+	}
+	if ran {
+		t.Error("timer ran without the clock reaching it")
+	}
+	c.AdvanceTo(start.Add(time.Second))
+	if !ran {
+		t.Error("timer didn't run when it came due")
+	}
+	if timer.Stop() {
+		t.Error("Stop on a timer that ran returned true")
+	}
+}
+
+func TestUse(t *testing.T) {
+	c := NewVirtual(start)
+	Use(c)
+	t.Cleanup(func() { Use(Real) })
+	ran := false
+	AfterFunc(time.Minute, func() { ran = true })
+	c.Advance(time.Minute)
+	if !ran {
+		t.Error("AfterFunc didn't use the virtual clock")
+	}
+	if got := Since(start); got != time.Minute {
+		t.Errorf("Since = %v, want 1m", got)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var startTime = time.Now()
+
+// IsOwner reports whether the invoking user owns the bot or is on the team that does.
+func IsOwner(ctx *Context) bool {
+	app := ctx.State.Application
+	if ctx.User == nil || app == nil {
+		return false
+	}
+	if app.Owner != nil && ctx.User.ID == app.Owner.ID {
+		return true
+	}
+	if app.Team != nil {
+		for _, m := range app.Team.Members {
+			if m.User != nil && m.User.ID == ctx.User.ID && m.MembershipState == discordgo.MembershipStateAccepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Owner returns the user who owns the bot, or the owner of the team that does.
+// It returns nil if the application hasn't been loaded or the owner isn't known.
+func Owner(app *discordgo.Application) *discordgo.User {
+	if app == nil {
+		return nil
+	}
+	if app.Team != nil {
+		for _, m := range app.Team.Members {
+			if m.User != nil && m.User.ID == app.Team.OwnerID {
+				return m.User
+			}
+		}
+	}
+	return app.Owner
+}
+
+// OwnerOnly refuses to run the command for anyone but the bot's owner or team.
+func OwnerOnly(next Command) Command {
+	return func(ctx *Context) error {
+		if !IsOwner(ctx) {
+			return ctx.RespondPrivate(ctx.T("commands.ownerOnly"))
+		}
+		return next(ctx)
+	}
+}
+
+// ~!admin module enable <name>
+// ~!admin module disable <name>
+// @OwnerOnly
+// Turns a module on or off without restarting
+// The choice is remembered across restarts.
+func adminModule(ctx *Context) error {
+	var args struct {
+		Name string `option:"name,required"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	name := args.Name
+	// Starting a module and syncing commands can take a while
+	err = ctx.RespondDelayed(true)
+	if err != nil {
+		return err
+	}
+	enable := strings.HasSuffix(ctx.Path(), " enable")
+	if enable {
+		err = EnableModule(ctx.Bot, name)
+	} else {
+		err = DisableModule(ctx.Bot, name)
+	}
+	if err != nil {
+		return ctx.RespondEdit(ctx.T("commands.moduleFailed", name, err.Error()))
+	}
+	if enable {
+		return ctx.RespondEdit(ctx.T("commands.moduleEnabled", name))
+	}
+	return ctx.RespondEdit(ctx.T("commands.moduleDisabled", name))
+}
+
+func adminModuleAuto(ctx *Context) []*discordgo.ApplicationCommandOptionChoice {
+	_, typed := ctx.Focused()
+	prefix := strings.ToLower(typed)
+	moduleLock.Lock()
+	names := make([]string, 0, len(modules))
+	for k := range modules {
+		if k != "commands" && strings.HasPrefix(k, prefix) {
+			names = append(names, k)
+		}
+	}
+	moduleLock.Unlock()
+	slices.Sort(names)
+	if len(names) > 25 {
+		names = names[:25]
+	}
+	out := make([]*discordgo.ApplicationCommandOptionChoice, len(names))
+	for i, x := range names {
+		out[i] = &discordgo.ApplicationCommandOptionChoice{Name: x, Value: x}
+	}
+	return out
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func fileSize(name string) string {
+	info, err := os.Stat(name)
+	if err != nil {
+		return "none"
+	}
+	return formatBytes(uint64(info.Size()))
+}
+
+// ~!admin status
+// @OwnerOnly
+// Shows how the bot is doing
+func adminStatus(ctx *Context) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	guilds, members, voice := 0, 0, 0
+	ctx.State.RLock()
+	for _, g := range ctx.State.Guilds {
+		guilds++
+		members += len(g.Members)
+		if ctx.Bot.VoiceConnection(g.ID) != nil {
+			voice++
+		}
+	}
+	ctx.State.RUnlock()
+	output := new(strings.Builder)
+	for _, m := range ModuleStatuses() {
+		switch {
+		case !m.Running:
+			fmt.Fprintf(output, "%s: off (%v)\n", m.Name, m.Err)
+		case m.Err != nil:
+			fmt.Fprintf(output, "%s: unhealthy (%v)\n", m.Name, m.Err)
+		case m.Info != "":
+			fmt.Fprintf(output, "%s: %s\n", m.Name, m.Info)
+		default:
+			fmt.Fprintf(output, "%s: ok\n", m.Name)
+		}
+	}
+	embed := new(discordgo.MessageEmbed)
+	embed.Title = "Status"
+	embed.Color = 0x7289da
+	embed.Fields = []*discordgo.MessageEmbedField{
+		{Name: "Uptime", Value: time.Since(startTime).Round(time.Second).String(), Inline: true},
+		{Name: "Latency", Value: ctx.Bot.HeartbeatLatency().Round(time.Millisecond).String(), Inline: true},
+		{Name: "Goroutines", Value: fmt.Sprint(runtime.NumGoroutine()), Inline: true},
+		{Name: "Heap", Value: fmt.Sprintf("%s in use, %s from OS, %d GCs", formatBytes(mem.HeapAlloc), formatBytes(mem.HeapSys), mem.NumGC), Inline: true},
+		{Name: "Database", Value: fmt.Sprintf("%s, WAL %s", fileSize(dbFile), fileSize(dbFile+"-wal")), Inline: true},
+		{Name: "Cache", Value: fmt.Sprintf("%d servers, %d members", guilds, members), Inline: true},
+		{Name: "Voice", Value: fmt.Sprintf("%d connections", voice), Inline: true},
+		{Name: "Modules", Value: output.String()},
+	}
+	return ctx.RespondEmbed(embed, true)
+}
+
+// ~!admin gc
+// @OwnerOnly
+// Runs the garbage collector and gives memory back to the OS
+func adminGC(ctx *Context) error {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	debug.FreeOSMemory()
+	took := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return ctx.RespondPrivate(fmt.Sprintf("Heap went from %s to %s in use and %s to %s from OS in %s.",
+		formatBytes(before.HeapAlloc), formatBytes(after.HeapAlloc), formatBytes(before.HeapSys-before.HeapReleased), formatBytes(after.HeapSys-after.HeapReleased), took.Round(time.Microsecond)))
+}
+
+// ~!admin dumpgoroutines
+// @OwnerOnly
+// Sends the stack of every goroutine as a file
+func adminGoroutines(ctx *Context) error {
+	buf := new(bytes.Buffer)
+	err := pprof.Lookup("goroutine").WriteTo(buf, 2)
+	if err != nil {
+		return fmt.Errorf("failed to dump goroutines: %w", err)
+	}
+	ctx.AttachFile(fmt.Sprintf("goroutines-%d.txt", time.Now().Unix()), "text/plain", buf)
+	return ctx.RespondPrivate(fmt.Sprintf("%d goroutines", runtime.NumGoroutine()))
+}
@@ -0,0 +1,43 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands_test
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
+)
+
+func TestOwner(t *testing.T) {
+	if commands.Owner(nil) != nil {
+		t.Error("owner without an application")
+	}
+	user := &discordgo.User{ID: "1"}
+	if got := commands.Owner(&discordgo.Application{Owner: user}); got != user {
+		t.Errorf("owner %+v", got)
+	}
+	lead := &discordgo.User{ID: "3"}
+	team := &discordgo.Team{OwnerID: "3", Members: []*discordgo.TeamMember{{User: &discordgo.User{ID: "2"}}, {User: lead}}}
+	if got := commands.Owner(&discordgo.Application{Team: team}); got != lead {
+		t.Errorf("team owner %+v", got)
+	}
+	if got := commands.Owner(&discordgo.Application{Team: &discordgo.Team{OwnerID: "4"}}); got != nil {
+		t.Errorf("unknown team owner %+v", got)
+	}
+}
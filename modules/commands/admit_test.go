@@ -0,0 +1,74 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
+)
+
+func TestAdmitCooldownBeforeExpensive(t *testing.T) {
+	commands.PrepareCommand("admittest", "Test command").Cooldown(commands.CooldownUser, time.Hour, 1).Expensive().Register(func(*commands.Context) error { return nil }, nil)
+	users := make([]*discordgo.User, commands.MaxExpensive+2)
+	for i := range users {
+		users[i] = &discordgo.User{ID: strconv.Itoa(100 + i), Username: "user" + strconv.Itoa(i)}
+	}
+	admit := func(u *discordgo.User) (func(), string) {
+		ctx := commands.MakeContext(bot, bot.Command(u, "", bot.NewID(), "admittest"))
+		release, reason, ok := commands.Admit(ctx)
+		if ok != (reason == "") {
+			t.Fatalf("ok is %v with reason %q", ok, reason)
+		}
+		return release, reason
+	}
+
+	// Fill the expensive pool
+	releases := make([]func(), commands.MaxExpensive)
+	for i := range releases {
+		var reason string
+		releases[i], reason = admit(users[i])
+		if reason != "" {
+			t.Fatalf("user %d refused: %s", i, reason)
+		}
+	}
+	// A user on cooldown is told so even though the pool is full
+	if _, reason := admit(users[0]); reason != "cooldown" {
+		t.Errorf("user on cooldown with a full pool refused for %q", reason)
+	}
+	if _, reason := admit(users[len(users)-2]); reason != "busy" {
+		t.Errorf("new user with a full pool refused for %q", reason)
+	}
+
+	// Refusing for the cooldown doesn't take the free slot
+	releases[0]()
+	if _, reason := admit(users[0]); reason != "cooldown" {
+		t.Errorf("user on cooldown refused for %q", reason)
+	}
+	release, reason := admit(users[len(users)-1])
+	if reason != "" {
+		t.Fatalf("new user with a free slot refused: %s", reason)
+	}
+	release()
+	for _, f := range releases[1:] {
+		f()
+	}
+}
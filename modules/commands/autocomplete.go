@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"maps"
+	"runtime/debug"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// Discord shows at most this many suggestions
+const maxChoices = 25
+
+// AutoOption sets the autocompleter for one option, which is marked for autocomplete when the command is registered.
+// It takes priority over the autocompleter set with Auto.
+func (c commandStruct) AutoOption(option string, a Autocompleter) commandStruct {
+	m := maps.Clone(c.optionAuto)
+	if m == nil {
+		m = make(map[string]Autocompleter)
+	}
+	m[option] = a
+	c.optionAuto = m
+	return c
+}
+
+// markAutocomplete turns on autocomplete for the options that have an autocompleter.
+func markAutocomplete(name string, options []*discordgo.ApplicationCommandOption, auto map[string]Autocompleter) {
+	for k := range auto {
+		found := false
+		for _, o := range options {
+			if o.Name == k {
+				o.Autocomplete = true
+				o.Choices = nil
+				found = true
+				break
+			}
+		}
+		if !found {
+			panic("autocompleter for unknown option " + k + " of " + name)
+		}
+	}
+}
+
+// Focused returns the name of the option being typed in and what has been typed so far.
+func (ctx *Context) Focused() (string, string) {
+	if ctx.Type != discordgo.InteractionApplicationCommandAutocomplete {
+		return "", ""
+	}
+	for _, o := range ctx.Options() {
+		if o.Focused {
+			if o.Value == nil {
+				return o.Name, ""
+			}
+			return o.Name, fmt.Sprint(o.Value)
+		}
+	}
+	return "", ""
+}
+
+// Autocomplete suggests values for the option being typed in.
+// It uses the option's autocompleter, falling back to the command's. With neither, or if it panics, there are no suggestions.
+func Autocomplete(ctx *Context) (out []*discordgo.ApplicationCommandOptionChoice) {
+	defer func() {
+		x := recover()
+		if x != nil {
+			log.Errors(fmt.Sprintf("Panic in autocomplete for %s: %v", ctx.Path(), x))
+			log.Errors(string(debug.Stack()))
+			out = nil
+		}
+		// Discord wants a list even if it is empty
+		if out == nil {
+			out = []*discordgo.ApplicationCommandOptionChoice{}
+		}
+	}()
+	name, _ := ctx.Focused()
+	e := lookup(ctx.Path())
+	a := e.ao[name]
+	if a == nil {
+		a = e.a
+	}
+	if a == nil {
+		return nil
+	}
+	out = a(ctx)
+	if len(out) > maxChoices {
+		out = out[:maxChoices]
+	}
+	return out
+}
+
+// ChoiceName shortens s to fit in the name of a suggestion.
+func ChoiceName(s string) string {
+	if utf8.RuneCountInString(s) <= 100 {
+		return s
+	}
+	return string([]rune(s)[:99]) + "…"
+}
@@ -19,10 +19,10 @@ package commands
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"math/rand"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
@@ -39,6 +39,13 @@ import (
 // To specify a user other than me, you need the Manage Messages permission.
 // Due to Discord limitations, this only scans the 100 most recent messages.
 func purge(ctx *Context) error {
+	var args struct {
+		User *discordgo.User `option:"user"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
 	ctx.RespondDelayed(true)
 	if ctx.GuildID == "" {
 		msgs, err := ctx.Bot.ChannelMessages(ctx.ChannelID, 100, "", "", "")
@@ -59,26 +66,16 @@ func purge(ctx *Context) error {
 		}
 		return ctx.RespondPrivate(fmt.Sprintf("Purged %d messages", len(todel)))
 	}
-	if ctx.AppPermissions&discordgo.PermissionManageMessages == 0 {
-		return ctx.RespondPrivate("I need the Manage Messages permission to use this command.")
-	}
 	target := ctx.Me.ID
 	d := ctx.ApplicationCommandData()
 	if d.TargetID != "" {
 		target = d.TargetID
-	} else if len(d.Options) != 0 {
-		args := d.Options[0].UserValue(nil)
+	} else if args.User != nil {
 		// Uncomment this if Perms(discordgo.ManageMessages) is removed for this command
-		// if args.ID != target {
-		// 	perms, err := ctx.State.UserChannelPermissions(ctx.User.ID, ctx.ChannelID)
-		// 	if err != nil {
-		// 		return fmt.Errorf("failed to get permissions: %w", err)
-		// 	}
-		// 	if perms&discordgo.PermissionManageMessages == 0 {
-		// 		return ctx.RespondPrivate("You need the Manage Messages permission to purge other people's messages.")
-		// 	}
+		// if args.User.ID != target && !ctx.HasPermission(discordgo.PermissionManageMessages) {
+		// 	return ctx.RespondPrivate("You need the Manage Messages permission to purge other people's messages.")
 		// }
-		target = args.ID
+		target = args.User.ID
 	}
 	msgs, err := ctx.Bot.ChannelMessages(ctx.ChannelID, 100, "", "", "")
 	if err != nil {
@@ -109,8 +106,15 @@ func purge(ctx *Context) error {
 // You need Manage Messages to use this command.
 // Due to library limitations, this only scans the 100 most recent messages, and then only on messages from the last 2 weeks.
 func ppurge(ctx *Context) error {
+	var args struct {
+		Prefix string `option:"prefix,required,min=1"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
 	ctx.RespondDelayed(true)
-	prefix := ctx.ApplicationCommandData().Options[0].StringValue()
+	prefix := args.Prefix
 	msgs, err := ctx.Bot.ChannelMessages(ctx.ChannelID, 100, "", "", "")
 	if err != nil {
 		return fmt.Errorf("failed to get message list: %w", err)
@@ -154,16 +158,19 @@ func version(ctx *Context) error {
 // Flips a coin
 // If times is provided, flips multiple coins.
 func flip(ctx *Context) error {
-	count := 1
-	args := ctx.ApplicationCommandData().Options
-	if len(args) > 0 {
-		count = int(args[0].IntValue())
+	args := struct {
+		Coins int `option:"coins,min=1,max=255"`
+	}{Coins: 1}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
 	}
+	count := args.Coins
 	if count == 1 {
 		if rand.Int()&1 == 0 {
-			return ctx.Respond("Heads")
+			return ctx.Respond(ctx.T("commands.heads"))
 		}
-		return ctx.Respond("Tails")
+		return ctx.Respond(ctx.T("commands.tails"))
 	}
 	heads := 0
 	for range count {
@@ -171,65 +178,147 @@ func flip(ctx *Context) error {
 			heads++
 		}
 	}
-	return ctx.Respond(fmt.Sprintf("%d/%d coins were heads", heads, count))
+	return ctx.Respond(ctx.T("commands.coins", heads, count))
 }
 
 // ~!roll [count]
 // Rolls a six-sided die
 // If count is provided, rolls multiple.
 func roll(ctx *Context) error {
-	count := 1
-	sides := 6
-	if diceOpt := ctx.ApplicationCommandData().GetOption("dice"); diceOpt != nil {
-		count = int(diceOpt.IntValue())
-	}
-	if sidesOpt := ctx.ApplicationCommandData().GetOption("sides"); sidesOpt != nil {
-		sides = int(sidesOpt.IntValue())
+	args := struct {
+		Dice  int `option:"dice,min=1,max=255"`
+		Sides int `option:"sides,min=3,max=120"`
+	}{Dice: 1, Sides: 6}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
 	}
+	count, sides := args.Dice, args.Sides
 	total := count
 	for range count {
 		total += rand.Intn(sides)
 	}
 	if count != 1 || sides != 6 {
-		return ctx.Respond(fmt.Sprintf("Rolled %d using %dd%d", total, count, sides))
+		return ctx.Respond(ctx.T("commands.rolledDice", total, count, sides))
+	}
+	return ctx.Respond(ctx.T("commands.rolled", total))
+}
+
+// Where everything the bot remembers is kept
+var dbFile = "persistent.db"
+
+// PingDatabase checks that the database can be reached.
+func PingDatabase() error {
+	if db == nil {
+		return errors.New("the database is not open")
+	}
+	return db.Ping()
+}
+
+// SetDatabaseFile changes where the database is kept. It must be called before the modules are started.
+func SetDatabaseFile(name string) {
+	dbFile = name
+}
+
+// createTables makes any tables in schema that don't exist yet, so that databases made by older versions keep working.
+// Every statement in it should use IF NOT EXISTS, and match dbGen.sql.
+func createTables(schema string) error {
+	_, err := db.Exec(schema)
+	if err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
 	}
-	return ctx.Respond("Rolled " + strconv.Itoa(total))
+	return nil
+}
+
+type baseModule struct{}
+
+func init() {
+	RegisterModule(baseModule{})
+}
+
+func (baseModule) Name() string {
+	return "commands"
+}
+
+func (baseModule) Deps() []string {
+	return nil
 }
 
-// Init is defined in the command interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
-// Here, it also initializes the command map. This means that calling commands.Init will unregister any existing commands.
-func Init(self *discordgo.Session) {
+// Init is defined in the Module interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
+// Here, it also initializes the command map and opens the database, which every other module depends on.
+func (baseModule) Init(self Session) error {
 	cmdMap = make(map[string]cmdMapEntry, 64)
 	var err error
-	db, err = sql.Open("sqlite3", "persistent.db")
+	db, err = sql.Open("sqlite3", dbFile)
 	if err != nil {
-		log.Error(err)
-		return
+		return fmt.Errorf("failed to open database: %w", err)
 	}
 	db.Exec("pragma journal_mode = WAL; pragma synchronous = normal; pragma mmap_size = 4194304;")
-	PrepareCommand("purge", "Delete messages by user").Perms(discordgo.PermissionManageMessages).Register(purge, []*discordgo.ApplicationCommandOption{
+	err = createTables(`CREATE TABLE IF NOT EXISTS guildCommands (
+		gid INTEGER,
+		name VARCHAR(32),
+		PRIMARY KEY (gid, name)
+	);
+	CREATE TABLE IF NOT EXISTS disabledModules (
+		name VARCHAR(32) PRIMARY KEY
+	);`)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	stmtDisabled, err = db.Prepare("SELECT 1 FROM guildCommands WHERE gid=?001 AND name=?002;")
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	self.AddHandler(onGuildDeleteCommands)
+	PrepareCommand("purge", "Delete messages by user").Perms(discordgo.PermissionManageMessages).Use(BotPerms(discordgo.PermissionManageMessages)).Register(purge, []*discordgo.ApplicationCommandOption{
 		NewCommandOption("user", "User to purge, default me").AsUser().Finalize(),
 	})
-	PrepareCommand("Purge Messages", "").AsUser().Guild().Perms(discordgo.PermissionManageMessages).Register(purge, nil)
-	PrepareCommand("ppurge", "Delete messages by prefix").Guild().Perms(discordgo.PermissionManageMessages).Register(ppurge, []*discordgo.ApplicationCommandOption{
+	PrepareCommand("Purge Messages", "").AsUser().Guild().Perms(discordgo.PermissionManageMessages).Use(BotPerms(discordgo.PermissionManageMessages)).Register(purge, nil)
+	PrepareCommand("ppurge", "Delete messages by prefix").Guild().Perms(discordgo.PermissionManageMessages).Use(BotPerms(discordgo.PermissionManageMessages)).Register(ppurge, []*discordgo.ApplicationCommandOption{
 		NewCommandOption("prefix", "Messages that start with this will be deleted").AsString().Required().Finalize(),
 	})
 	PrepareCommand("ping", "Get bot latency").Register(ping, nil)
 	PrepareCommand("version", "Get version info").Register(version, nil)
-	PrepareCommand("flip", "Flip one or more coins").Register(flip, []*discordgo.ApplicationCommandOption{
+	PrepareCommand("flip", "Flip one or more coins").Cooldown(CooldownUser, 2*time.Second, 5).Register(flip, []*discordgo.ApplicationCommandOption{
 		NewCommandOption("coins", "How many coins to flip").AsInt().SetMinMax(1, 255).Finalize(),
 	})
-	PrepareCommand("roll", "Roll one or more D6").Register(roll, []*discordgo.ApplicationCommandOption{
+	PrepareCommand("commands", "Turn commands on or off for this server").Guild().Perms(discordgo.PermissionManageGuild).Register(nil, nil)
+	PrepareCommand("commands enable", "Allow a command to be used here").AutoOption("command", toggleCommandAuto).Register(toggleCommand, []*discordgo.ApplicationCommandOption{
+		NewCommandOption("command", "Name of the command").AsString().Required().Finalize(),
+	})
+	PrepareCommand("commands disable", "Stop a command from being used here").AutoOption("command", toggleCommandAuto).Register(toggleCommand, []*discordgo.ApplicationCommandOption{
+		NewCommandOption("command", "Name of the command").AsString().Required().Finalize(),
+	})
+	PrepareCommand("admin", "Bot owner tools").Use(OwnerOnly).Register(nil, nil)
+	PrepareCommand("admin status", "Show how the bot is doing").Register(adminStatus, nil)
+	PrepareCommand("admin gc", "Run the garbage collector").Register(adminGC, nil)
+	PrepareCommand("admin dumpgoroutines", "Get the stack of every goroutine").Register(adminGoroutines, nil)
+	PrepareCommand("admin module", "Turn parts of the bot on or off").Register(nil, nil)
+	PrepareCommand("admin module enable", "Start a module").AutoOption("name", adminModuleAuto).Register(adminModule, []*discordgo.ApplicationCommandOption{
+		NewCommandOption("name", "Name of the module").AsString().Required().Finalize(),
+	})
+	PrepareCommand("admin module disable", "Stop a module").AutoOption("name", adminModuleAuto).Register(adminModule, []*discordgo.ApplicationCommandOption{
+		NewCommandOption("name", "Name of the module").AsString().Required().Finalize(),
+	})
+	PrepareCommand("roll", "Roll one or more D6").Cooldown(CooldownUser, 2*time.Second, 5).Register(roll, []*discordgo.ApplicationCommandOption{
 		NewCommandOption("dice", "How many dice to roll").AsInt().SetMinMax(1, 255).Finalize(),
 		NewCommandOption("sides", "How many sides to each die").AsInt().SetMinMax(3, 120).Finalize(),
 	})
+	return nil
 }
 
-// Cleanup is defined in the command interface to clean up the module when the bot unloads.
-func Cleanup(_ *discordgo.Session) {
+// Cleanup is defined in the Module interface to clean up the module when the bot unloads.
+func (baseModule) Cleanup(_ Session) {
+	stmtDisabled.Close()
 	db.Exec("PRAGMA optimize;")
 	err := db.Close()
 	if err != nil {
 		log.Error(err)
 	}
 }
+
+func (baseModule) Health() error {
+	return db.Ping()
+}
@@ -0,0 +1,247 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// OptionError means the options a command got do not fit what its handler expects.
+// The dispatcher shows the message to the user privately instead of treating it as a crash.
+type OptionError struct {
+	Option string
+	Msg    string
+}
+
+func (e *OptionError) Error() string {
+	return e.Option + ": " + e.Msg
+}
+
+type bindField struct {
+	name     string
+	required bool
+	min, max *float64
+}
+
+func parseBindTag(f reflect.StructField) (bindField, bool) {
+	tag, ok := f.Tag.Lookup("option")
+	if !ok || tag == "-" {
+		return bindField{}, false
+	}
+	parts := strings.Split(tag, ",")
+	out := bindField{name: parts[0]}
+	if out.name == "" {
+		out.name = strings.ToLower(f.Name)
+	}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		switch k {
+		case "required":
+			out.required = true
+		case "min", "max":
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				panic("bad " + k + " in option tag of " + f.Name)
+			}
+			if k == "min" {
+				out.min = &n
+			} else {
+				out.max = &n
+			}
+		default:
+			panic("unknown option tag " + k + " on " + f.Name)
+		}
+	}
+	return out, true
+}
+
+// Bind fills the struct that dst points to from the invoked command's leaf options.
+// Fields are matched by the option tag, which holds the option name and optionally required, min=N and max=N:
+//
+//	var args struct {
+//		Index int             `option:"index,min=1,max=200"`
+//		User  *discordgo.User `option:"user,required"`
+//	}
+//
+// Fields can be strings, ints, floats, bools, or pointers to them to tell a missing option from a zero one.
+// Fields for missing options are left alone, so defaults can be filled in before calling Bind.
+// Users, members, channels and roles are taken from the resolved data. For strings, min and max limit the length.
+// If an option is missing, has the wrong type or is out of range, Bind returns an *OptionError.
+func (ctx *Context) Bind(dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		panic("Bind needs a pointer to a struct")
+	}
+	v = v.Elem()
+	t := v.Type()
+	opts := make(map[string]*discordgo.ApplicationCommandInteractionDataOption)
+	var resolved *discordgo.ApplicationCommandInteractionDataResolved
+	if ctx.Type == discordgo.InteractionApplicationCommand || ctx.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		for _, o := range ctx.Options() {
+			opts[o.Name] = o
+		}
+		resolved = ctx.ApplicationCommandData().Resolved
+	}
+	for i := range t.NumField() {
+		f, ok := parseBindTag(t.Field(i))
+		if !ok {
+			continue
+		}
+		opt := opts[f.name]
+		if opt == nil || opt.Value == nil {
+			if f.required {
+				return &OptionError{f.name, "this option is required"}
+			}
+			continue
+		}
+		err := bindValue(ctx.State, v.Field(i), opt, resolved)
+		if err != nil {
+			return &OptionError{f.name, err.Error()}
+		}
+		err = f.checkRange(v.Field(i))
+		if err != nil {
+			return &OptionError{f.name, err.Error()}
+		}
+	}
+	return nil
+}
+
+func bindValue(state *discordgo.State, fv reflect.Value, opt *discordgo.ApplicationCommandInteractionDataOption, resolved *discordgo.ApplicationCommandInteractionDataResolved) error {
+	if resolved == nil {
+		resolved = new(discordgo.ApplicationCommandInteractionDataResolved)
+	}
+	id, _ := opt.Value.(string)
+	switch fv.Type() {
+	case reflect.TypeFor[*discordgo.User]():
+		u := resolved.Users[id]
+		if u == nil {
+			if opt.Type != discordgo.ApplicationCommandOptionUser && opt.Type != discordgo.ApplicationCommandOptionMentionable {
+				return fmt.Errorf("expected a user")
+			}
+			u = &discordgo.User{ID: id}
+		}
+		fv.Set(reflect.ValueOf(u))
+		return nil
+	case reflect.TypeFor[*discordgo.Member]():
+		m := resolved.Members[id]
+		if m == nil {
+			return fmt.Errorf("expected a member of this server")
+		}
+		if m.User == nil {
+			m.User = resolved.Users[id]
+		}
+		fv.Set(reflect.ValueOf(m))
+		return nil
+	case reflect.TypeFor[*discordgo.Channel]():
+		c := resolved.Channels[id]
+		if c == nil {
+			if opt.Type != discordgo.ApplicationCommandOptionChannel {
+				return fmt.Errorf("expected a channel")
+			}
+			// A bare channel would pass for a text channel, so its type has to come from somewhere
+			var err error
+			c, err = state.Channel(id)
+			if err != nil {
+				return fmt.Errorf("unknown channel")
+			}
+		}
+		fv.Set(reflect.ValueOf(c))
+		return nil
+	case reflect.TypeFor[*discordgo.Role]():
+		r := resolved.Roles[id]
+		if r == nil {
+			if opt.Type != discordgo.ApplicationCommandOptionRole && opt.Type != discordgo.ApplicationCommandOptionMentionable {
+				return fmt.Errorf("expected a role")
+			}
+			r = &discordgo.Role{ID: id}
+		}
+		fv.Set(reflect.ValueOf(r))
+		return nil
+	}
+	if fv.Kind() == reflect.Pointer {
+		fv.Set(reflect.New(fv.Type().Elem()))
+		fv = fv.Elem()
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		s, ok := opt.Value.(string)
+		if !ok {
+			return fmt.Errorf("expected text")
+		}
+		fv.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := opt.Value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("expected a whole number")
+		}
+		if fv.OverflowInt(int64(n)) {
+			return fmt.Errorf("number is too large")
+		}
+		fv.SetInt(int64(n))
+	case reflect.Float32, reflect.Float64:
+		n, ok := opt.Value.(float64)
+		if !ok {
+			return fmt.Errorf("expected a number")
+		}
+		fv.SetFloat(n)
+	case reflect.Bool:
+		b, ok := opt.Value.(bool)
+		if !ok {
+			return fmt.Errorf("expected true or false")
+		}
+		fv.SetBool(b)
+	default:
+		panic("unsupported option field type " + fv.Type().String())
+	}
+	return nil
+}
+
+func (f bindField) checkRange(fv reflect.Value) error {
+	if f.min == nil && f.max == nil {
+		return nil
+	}
+	if fv.Kind() == reflect.Pointer {
+		fv = fv.Elem()
+	}
+	var n float64
+	unit := ""
+	switch fv.Kind() {
+	case reflect.String:
+		n = float64(utf8.RuneCountInString(fv.String()))
+		unit = " characters"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(fv.Int())
+	case reflect.Float32, reflect.Float64:
+		n = fv.Float()
+	default:
+		return nil
+	}
+	if f.min != nil && n < *f.min {
+		return fmt.Errorf("must be at least %g%s", *f.min, unit)
+	}
+	if f.max != nil && n > *f.max {
+		return fmt.Errorf("must be at most %g%s", *f.max, unit)
+	}
+	return nil
+}
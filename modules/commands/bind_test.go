@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
+)
+
+func TestBindChannelWithoutResolved(t *testing.T) {
+	gid, text, voice := bot.NewID(), bot.NewID(), bot.NewID()
+	bot.AddGuild(&discordgo.Guild{
+		ID:      gid,
+		Name:    t.Name(),
+		OwnerID: owner.ID,
+		Channels: []*discordgo.Channel{
+			{ID: text, Name: "general", Type: discordgo.ChannelTypeGuildText},
+			{ID: voice, Name: "voice", Type: discordgo.ChannelTypeGuildVoice},
+		},
+		Members: []*discordgo.Member{{User: owner}},
+	})
+	bind := func(id string) (*discordgo.Channel, error) {
+		opt := &discordgo.ApplicationCommandInteractionDataOption{Name: "channel", Type: discordgo.ApplicationCommandOptionChannel, Value: id}
+		ctx := commands.MakeContext(bot, bot.Command(owner, gid, text, "test", opt))
+		var args struct {
+			Channel *discordgo.Channel `option:"channel"`
+		}
+		err := ctx.Bind(&args)
+		return args.Channel, err
+	}
+
+	c, err := bind(voice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != voice || c.Type != discordgo.ChannelTypeGuildVoice {
+		t.Errorf("bound %+v", c)
+	}
+	_, err = bind(bot.NewID())
+	var optErr *commands.OptionError
+	if !errors.As(err, &optErr) || optErr.Option != "channel" {
+		t.Errorf("unknown channel: %v", err)
+	}
+}
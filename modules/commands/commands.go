@@ -19,14 +19,23 @@ package commands
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"strconv"
+	"io"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
+	"jlortiz.org/jlort2/modules/log"
 )
 
+// How long a handler has to respond before the dispatcher defers for it.
+// Discord gives up on an interaction after three seconds.
+const AutoDeferDelay = 2500 * time.Millisecond
+
 var db *sql.DB
 
 // Context is a helper struct for defining a command invokation context.
@@ -34,22 +43,53 @@ var db *sql.DB
 type Context struct {
 	*discordgo.Interaction
 
-	Bot        *discordgo.Session
+	Bot        Session
 	Me         *discordgo.User
 	State      *discordgo.State
 	Database   *sql.DB
 	origName   string
+	path       string
 	followup   string
 	components []discordgo.MessageComponent
-	hasDelayed bool
+	files      []*discordgo.File
+	// Set by SetComponents and returned by the next response instead of sending it
+	componentErr error
+	// Held while responding, since the dispatcher may defer from another goroutine
+	respLock       sync.Mutex
+	responded      bool
+	hasDelayed     bool
+	delayedPrivate bool
+	autoDeferred   bool
+	// Set for text commands, which reply with normal messages
+	message      *discordgo.Message
+	reply        string
+	replyChannel string
+}
+
+// takeComponentErr returns the error from the last SetComponents, if any, and clears it.
+func (ctx *Context) takeComponentErr() error {
+	err := ctx.componentErr
+	ctx.componentErr = nil
+	return err
 }
 
 func (ctx *Context) resp(msg string, embed *discordgo.MessageEmbed, private bool) error {
+	if err := ctx.takeComponentErr(); err != nil {
+		return err
+	}
+	if ctx.message != nil {
+		embeds := []*discordgo.MessageEmbed{}
+		if embed != nil {
+			embeds = append(embeds, embed)
+		}
+		return ctx.respMessage(&msg, &embeds, private)
+	}
 	if ctx.followup == "0" {
-		ctx.RespondDelayed(private)
+		ctx.deferResp(private)
 		data := new(discordgo.WebhookParams)
 		data.Content = msg
 		data.Components = ctx.components
+		data.Files = ctx.files
 		if private {
 			data.Flags = discordgo.MessageFlagsEphemeral
 		}
@@ -67,6 +107,7 @@ func (ctx *Context) resp(msg string, embed *discordgo.MessageEmbed, private bool
 		resp := new(discordgo.WebhookEdit)
 		resp.Content = &msg
 		resp.Components = &ctx.components
+		resp.Files = ctx.files
 		if embed != nil {
 			resp.Embeds = &[]*discordgo.MessageEmbed{embed}
 		}
@@ -76,6 +117,16 @@ func (ctx *Context) resp(msg string, embed *discordgo.MessageEmbed, private bool
 		}
 		return err
 	}
+	if ctx.hasDelayed {
+		embeds := []*discordgo.MessageEmbed{}
+		if embed != nil {
+			embeds = append(embeds, embed)
+		}
+		if ctx.autoDeferred && ctx.origName == "" && private != ctx.delayedPrivate {
+			return ctx.replaceDeferred(msg, embeds, private)
+		}
+		return ctx.edit(&msg, &embeds)
+	}
 	resp := new(discordgo.InteractionResponse)
 	if ctx.origName == "" {
 		resp.Type = discordgo.InteractionResponseChannelMessageWithSource
@@ -85,6 +136,7 @@ func (ctx *Context) resp(msg string, embed *discordgo.MessageEmbed, private bool
 	resp.Data = new(discordgo.InteractionResponseData)
 	resp.Data.Content = msg
 	resp.Data.Components = ctx.components
+	resp.Data.Files = ctx.files
 	if private {
 		resp.Data.Flags = discordgo.MessageFlagsEphemeral
 	}
@@ -94,34 +146,155 @@ func (ctx *Context) resp(msg string, embed *discordgo.MessageEmbed, private bool
 	err := ctx.Bot.InteractionRespond(ctx.Interaction, resp)
 	if err != nil {
 		err = fmt.Errorf("failed to send response: %w", err)
+	} else {
+		ctx.responded = true
+	}
+	return err
+}
+
+// replaceDeferred swaps an automatic deferral for a message that is or isn't ephemeral as the handler asked.
+// A deferred response can't change that after the fact, so it is deleted and a followup is sent instead.
+func (ctx *Context) replaceDeferred(msg string, embeds []*discordgo.MessageEmbed, private bool) error {
+	err := ctx.Bot.InteractionResponseDelete(ctx.Interaction)
+	if err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	data := new(discordgo.WebhookParams)
+	data.Content = msg
+	data.Embeds = embeds
+	data.Components = ctx.components
+	data.Files = ctx.files
+	if private {
+		data.Flags = discordgo.MessageFlagsEphemeral
+	}
+	s, err := ctx.Bot.FollowupMessageCreate(ctx.Interaction, true, data)
+	if err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	// Later edits go to the followup
+	ctx.followup = s.ID
+	ctx.autoDeferred = false
+	return nil
+}
+
+// respMessage replies to a text command, or edits the reply if there already is one.
+// Messages can't be ephemeral, so in a server a private response is sent to the user as a DM instead.
+func (ctx *Context) respMessage(msg *string, embeds *[]*discordgo.MessageEmbed, private bool) error {
+	var err error
+	if ctx.reply == "" {
+		ctx.replyChannel = ctx.ChannelID
+		var reference *discordgo.MessageReference
+		if private && ctx.GuildID != "" {
+			var ch *discordgo.Channel
+			ch, err = ctx.Bot.UserChannelCreate(ctx.User.ID)
+			if err != nil {
+				return fmt.Errorf("failed to open DM: %w", err)
+			}
+			ctx.replyChannel = ch.ID
+		} else {
+			reference = ctx.message.Reference()
+		}
+		data := new(discordgo.MessageSend)
+		if msg != nil {
+			data.Content = *msg
+		}
+		if embeds != nil {
+			data.Embeds = *embeds
+		}
+		data.Components = ctx.components
+		data.Files = ctx.files
+		data.Reference = reference
+		var m *discordgo.Message
+		m, err = ctx.Bot.ChannelMessageSendComplex(ctx.replyChannel, data)
+		if err == nil {
+			ctx.reply = m.ID
+			ctx.responded = true
+		}
+	} else {
+		data := discordgo.NewMessageEdit(ctx.replyChannel, ctx.reply)
+		data.Content = msg
+		data.Embeds = embeds
+		data.Components = &ctx.components
+		data.Files = ctx.files
+		_, err = ctx.Bot.ChannelMessageEditComplex(data)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to send response: %w", err)
+	}
+	return err
+}
+
+// edit changes the response. Fields that are nil are left as they are.
+func (ctx *Context) edit(msg *string, embeds *[]*discordgo.MessageEmbed) error {
+	if err := ctx.takeComponentErr(); err != nil {
+		return err
+	}
+	if ctx.message != nil {
+		return ctx.respMessage(msg, embeds, ctx.delayedPrivate)
+	}
+	if !ctx.responded {
+		// Nothing to edit yet, so respond normally. For components this updates their message.
+		var content string
+		var embed *discordgo.MessageEmbed
+		if msg != nil {
+			content = *msg
+		}
+		if embeds != nil && len(*embeds) != 0 {
+			embed = (*embeds)[0]
+		}
+		return ctx.resp(content, embed, false)
+	}
+	resp := new(discordgo.WebhookEdit)
+	resp.Content = msg
+	resp.Embeds = embeds
+	resp.Components = &ctx.components
+	resp.Files = ctx.files
+	var err error
+	if ctx.followup != "" && ctx.followup != "0" {
+		_, err = ctx.Bot.FollowupMessageEdit(ctx.Interaction, ctx.followup, resp)
+	} else {
+		_, err = ctx.Bot.InteractionResponseEdit(ctx.Interaction, resp)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to edit response: %w", err)
 	}
 	return err
 }
 
 // Send a message to the channel where the command was invoked.
 func (ctx *Context) Respond(msg string) error {
-	if ctx.hasDelayed {
-		return ctx.RespondEdit(msg)
-	}
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
 	return ctx.resp(msg, nil, false)
 }
 
 func (ctx *Context) RespondPrivate(msg string) error {
-	if ctx.hasDelayed {
-		return ctx.RespondEdit(msg)
-	}
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
 	return ctx.resp(msg, nil, true)
 }
 
 func (ctx *Context) RespondEmbed(embed *discordgo.MessageEmbed, private bool) error {
-	if ctx.hasDelayed {
-		return ctx.RespondEditEmbed(embed)
-	}
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
 	return ctx.resp("", embed, private)
 }
 
 func (ctx *Context) RespondDelayed(private bool) error {
-	if ctx.hasDelayed {
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
+	return ctx.deferResp(private)
+}
+
+func (ctx *Context) deferResp(private bool) error {
+	if ctx.message != nil {
+		// Nothing to send, but the reply should still go where the handler asked
+		if ctx.reply == "" {
+			ctx.delayedPrivate = private
+		}
+		return nil
+	}
+	if ctx.responded {
 		return nil
 	}
 	resp := new(discordgo.InteractionResponse)
@@ -137,44 +310,71 @@ func (ctx *Context) RespondDelayed(private bool) error {
 	if err != nil {
 		err = fmt.Errorf("failed to send response: %w", err)
 	} else {
+		ctx.responded = true
 		ctx.hasDelayed = true
+		ctx.delayedPrivate = private
 	}
 	return err
 }
 
-func (ctx *Context) RespondEdit(msg string) error {
-	if ctx.origName != "" {
-		return ctx.Respond(msg)
+// DeferAfter defers the response if nothing has been sent within d, so that slow handlers don't time out.
+// Responses after that edit the deferred one. The returned function stops the timer.
+func (ctx *Context) DeferAfter(d time.Duration) func() {
+	if ctx.message != nil {
+		// Text commands have no deadline
+		return func() {}
 	}
-	resp := new(discordgo.WebhookEdit)
-	resp.Content = &msg
-	resp.Components = &ctx.components
-	_, err := ctx.Bot.InteractionResponseEdit(ctx.Interaction, resp)
-	if err != nil {
-		err = fmt.Errorf("failed to edit response: %w", err)
+	t := clock.AfterFunc(d, func() {
+		ctx.respLock.Lock()
+		defer ctx.respLock.Unlock()
+		if ctx.responded {
+			return
+		}
+		err := ctx.deferResp(false)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		ctx.autoDeferred = true
+		log.Debug(fmt.Sprintf("Deferred %s automatically", ctx.path))
+	})
+	return func() {
+		t.Stop()
 	}
-	return err
+}
+
+func (ctx *Context) RespondEdit(msg string) error {
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
+	return ctx.edit(&msg, nil)
 }
 
 func (ctx *Context) RespondEditEmbed(embed *discordgo.MessageEmbed) error {
-	if ctx.origName != "" {
-		return ctx.RespondEmbed(embed, false)
-	}
-	resp := new(discordgo.WebhookEdit)
-	resp.Embeds = &[]*discordgo.MessageEmbed{embed}
-	resp.Components = &ctx.components
-	_, err := ctx.Bot.InteractionResponseEdit(ctx.Interaction, resp)
-	if err != nil {
-		err = fmt.Errorf("failed to edit response: %w", err)
-	}
-	return err
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
+	return ctx.edit(nil, &[]*discordgo.MessageEmbed{embed})
 }
 
 func (ctx *Context) RespondEmpty() error {
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
+	if ctx.message != nil {
+		if ctx.reply == "" {
+			return nil
+		}
+		return ctx.Bot.ChannelMessageDelete(ctx.replyChannel, ctx.reply)
+	}
 	if ctx.origName != "" {
-		return ctx.Bot.InteractionRespond(ctx.Interaction, &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredMessageUpdate})
+		if ctx.responded {
+			return nil
+		}
+		err := ctx.Bot.InteractionRespond(ctx.Interaction, &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredMessageUpdate})
+		if err == nil {
+			ctx.responded = true
+		}
+		return err
 	}
-	if !ctx.hasDelayed {
+	if !ctx.responded {
 		resp := new(discordgo.InteractionResponse)
 		resp.Type = discordgo.InteractionResponseDeferredChannelMessageWithSource
 		resp.Data = new(discordgo.InteractionResponseData)
@@ -183,30 +383,168 @@ func (ctx *Context) RespondEmpty() error {
 		if err != nil {
 			return fmt.Errorf("failed to send response: %w", err)
 		}
+		ctx.responded = true
 	}
 	return ctx.Bot.InteractionResponseDelete(ctx.Interaction)
 }
 
+// SetComponents sets the components sent with the next response.
+// Loose buttons are packed into rows of five, each select menu gets a row to itself, and ActionsRows are kept as given.
+// Custom IDs are prefixed with the command name so that interactions come back to its component handler.
+// If the components can't be sent, the next response returns why instead of sending anything.
 func (ctx *Context) SetComponents(args ...discordgo.MessageComponent) {
+	ctx.componentErr = nil
 	if len(args) == 0 {
 		return
 	}
-	name := ctx.origName + "\a"
-	if name == "\a" {
-		name = ctx.ApplicationCommandData().Name + "\a"
-	}
-	for i, x := range args {
-		if x.Type() == discordgo.ButtonComponent {
-			x2 := x.(discordgo.Button)
-			x2.CustomID = name + x2.CustomID
-			args[i] = x2
-		} else {
+	prefix := ctx.path + "\a"
+	rows := make([]discordgo.MessageComponent, 0, 5)
+	var cur *discordgo.ActionsRow
+	for _, x := range args {
+		var row *discordgo.ActionsRow
+		var err error
+		switch x2 := x.(type) {
+		case discordgo.ActionsRow:
+			row, err = prefixRow(prefix, x2.Components)
+			cur = nil
+		case *discordgo.ActionsRow:
+			row, err = prefixRow(prefix, x2.Components)
+			cur = nil
+		case discordgo.Button, *discordgo.Button:
+			if cur == nil || len(cur.Components) == 5 {
+				cur = new(discordgo.ActionsRow)
+				rows = append(rows, cur)
+			}
+			x, err = prefixComponent(prefix, x)
+			if err == nil {
+				cur.Components = append(cur.Components, x)
+			}
+		case discordgo.SelectMenu, *discordgo.SelectMenu:
+			row, err = prefixRow(prefix, []discordgo.MessageComponent{x})
+			cur = nil
+		default:
+			err = fmt.Errorf("unsupported component type %d", x.Type())
+		}
+		if err != nil {
+			ctx.componentErr = err
 			return
 		}
+		if row != nil {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) > 5 {
+		ctx.componentErr = fmt.Errorf("too many component rows: %d", len(rows))
+		return
+	}
+	ctx.components = rows
+}
+
+// AttachFile adds a file to the next response.
+func (ctx *Context) AttachFile(name, contentType string, r io.Reader) {
+	ctx.files = append(ctx.files, &discordgo.File{Name: name, ContentType: contentType, Reader: r})
+}
+
+func prefixRow(prefix string, ls []discordgo.MessageComponent) (*discordgo.ActionsRow, error) {
+	row := new(discordgo.ActionsRow)
+	row.Components = make([]discordgo.MessageComponent, len(ls))
+	for i, x := range ls {
+		var err error
+		row.Components[i], err = prefixComponent(prefix, x)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+// Discord rejects custom IDs longer than this
+const maxCustomID = 100
+
+func prefixComponent(prefix string, x discordgo.MessageComponent) (discordgo.MessageComponent, error) {
+	var id string
+	switch x2 := x.(type) {
+	case *discordgo.Button:
+		return prefixComponent(prefix, *x2)
+	case discordgo.Button:
+		if x2.Style == discordgo.LinkButton || x2.Style == discordgo.PremiumButton {
+			return x2, nil
+		}
+		x2.CustomID = prefix + x2.CustomID
+		id, x = x2.CustomID, x2
+	case *discordgo.SelectMenu:
+		return prefixComponent(prefix, *x2)
+	case discordgo.SelectMenu:
+		x2.CustomID = prefix + x2.CustomID
+		id, x = x2.CustomID, x2
+	}
+	if len(id) > maxCustomID {
+		return nil, fmt.Errorf("custom ID %q is %d characters, the limit is %d", id, len(id), maxCustomID)
+	}
+	return x, nil
+}
+
+// SelectedValues returns what was picked in a select menu.
+// For user, role, mentionable and channel menus these are IDs, which can be looked up in MessageComponentData().Resolved.
+func (ctx *Context) SelectedValues() []string {
+	if ctx.Type != discordgo.InteractionMessageComponent {
+		return nil
+	}
+	return ctx.MessageComponentData().Values
+}
+
+// RespondModal opens a form with one row per text input. The submission goes to the handler set with commandStruct.Modal.
+func (ctx *Context) RespondModal(title string, fields ...discordgo.TextInput) error {
+	rows := make([]discordgo.MessageComponent, len(fields))
+	for i, x := range fields {
+		rows[i] = discordgo.ActionsRow{Components: []discordgo.MessageComponent{x}}
+	}
+	ctx.respLock.Lock()
+	defer ctx.respLock.Unlock()
+	if ctx.message != nil {
+		return ctx.resp(ctx.T("commands.noForms"), nil, true)
+	}
+	err := ctx.Bot.InteractionRespond(ctx.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{CustomID: ctx.path + "\a", Title: title, Components: rows},
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to send modal: %w", err)
+	} else {
+		ctx.responded = true
+	}
+	return err
+}
+
+// ModalValue returns what was typed into the text input with the given custom ID, or "" if there is none.
+func (ctx *Context) ModalValue(customID string) string {
+	for _, row := range ctx.ModalSubmitData().Components {
+		row2, ok := row.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, x := range row2.Components {
+			input, ok := x.(*discordgo.TextInput)
+			if ok && input.CustomID == customID {
+				return input.Value
+			}
+		}
 	}
-	com := new(discordgo.ActionsRow)
-	com.Components = args
-	ctx.components = []discordgo.MessageComponent{com}
+	return ""
+}
+
+// Path returns the name of the command this interaction belongs to, including subcommands.
+func (ctx *Context) Path() string {
+	return ctx.path
+}
+
+// Options returns the options given to the subcommand that was invoked, or to the command itself if it has no subcommands.
+func (ctx *Context) Options() []*discordgo.ApplicationCommandInteractionDataOption {
+	opts := ctx.ApplicationCommandData().Options
+	for len(opts) == 1 && (opts[0].Type == discordgo.ApplicationCommandOptionSubCommand || opts[0].Type == discordgo.ApplicationCommandOptionSubCommandGroup) {
+		opts = opts[0].Options
+	}
+	return opts
 }
 
 func (ctx *Context) FollowupPrepare() {
@@ -218,19 +556,27 @@ func (ctx *Context) FollowupDestroy() {
 }
 
 // MakeContext returns a Context populated with data from the message event.
-func MakeContext(self *discordgo.Session, event *discordgo.Interaction) *Context {
+func MakeContext(self Session, event *discordgo.Interaction) *Context {
 	ctx := new(Context)
 	ctx.Interaction = event
 	if ctx.Member != nil {
 		ctx.User = event.Member.User
 	}
 	ctx.Bot = self
-	ctx.State = self.State
-	ctx.Me = self.State.User
-	if event.Type == discordgo.InteractionMessageComponent {
+	ctx.State = self.GetState()
+	ctx.Me = ctx.State.User
+	switch event.Type {
+	case discordgo.InteractionMessageComponent:
 		data := event.MessageComponentData()
 		ctx.origName, data.CustomID, _ = strings.Cut(data.CustomID, "\a")
 		event.Data = data
+		ctx.path = ctx.origName
+	case discordgo.InteractionModalSubmit:
+		data := event.ModalSubmitData()
+		ctx.path, data.CustomID, _ = strings.Cut(data.CustomID, "\a")
+		event.Data = data
+	default:
+		ctx.path = CommandPath(event.ApplicationCommandData())
 	}
 	ctx.Database = db
 	return ctx
@@ -240,19 +586,34 @@ func MakeContext(self *discordgo.Session, event *discordgo.Interaction) *Context
 type Command func(*Context) error
 type Autocompleter func(*Context) []*discordgo.ApplicationCommandOptionChoice
 type cmdMapEntry struct {
-	c Command
-	a Autocompleter
-	h Command // Component handler
+	c         Command
+	a         Autocompleter
+	h         Command // Component handler
+	m         Command // Modal submit handler
+	cooldown  *cooldown
+	expensive bool
+	top       string // Name of the top-level command
+	mw        []Middleware
+	ao        map[string]Autocompleter // Per option autocompleters
 }
 
 var batchCmdList []commandStruct
 var cmdMap map[string]cmdMapEntry
 
+// Guards cmdMap and batchCmdList, which change when a module is turned on or off
+var cmdLock sync.RWMutex
+
 type commandStruct struct {
 	*discordgo.ApplicationCommand
 	autocomplete Autocompleter
 	handler      Command
+	modal        Command
 	gsm          bool
+	cooldown     *cooldown
+	expensive    bool
+	middleware   []Middleware
+	aliases      []string
+	optionAuto   map[string]Autocompleter
 }
 
 func PrepareCommand(name, description string) commandStruct {
@@ -284,7 +645,7 @@ func (c commandStruct) NSFW() commandStruct {
 func (c commandStruct) Guild() commandStruct {
 	b := []discordgo.InteractionContextType{discordgo.InteractionContextGuild}
 	c.Contexts = &b
-	return c
+	return c.Use(GuildOnly)
 }
 
 func (c commandStruct) Perms(p int64) commandStruct {
@@ -302,83 +663,128 @@ func (c commandStruct) Component(c2 Command) commandStruct {
 	return c
 }
 
+func (c commandStruct) Modal(c2 Command) commandStruct {
+	c.modal = c2
+	return c
+}
+
 func (c commandStruct) Gsm() commandStruct {
 	c.gsm = true
 	return c
 }
 
+// Register adds the command to the list to be uploaded.
+// If this is a slash command whose name has spaces, like "quote add", it is registered as a subcommand of the already registered "quote".
+// Registering with a nil Command makes a container: either a top-level command that only holds subcommands, or a subcommand group.
 func (c commandStruct) Register(cmd Command, options []*discordgo.ApplicationCommandOption) {
+	cmdLock.Lock()
+	defer cmdLock.Unlock()
 	c.Options = options
-	batchCmdList = append(batchCmdList, c)
-	cmdMap[c.Name] = cmdMapEntry{cmd, c.autocomplete, c.handler}
-}
-
-func UploadCommands(self *discordgo.Session, appId string, guildId string, testMode bool) {
-	var err error
-	if testMode {
-		ls := make([]*discordgo.ApplicationCommand, len(batchCmdList))
-		for i, x := range batchCmdList {
-			ls[i] = x.ApplicationCommand
+	markAutocomplete(c.Name, options, c.optionAuto)
+	path := c.Name
+	if c.Type == discordgo.ChatApplicationCommand && strings.IndexByte(c.Name, ' ') != -1 {
+		parts := strings.Split(c.Name, " ")
+		if len(parts) > 3 {
+			panic("subcommands can only be nested two deep: " + c.Name)
 		}
-		_, err = self.ApplicationCommandBulkOverwrite(appId, guildId, ls)
-	} else {
-		ls := make([]*discordgo.ApplicationCommand, 0, len(batchCmdList))
-		ls2 := make([]*discordgo.ApplicationCommand, 0, 4)
+		var parent *[]*discordgo.ApplicationCommandOption
 		for _, x := range batchCmdList {
-			if x.gsm {
-				ls2 = append(ls2, x.ApplicationCommand)
-			} else {
-				ls = append(ls, x.ApplicationCommand)
+			if x.Type == discordgo.ChatApplicationCommand && x.Name == parts[0] {
+				parent = &x.Options
+				break
 			}
 		}
-		_, err = self.ApplicationCommandBulkOverwrite(appId, "", ls)
-		if err == nil && guildId != "" {
-			_, err = self.ApplicationCommandBulkOverwrite(appId, guildId, ls2)
+		if parent != nil && len(parts) == 3 {
+			parent = findSubcommand(*parent, parts[1])
+		}
+		if parent == nil {
+			panic("parent of subcommand not registered: " + c.Name)
+		}
+		opt := NewCommandOption(parts[len(parts)-1], c.Description)
+		if c.NameLocalizations != nil {
+			opt.NameLocalizations = maps.Clone(*c.NameLocalizations)
 		}
+		if c.DescriptionLocalizations != nil {
+			opt.DescriptionLocalizations = maps.Clone(*c.DescriptionLocalizations)
+		}
+		if cmd == nil {
+			*parent = append(*parent, opt.AsSubcommandGroup(nil))
+		} else {
+			*parent = append(*parent, opt.AsSubcommand(options))
+		}
+	} else {
+		batchCmdList = append(batchCmdList, c)
 	}
-	if err != nil {
-		if testMode {
-			err2 := err.(*discordgo.RESTError)
-			var errBody struct {
-				Errors map[string]any
-				Code   int
-			}
-			json.Unmarshal(err2.ResponseBody, &errBody)
-			if errBody.Code == discordgo.ErrCodeInvalidFormBody {
-				for k := range errBody.Errors {
-					i, _ := strconv.Atoi(k)
-					fmt.Printf("%d: %s\n", i, batchCmdList[i].Name)
-					for _, v := range batchCmdList[i].Options {
-						fmt.Printf(" - %s (%d)\n", v.Name, v.Type)
-					}
-				}
-			}
+	top, _, _ := strings.Cut(path, " ")
+	mw := c.middleware
+	if c.Type != discordgo.ChatApplicationCommand {
+		top = path
+	} else if ind := strings.LastIndexByte(path, ' '); ind != -1 {
+		// Subcommands get the middleware of the commands they are in
+		mw = slices.Concat(cmdMap[path[:ind]].mw, mw)
+	}
+	cmdMap[path] = cmdMapEntry{cmd, c.autocomplete, c.handler, c.modal, c.cooldown, c.expensive, top, mw, c.optionAuto}
+	if loadingModule != nil {
+		loadingModule.commands = append(loadingModule.commands, path)
+	}
+}
+
+func findSubcommand(opts []*discordgo.ApplicationCommandOption, name string) *[]*discordgo.ApplicationCommandOption {
+	for _, x := range opts {
+		if x.Type == discordgo.ApplicationCommandOptionSubCommandGroup && x.Name == name {
+			return &x.Options
 		}
-		panic(err)
 	}
-	batchCmdList = nil
+	return nil
 }
 
-func ClearGuildCommands(self *discordgo.Session, appId string, guildID string) {
-	_, err := self.ApplicationCommandBulkOverwrite(appId, guildID, nil)
-	if err != nil {
-		panic(err)
+// CommandPath returns the full name of the invoked command, including any subcommand group and subcommand, separated by spaces.
+func CommandPath(data discordgo.ApplicationCommandInteractionData) string {
+	path := data.Name
+	opts := data.Options
+	for len(opts) == 1 && (opts[0].Type == discordgo.ApplicationCommandOptionSubCommand || opts[0].Type == discordgo.ApplicationCommandOptionSubCommandGroup) {
+		path += " " + opts[0].Name
+		opts = opts[0].Options
 	}
+	return path
 }
 
-// GetCommand returns the command associated with the given name
-func GetCommand(name string) Command {
-	return cmdMap[name].c
+// lookup finds the entry for a command path, falling back to the nearest registered parent.
+func lookup(name string) cmdMapEntry {
+	cmdLock.RLock()
+	defer cmdLock.RUnlock()
+	for {
+		if e, ok := cmdMap[name]; ok {
+			return e
+		}
+		ind := strings.LastIndexByte(name, ' ')
+		if ind == -1 {
+			return cmdMapEntry{}
+		}
+		name = name[:ind]
+	}
 }
 
-// GetCommand returns the command associated with the given name
-func GetCommandAutocomplete(name string) Autocompleter {
-	return cmdMap[name].a
+// GetCommand returns the command associated with the given name or path, wrapped in its middleware
+func GetCommand(name string) Command {
+	e := lookup(name)
+	cmdLock.RLock()
+	defer cmdLock.RUnlock()
+	return wrap(e.c, e.mw)
 }
 
 func GetCommandComponentHandler(data discordgo.MessageComponentInteractionData) Command {
 	name, _, _ := strings.Cut(data.CustomID, "\a")
-	return cmdMap[name].h
+	cmdLock.RLock()
+	defer cmdLock.RUnlock()
+	return wrap(cmdMap[name].h, cmdMap[name].mw)
+}
+
+func GetCommandModalHandler(data discordgo.ModalSubmitInteractionData) Command {
+	name, _, _ := strings.Cut(data.CustomID, "\a")
+	cmdLock.RLock()
+	defer cmdLock.RUnlock()
+	return wrap(cmdMap[name].m, cmdMap[name].mw)
 }
 
 func GetDatabase() *sql.DB {
@@ -433,6 +839,12 @@ func (c *commandOption) AsSubcommand(o []*discordgo.ApplicationCommandOption) *d
 	return &c.ApplicationCommandOption
 }
 
+func (c *commandOption) AsSubcommandGroup(o []*discordgo.ApplicationCommandOption) *discordgo.ApplicationCommandOption {
+	c.Type = discordgo.ApplicationCommandOptionSubCommandGroup
+	c.Options = o
+	return &c.ApplicationCommandOption
+}
+
 func (c *commandOption) SetMinMax(min, max int) *commandOption {
 	min2 := float64(min)
 	c.MinValue = &min2
@@ -441,6 +853,12 @@ func (c *commandOption) SetMinMax(min, max int) *commandOption {
 	return c
 }
 
+func (c *commandOption) SetLength(min, max int) *commandOption {
+	c.MinLength = &min
+	c.MaxLength = max
+	return c
+}
+
 func (c *commandOption) Required() *commandOption {
 	c.ApplicationCommandOption.Required = true
 	return c
@@ -0,0 +1,168 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
+	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/commands/fake"
+)
+
+func TestSetComponentsError(t *testing.T) {
+	owner := &discordgo.User{ID: "1", Username: "owner"}
+	bot := fake.New(owner)
+	i := bot.Command(owner, "", bot.NewID(), "stats")
+	ctx := commands.MakeContext(bot, i)
+	menus := make([]discordgo.MessageComponent, 6)
+	for j := range menus {
+		menus[j] = discordgo.SelectMenu{CustomID: strconv.Itoa(j)}
+	}
+	ctx.SetComponents(menus...)
+	if err := ctx.Respond("too many"); err == nil {
+		t.Error("six rows were accepted")
+	}
+	if bot.LastResponse() != nil && bot.LastResponse().Interaction == i {
+		t.Fatal("a response was sent")
+	}
+
+	ctx.SetComponents(discordgo.TextInput{CustomID: "text"})
+	if err := ctx.Respond("text input"); err == nil {
+		t.Error("a text input was accepted")
+	}
+
+	// Valid components replace the error
+	ctx.SetComponents(discordgo.Button{CustomID: "ok", Label: "OK"})
+	if err := ctx.Respond("fixed"); err != nil {
+		t.Fatal(err)
+	}
+	resp := bot.LastResponse()
+	if resp.Interaction != i || resp.Data.Content != "fixed" || len(resp.Data.Components) != 1 {
+		t.Errorf("response %+v", resp.Data)
+	}
+}
+
+func TestSetComponentsLongID(t *testing.T) {
+	owner := &discordgo.User{ID: "1", Username: "owner"}
+	bot := fake.New(owner)
+	i := bot.Command(owner, "", bot.NewID(), "stats")
+	ctx := commands.MakeContext(bot, i)
+	// The command name and a separator are added in front
+	ctx.SetComponents(discordgo.Button{CustomID: strings.Repeat("a", 100-len("stats\a")+1), Label: "long"})
+	if err := ctx.Respond("long"); err == nil {
+		t.Error("a long custom ID was accepted")
+	}
+	ctx.SetComponents(discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.SelectMenu{CustomID: strings.Repeat("a", 100-len("stats\a"))},
+	}})
+	if err := ctx.Respond("fits"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useVirtualClock swaps in a virtual clock for the rest of the test.
+func useVirtualClock(t *testing.T) *clock.Virtual {
+	c := clock.NewVirtual(time.Unix(1700000000, 0))
+	clock.Use(c)
+	t.Cleanup(func() { clock.Use(clock.Real) })
+	return c
+}
+
+func TestDeferAfterThenRespond(t *testing.T) {
+	c := useVirtualClock(t)
+	cid := bot.NewID()
+	i := bot.Command(owner, "", cid, "stats")
+	ctx := commands.MakeContext(bot, i)
+	stop := ctx.DeferAfter(commands.AutoDeferDelay)
+	defer stop()
+	c.Advance(commands.AutoDeferDelay - time.Millisecond)
+	if resp := bot.LastResponse(); resp != nil && resp.Interaction == i {
+		t.Fatal("deferred too early")
+	}
+	c.Advance(time.Millisecond)
+	resp := bot.LastResponse()
+	if resp == nil || resp.Interaction != i || resp.Type != discordgo.InteractionResponseDeferredChannelMessageWithSource {
+		t.Fatalf("not deferred: %+v", resp)
+	}
+	if resp.Data.Flags&discordgo.MessageFlagsEphemeral != 0 {
+		t.Error("automatic deferral is ephemeral")
+	}
+
+	// The late reply edits the deferred response instead of making a new one
+	if err := ctx.Respond("late"); err != nil {
+		t.Fatal(err)
+	}
+	if bot.LastResponse() != resp {
+		t.Error("a second response was sent")
+	}
+	msgs := bot.Messages(cid)
+	if len(msgs) != 1 || msgs[0].Content != "late" {
+		t.Errorf("messages %+v", msgs)
+	}
+}
+
+func TestDeferAfterPrivate(t *testing.T) {
+	c := useVirtualClock(t)
+	cid := bot.NewID()
+	i := bot.Command(owner, "", cid, "stats")
+	ctx := commands.MakeContext(bot, i)
+	stop := ctx.DeferAfter(commands.AutoDeferDelay)
+	defer stop()
+	c.Advance(commands.AutoDeferDelay)
+	if err := ctx.RespondPrivate("secret"); err != nil {
+		t.Fatal(err)
+	}
+	// A public deferral can't become ephemeral, so it is swapped for an ephemeral followup
+	msgs := bot.Messages(cid)
+	if len(msgs) != 1 || msgs[0].Content != "secret" || msgs[0].Flags&discordgo.MessageFlagsEphemeral == 0 {
+		t.Fatalf("messages %+v", msgs)
+	}
+	// and later edits go to the followup, which stays ephemeral
+	if err := ctx.RespondEdit("still secret"); err != nil {
+		t.Fatal(err)
+	}
+	msgs = bot.Messages(cid)
+	if len(msgs) != 1 || msgs[0].Content != "still secret" || msgs[0].Flags&discordgo.MessageFlagsEphemeral == 0 {
+		t.Errorf("messages %+v", msgs)
+	}
+}
+
+func TestDeferAfterNotNeeded(t *testing.T) {
+	c := useVirtualClock(t)
+	cid := bot.NewID()
+	i := bot.Command(owner, "", cid, "stats")
+	ctx := commands.MakeContext(bot, i)
+	stop := ctx.DeferAfter(commands.AutoDeferDelay)
+	if err := ctx.RespondPrivate("quick"); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(commands.AutoDeferDelay)
+	stop()
+	resp := bot.LastResponse()
+	if resp.Interaction != i || resp.Type != discordgo.InteractionResponseChannelMessageWithSource || resp.Data.Flags&discordgo.MessageFlagsEphemeral == 0 {
+		t.Errorf("response %+v", resp)
+	}
+	if msgs := bot.Messages(cid); len(msgs) != 1 {
+		t.Errorf("messages %+v", msgs)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
+)
+
+// CooldownBucket selects who shares a cooldown.
+type CooldownBucket uint8
+
+const (
+	CooldownUser CooldownBucket = iota
+	CooldownChannel
+	CooldownGuild
+)
+
+// MaxExpensive is how many commands marked Expensive may run at once across the whole bot.
+const MaxExpensive = 2
+
+type cooldown struct {
+	bucket CooldownBucket
+	per    time.Duration
+	burst  int
+	// Theoretical arrival time per bucket key, see GCRA
+	tat map[string]time.Time
+	sync.Mutex
+}
+
+var expensiveSem = make(chan struct{}, MaxExpensive)
+
+// Cooldown limits the command to burst uses in a row, regaining one use every per.
+func (c commandStruct) Cooldown(bucket CooldownBucket, per time.Duration, burst int) commandStruct {
+	if burst < 1 {
+		burst = 1
+	}
+	c.cooldown = &cooldown{bucket: bucket, per: per, burst: burst, tat: make(map[string]time.Time)}
+	return c
+}
+
+// Expensive makes the command share the global pool of MaxExpensive concurrent runs.
+func (c commandStruct) Expensive() commandStruct {
+	c.expensive = true
+	return c
+}
+
+func (cd *cooldown) key(ctx *Context) string {
+	switch cd.bucket {
+	case CooldownGuild:
+		if ctx.GuildID != "" {
+			return ctx.GuildID
+		}
+		return ctx.ChannelID
+	case CooldownChannel:
+		return ctx.ChannelID
+	default:
+		return ctx.User.ID
+	}
+}
+
+func (cd *cooldown) take(key string, now time.Time) time.Duration {
+	cd.Lock()
+	defer cd.Unlock()
+	tolerance := cd.per * time.Duration(cd.burst-1)
+	tat := cd.tat[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	if allowAt := tat.Add(-tolerance); allowAt.After(now) {
+		return allowAt.Sub(now)
+	}
+	cd.tat[key] = tat.Add(cd.per)
+	if len(cd.tat) > 256 {
+		for k, v := range cd.tat {
+			if v.Before(now) {
+				delete(cd.tat, k)
+			}
+		}
+	}
+	return 0
+}
+
+// CooldownRemaining uses up one use of the invoked command's cooldown.
+// If none are left, nothing is used and it returns how long until the next one is available.
+func CooldownRemaining(ctx *Context) time.Duration {
+	if ctx.Type != discordgo.InteractionApplicationCommand {
+		return 0
+	}
+	cd := lookup(ctx.path).cooldown
+	if cd == nil {
+		return 0
+	}
+	return cd.take(cd.key(ctx), clock.Now())
+}
+
+// AcquireExpensive reserves a slot in the expensive command pool if the invoked command needs one.
+// If ok is true, release must be called once the command finishes.
+func AcquireExpensive(ctx *Context) (release func(), ok bool) {
+	if ctx.Type != discordgo.InteractionApplicationCommand || !lookup(ctx.path).expensive {
+		return func() {}, true
+	}
+	select {
+	case expensiveSem <- struct{}{}:
+		return func() { <-expensiveSem }, true
+	default:
+		return nil, false
+	}
+}
+
+// Admit checks whether the invoked command may run: that it isn't disabled here, that its cooldown has a use left, and that the expensive pool has room, in that order.
+// If it may, release must be called once the command finishes. Otherwise Admit has told the user why, and reason says it for the stats.
+// The cooldown comes before the expensive pool so that users who are on cooldown can't hold up a slot.
+func Admit(ctx *Context) (release func(), reason string, ok bool) {
+	if IsDisabled(ctx) {
+		ctx.RespondPrivate(ctx.T("commands.disabled"))
+		return nil, "disabled", false
+	}
+	if wait := CooldownRemaining(ctx); wait > 0 {
+		ctx.RespondPrivate(ctx.T("commands.cooldown", clock.Now().Add(wait+time.Second-1).Unix()))
+		return nil, "cooldown", false
+	}
+	release, ok = AcquireExpensive(ctx)
+	if !ok {
+		ctx.RespondPrivate(ctx.T("commands.busy"))
+		return nil, "busy", false
+	}
+	return release, "", true
+}
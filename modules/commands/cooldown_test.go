@@ -0,0 +1,113 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestCooldownTake(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type use struct {
+		key  string
+		at   time.Duration
+		wait time.Duration
+	}
+	tests := []struct {
+		name  string
+		per   time.Duration
+		burst int
+		uses  []use
+	}{
+		{"single", time.Minute, 1, []use{
+			{"a", 0, 0},
+			{"a", time.Second, 59 * time.Second},
+			{"a", time.Minute, 0},
+		}},
+		{"burst", time.Minute, 3, []use{
+			{"a", 0, 0},
+			{"a", 0, 0},
+			{"a", 0, 0},
+			{"a", 0, time.Minute},
+			{"a", 20 * time.Second, 40 * time.Second},
+		}},
+		{"refill", time.Minute, 3, []use{
+			{"a", 0, 0},
+			{"a", 0, 0},
+			{"a", 0, 0},
+			// One use comes back each minute
+			{"a", time.Minute, 0},
+			{"a", time.Minute, time.Minute},
+			// and they stop coming back once the burst is full again
+			{"a", 10 * time.Minute, 0},
+			{"a", 10 * time.Minute, 0},
+			{"a", 10 * time.Minute, 0},
+			{"a", 10 * time.Minute, time.Minute},
+		}},
+		{"keys", time.Minute, 1, []use{
+			{"a", 0, 0},
+			{"b", 0, 0},
+			{"a", 0, time.Minute},
+			{"b", 30 * time.Second, 30 * time.Second},
+		}},
+		{"refused uses are free", time.Minute, 1, []use{
+			{"a", 0, 0},
+			{"a", 10 * time.Second, 50 * time.Second},
+			{"a", 20 * time.Second, 40 * time.Second},
+			{"a", time.Minute, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd := &cooldown{per: tt.per, burst: tt.burst, tat: make(map[string]time.Time)}
+			for i, u := range tt.uses {
+				if wait := cd.take(u.key, start.Add(u.at)); wait != u.wait {
+					t.Errorf("use %d of %s at %v: waited %v, want %v", i, u.key, u.at, wait, u.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestCooldownKey(t *testing.T) {
+	user := &discordgo.User{ID: "10"}
+	guild := &Context{Interaction: &discordgo.Interaction{GuildID: "20", ChannelID: "30", User: user}}
+	dm := &Context{Interaction: &discordgo.Interaction{ChannelID: "40", User: user}}
+	tests := []struct {
+		bucket CooldownBucket
+		ctx    *Context
+		want   string
+	}{
+		{CooldownUser, guild, "10"},
+		{CooldownUser, dm, "10"},
+		{CooldownChannel, guild, "30"},
+		{CooldownChannel, dm, "40"},
+		{CooldownGuild, guild, "20"},
+		// DMs have no guild, so the channel stands in for it
+		{CooldownGuild, dm, "40"},
+	}
+	for _, tt := range tests {
+		cd := &cooldown{bucket: tt.bucket}
+		if got := cd.key(tt.ctx); got != tt.want {
+			t.Errorf("bucket %d in guild %q: key %q, want %q", tt.bucket, tt.ctx.GuildID, got, tt.want)
+		}
+	}
+}
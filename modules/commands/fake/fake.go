@@ -0,0 +1,732 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package fake provides an in-memory commands.Session.
+// It records everything the bot sends and serves canned guilds, channels, members, messages and voice states,
+// so command flows can be driven without connecting to Discord.
+package fake
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
+	"jlortiz.org/jlort2/modules/commands"
+)
+
+var ErrNotFound = errors.New("fake: not found")
+
+// Response is an interaction response the bot sent, along with the interaction it answered.
+type Response struct {
+	Interaction *discordgo.Interaction
+	*discordgo.InteractionResponse
+}
+
+type Session struct {
+	sync.Mutex
+	State     *discordgo.State
+	Latency   time.Duration
+	Responses []Response
+	Handlers  []interface{}
+	// Files are served by HTTPClient, keyed by URL.
+	Files map[string][]byte
+	// Requests made through the session from Discord, oldest first
+	Requests []Request
+
+	lastID    uint64
+	messages  map[string][]*discordgo.Message
+	replies   map[string]*discordgo.Message
+	dms       map[string]*discordgo.Channel
+	voice     map[string]*discordgo.VoiceConnection
+	voiceStop map[string]chan struct{}
+	discord   *discordgo.Session
+	// Interactions seen by Dispatch, keyed by token
+	interactions map[string]*discordgo.Interaction
+	// Opus packets received per guild
+	OpusPackets map[string]int
+}
+
+var _ commands.Session = (*Session)(nil)
+
+// New returns a Session with a bot user and an application owned by owner.
+func New(owner *discordgo.User) *Session {
+	s := new(Session)
+	s.State = discordgo.NewState()
+	s.State.TrackVoice = true
+	s.State.User = &discordgo.User{ID: s.newID(), Username: "jlort", Bot: true}
+	s.State.Application = &discordgo.Application{ID: s.newID(), Name: "jlort jlort", Owner: owner}
+	s.Files = make(map[string][]byte)
+	s.messages = make(map[string][]*discordgo.Message)
+	s.replies = make(map[string]*discordgo.Message)
+	s.dms = make(map[string]*discordgo.Channel)
+	s.voice = make(map[string]*discordgo.VoiceConnection)
+	s.voiceStop = make(map[string]chan struct{})
+	s.OpusPackets = make(map[string]int)
+	s.interactions = make(map[string]*discordgo.Interaction)
+	return s
+}
+
+// Discord counts snowflake timestamps from the start of 2015
+const discordEpoch = 1420070400000
+
+// newID makes a snowflake from the clock, so that fake IDs sort among real ones.
+func (s *Session) newID() string {
+	id := uint64(clock.Now().UnixMilli()-discordEpoch) << 22
+	if id <= s.lastID {
+		id = s.lastID + 1
+	}
+	s.lastID = id
+	return strconv.FormatUint(id, 10)
+}
+
+// NewID returns a fresh snowflake that sorts after every ID handed out so far.
+func (s *Session) NewID() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.newID()
+}
+
+// AddGuild adds a guild, its channels and its members to the state.
+func (s *Session) AddGuild(g *discordgo.Guild) {
+	setGuildIDs(g)
+	s.State.GuildAdd(g)
+}
+
+// setGuildIDs fills in the guild ID of everything in a guild, which Discord leaves out.
+func setGuildIDs(g *discordgo.Guild) {
+	for _, c := range g.Channels {
+		c.GuildID = g.ID
+	}
+	for _, m := range g.Members {
+		m.GuildID = g.ID
+	}
+	for _, vs := range g.VoiceStates {
+		vs.GuildID = g.ID
+	}
+}
+
+func (s *Session) AddChannel(c *discordgo.Channel) error {
+	return s.State.ChannelAdd(c)
+}
+
+func (s *Session) AddMember(m *discordgo.Member) error {
+	return s.State.MemberAdd(m)
+}
+
+// SetVoiceState replaces the voice state of a user in a guild.
+// An empty ChannelID removes it.
+func (s *Session) SetVoiceState(vs *discordgo.VoiceState) error {
+	g, err := s.State.Guild(vs.GuildID)
+	if err != nil {
+		return err
+	}
+	s.State.Lock()
+	defer s.State.Unlock()
+	g.VoiceStates = slices.DeleteFunc(g.VoiceStates, func(x *discordgo.VoiceState) bool { return x.UserID == vs.UserID })
+	if vs.ChannelID != "" {
+		g.VoiceStates = append(g.VoiceStates, vs)
+	}
+	return nil
+}
+
+// AddMessage stores a message as if it had been posted to its channel. A missing ID or timestamp is filled in.
+func (s *Session) AddMessage(m *discordgo.Message) *discordgo.Message {
+	s.Lock()
+	defer s.Unlock()
+	return s.addMessage(m)
+}
+
+func (s *Session) addMessage(m *discordgo.Message) *discordgo.Message {
+	if m.ID == "" {
+		m.ID = s.newID()
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = clock.Now()
+	}
+	ls := s.messages[m.ChannelID]
+	ind, _ := slices.BinarySearchFunc(ls, m.ID, func(x *discordgo.Message, id string) int { return cmpID(x.ID, id) })
+	s.messages[m.ChannelID] = slices.Insert(ls, ind, m)
+	return m
+}
+
+func cmpID(a, b string) int {
+	x, _ := strconv.ParseUint(a, 10, 64)
+	y, _ := strconv.ParseUint(b, 10, 64)
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+// Messages returns the messages in a channel, oldest first.
+func (s *Session) Messages(channelID string) []*discordgo.Message {
+	s.Lock()
+	defer s.Unlock()
+	return slices.Clone(s.messages[channelID])
+}
+
+// LastMessage returns the newest message in a channel, or nil.
+func (s *Session) LastMessage(channelID string) *discordgo.Message {
+	s.Lock()
+	defer s.Unlock()
+	ls := s.messages[channelID]
+	if len(ls) == 0 {
+		return nil
+	}
+	return ls[len(ls)-1]
+}
+
+// Reply returns the message that was sent in response to an interaction, or nil.
+func (s *Session) Reply(i *discordgo.Interaction) *discordgo.Message {
+	s.Lock()
+	defer s.Unlock()
+	return s.replies[i.ID]
+}
+
+// LastResponse returns the most recent interaction response, or nil.
+func (s *Session) LastResponse() *Response {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.Responses) == 0 {
+		return nil
+	}
+	return &s.Responses[len(s.Responses)-1]
+}
+
+// Selects returns every select menu on a message in order.
+func Selects(m *discordgo.Message) []discordgo.SelectMenu {
+	var out []discordgo.SelectMenu
+	for _, x := range m.Components {
+		row, ok := x.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, y := range row.Components {
+			if b, ok := y.(discordgo.SelectMenu); ok {
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
+// Buttons returns every button on a message in order.
+func Buttons(m *discordgo.Message) []discordgo.Button {
+	var out []discordgo.Button
+	for _, x := range m.Components {
+		row, ok := x.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, y := range row.Components {
+			if b, ok := y.(discordgo.Button); ok {
+				out = append(out, b)
+			}
+		}
+	}
+	return out
+}
+
+// Option builds a command option. The type is taken from the value: string, int, bool, or *discordgo.User.
+func Option(name string, value any) *discordgo.ApplicationCommandInteractionDataOption {
+	opt := &discordgo.ApplicationCommandInteractionDataOption{Name: name}
+	switch v := value.(type) {
+	case string:
+		opt.Type = discordgo.ApplicationCommandOptionString
+		opt.Value = v
+	case int:
+		opt.Type = discordgo.ApplicationCommandOptionInteger
+		opt.Value = float64(v)
+	case bool:
+		opt.Type = discordgo.ApplicationCommandOptionBoolean
+		opt.Value = v
+	case *discordgo.User:
+		opt.Type = discordgo.ApplicationCommandOptionUser
+		opt.Value = v.ID
+	default:
+		panic("fake: unsupported option value")
+	}
+	return opt
+}
+
+// Focused marks the option as the one being typed in, for Autocomplete.
+func Focused(opt *discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	opt.Focused = true
+	return opt
+}
+
+// Subcommand wraps options in a subcommand option.
+func Subcommand(name string, opts ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionSubCommand, Options: opts}
+}
+
+// Group wraps a subcommand in a subcommand group option.
+func Group(name string, sub *discordgo.ApplicationCommandInteractionDataOption) *discordgo.ApplicationCommandInteractionDataOption {
+	return &discordgo.ApplicationCommandInteractionDataOption{Name: name, Type: discordgo.ApplicationCommandOptionSubCommandGroup, Options: []*discordgo.ApplicationCommandInteractionDataOption{sub}}
+}
+
+func (s *Session) interaction(user *discordgo.User, guildID, channelID string) *discordgo.Interaction {
+	i := new(discordgo.Interaction)
+	i.ID = s.NewID()
+	i.AppID = s.State.Application.ID
+	i.Token = "token-" + i.ID
+	i.GuildID = guildID
+	i.ChannelID = channelID
+	i.Locale = discordgo.EnglishUS
+	if guildID != "" {
+		mem, err := s.State.Member(guildID, user.ID)
+		if err != nil {
+			mem = &discordgo.Member{GuildID: guildID, User: user}
+		}
+		i.Member = mem
+		i.AppPermissions = discordgo.PermissionAll
+	} else {
+		i.User = user
+	}
+	return i
+}
+
+// Command builds a slash command invocation. Pass an empty guildID for a DM.
+func (s *Session) Command(user *discordgo.User, guildID, channelID, name string, opts ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.Interaction {
+	i := s.interaction(user, guildID, channelID)
+	i.Type = discordgo.InteractionApplicationCommand
+	data := discordgo.ApplicationCommandInteractionData{ID: s.NewID(), Name: name, CommandType: discordgo.ChatApplicationCommand, Options: opts}
+	data.Resolved = new(discordgo.ApplicationCommandInteractionDataResolved)
+	data.Resolved.Users = make(map[string]*discordgo.User)
+	for _, opt := range opts {
+		if opt.Type == discordgo.ApplicationCommandOptionUser {
+			u, _ := opt.Value.(string)
+			data.Resolved.Users[u] = &discordgo.User{ID: u}
+			if guildID != "" {
+				if mem, err := s.State.Member(guildID, u); err == nil {
+					data.Resolved.Users[u] = mem.User
+				}
+			}
+		}
+	}
+	i.Data = data
+	return i
+}
+
+// Autocomplete builds an autocomplete request. One of the options should be marked with Focused.
+func (s *Session) Autocomplete(user *discordgo.User, guildID, channelID, name string, opts ...*discordgo.ApplicationCommandInteractionDataOption) *discordgo.Interaction {
+	i := s.Command(user, guildID, channelID, name, opts...)
+	i.Type = discordgo.InteractionApplicationCommandAutocomplete
+	return i
+}
+
+// Press builds a button press on a message the bot sent earlier.
+func (s *Session) Press(user *discordgo.User, msg *discordgo.Message, customID string) *discordgo.Interaction {
+	i := s.interaction(user, msg.GuildID, msg.ChannelID)
+	i.Type = discordgo.InteractionMessageComponent
+	i.Message = msg
+	i.Data = discordgo.MessageComponentInteractionData{CustomID: customID, ComponentType: discordgo.ButtonComponent}
+	return i
+}
+
+// Choose builds a select menu interaction on a message the bot sent earlier.
+func (s *Session) Choose(user *discordgo.User, msg *discordgo.Message, customID string, values ...string) *discordgo.Interaction {
+	i := s.Press(user, msg, customID)
+	i.Data = discordgo.MessageComponentInteractionData{CustomID: customID, ComponentType: discordgo.SelectMenuComponent, Values: values}
+	return i
+}
+
+// Submit builds a modal submission with the given text input values.
+// customID is the one from the modal, which already carries the command name.
+func (s *Session) Submit(user *discordgo.User, guildID, channelID, customID string, values map[string]string) *discordgo.Interaction {
+	i := s.interaction(user, guildID, channelID)
+	i.Type = discordgo.InteractionModalSubmit
+	data := discordgo.ModalSubmitInteractionData{CustomID: customID}
+	for k, v := range values {
+		data.Components = append(data.Components, &discordgo.ActionsRow{Components: []discordgo.MessageComponent{&discordgo.TextInput{CustomID: k, Value: v}}})
+	}
+	i.Data = data
+	return i
+}
+
+// SignedRequest builds the HTTP request Discord would send an interactions endpoint at url, signed with key.
+func SignedRequest(key ed25519.PrivateKey, url string, i *discordgo.Interaction) *http.Request {
+	body, err := json.Marshal(i)
+	if err != nil {
+		panic(err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-Timestamp", ts)
+	req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(key, append([]byte(ts), body...))))
+	return req
+}
+
+// Run routes an interaction to its registered handler the same way the gateway would.
+func (s *Session) Run(i *discordgo.Interaction) error {
+	var cmd commands.Command
+	switch i.Type {
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		return s.InteractionRespond(i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+			Data: &discordgo.InteractionResponseData{Choices: commands.Autocomplete(commands.MakeContext(s, i))},
+		})
+	case discordgo.InteractionMessageComponent:
+		cmd = commands.GetCommandComponentHandler(i.MessageComponentData())
+	case discordgo.InteractionModalSubmit:
+		cmd = commands.GetCommandModalHandler(i.ModalSubmitData())
+	default:
+		cmd = commands.GetCommand(commands.CommandPath(i.ApplicationCommandData()))
+	}
+	if cmd == nil {
+		return ErrNotFound
+	}
+	return cmd(commands.MakeContext(s, i))
+}
+
+func (s *Session) AddHandler(handler interface{}) func() {
+	s.Lock()
+	defer s.Unlock()
+	ind := len(s.Handlers)
+	s.Handlers = append(s.Handlers, handler)
+	return func() {
+		s.Lock()
+		s.Handlers[ind] = nil
+		s.Unlock()
+	}
+}
+
+func (s *Session) GetState() *discordgo.State {
+	return s.State
+}
+
+func (s *Session) HeartbeatLatency() time.Duration {
+	return s.Latency
+}
+
+func (s *Session) HTTPClient() *http.Client {
+	return &http.Client{Transport: s}
+}
+
+// RoundTrip serves Files for HTTPClient.
+func (s *Session) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.Lock()
+	b, ok := s.Files[req.URL.String()]
+	s.Unlock()
+	resp := &http.Response{Request: req, Header: make(http.Header), StatusCode: http.StatusOK}
+	if !ok {
+		resp.StatusCode = http.StatusNotFound
+	}
+	resp.Status = http.StatusText(resp.StatusCode)
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	return resp, nil
+}
+
+func (s *Session) botMessage(channelID string) *discordgo.Message {
+	msg := &discordgo.Message{ChannelID: channelID, Author: s.State.User}
+	if c, err := s.State.Channel(channelID); err == nil {
+		msg.GuildID = c.GuildID
+	}
+	return msg
+}
+
+func (s *Session) InteractionRespond(i *discordgo.Interaction, resp *discordgo.InteractionResponse, _ ...discordgo.RequestOption) error {
+	s.Lock()
+	defer s.Unlock()
+	s.Responses = append(s.Responses, Response{i, resp})
+	switch resp.Type {
+	case discordgo.InteractionResponseChannelMessageWithSource, discordgo.InteractionResponseDeferredChannelMessageWithSource:
+		msg := s.botMessage(i.ChannelID)
+		msg.GuildID = i.GuildID
+		msg.Interaction = &discordgo.MessageInteraction{ID: i.ID, Type: i.Type}
+		if resp.Data != nil {
+			msg.Content = resp.Data.Content
+			msg.Embeds = resp.Data.Embeds
+			msg.Components = resp.Data.Components
+			msg.Flags = resp.Data.Flags
+		}
+		s.replies[i.ID] = s.addMessage(msg)
+	case discordgo.InteractionResponseUpdateMessage:
+		if i.Message != nil && resp.Data != nil {
+			i.Message.Content = resp.Data.Content
+			i.Message.Embeds = resp.Data.Embeds
+			i.Message.Components = resp.Data.Components
+		}
+		s.replies[i.ID] = i.Message
+	case discordgo.InteractionResponseDeferredMessageUpdate:
+		s.replies[i.ID] = i.Message
+	}
+	return nil
+}
+
+func applyEdit(msg *discordgo.Message, edit *discordgo.WebhookEdit) {
+	if edit.Content != nil {
+		msg.Content = *edit.Content
+	}
+	if edit.Embeds != nil {
+		msg.Embeds = *edit.Embeds
+	}
+	if edit.Components != nil {
+		msg.Components = *edit.Components
+	}
+	for _, f := range edit.Files {
+		msg.Attachments = append(msg.Attachments, &discordgo.MessageAttachment{Filename: f.Name, URL: "attachment://" + f.Name})
+	}
+}
+
+func (s *Session) InteractionResponseEdit(i *discordgo.Interaction, newresp *discordgo.WebhookEdit, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.replies[i.ID]
+	if msg == nil {
+		return nil, ErrNotFound
+	}
+	applyEdit(msg, newresp)
+	return msg, nil
+}
+
+func (s *Session) InteractionResponseDelete(i *discordgo.Interaction, _ ...discordgo.RequestOption) error {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.replies[i.ID]
+	if msg == nil {
+		return ErrNotFound
+	}
+	delete(s.replies, i.ID)
+	s.deleteMessage(msg.ChannelID, msg.ID)
+	return nil
+}
+
+func (s *Session) FollowupMessageCreate(i *discordgo.Interaction, _ bool, data *discordgo.WebhookParams, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.botMessage(i.ChannelID)
+	msg.GuildID = i.GuildID
+	msg.Content = data.Content
+	msg.Embeds = data.Embeds
+	msg.Components = data.Components
+	msg.Flags = data.Flags
+	return s.addMessage(msg), nil
+}
+
+func (s *Session) FollowupMessageEdit(i *discordgo.Interaction, messageID string, data *discordgo.WebhookEdit, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.findMessage(i.ChannelID, messageID)
+	if msg == nil {
+		return nil, ErrNotFound
+	}
+	applyEdit(msg, data)
+	return msg, nil
+}
+
+func (s *Session) UserChannelCreate(recipientID string, _ ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	s.Lock()
+	ch, ok := s.dms[recipientID]
+	if !ok {
+		ch = &discordgo.Channel{ID: s.newID(), Type: discordgo.ChannelTypeDM, Recipients: []*discordgo.User{{ID: recipientID}}}
+		s.dms[recipientID] = ch
+	}
+	s.Unlock()
+	if !ok {
+		s.State.ChannelAdd(ch)
+	}
+	return ch, nil
+}
+
+func (s *Session) findMessage(channelID, messageID string) *discordgo.Message {
+	for _, m := range s.messages[channelID] {
+		if m.ID == messageID {
+			return m
+		}
+	}
+	return nil
+}
+
+func (s *Session) deleteMessage(channelID, messageID string) bool {
+	ls := s.messages[channelID]
+	l := len(ls)
+	s.messages[channelID] = slices.DeleteFunc(ls, func(m *discordgo.Message) bool { return m.ID == messageID })
+	return len(s.messages[channelID]) != l
+}
+
+// ChannelMessages returns messages newest first, like the REST endpoint does.
+func (s *Session) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, _ ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	ls := s.messages[channelID]
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	var sel []*discordgo.Message
+	switch {
+	case afterID != "":
+		start, _ := slices.BinarySearchFunc(ls, afterID, func(x *discordgo.Message, id string) int { return cmpID(x.ID, id) })
+		for start < len(ls) && cmpID(ls[start].ID, afterID) <= 0 {
+			start++
+		}
+		sel = ls[start:min(start+limit, len(ls))]
+	case aroundID != "":
+		mid, _ := slices.BinarySearchFunc(ls, aroundID, func(x *discordgo.Message, id string) int { return cmpID(x.ID, id) })
+		start := max(mid-limit/2, 0)
+		sel = ls[start:min(start+limit, len(ls))]
+	default:
+		end := len(ls)
+		if beforeID != "" {
+			end, _ = slices.BinarySearchFunc(ls, beforeID, func(x *discordgo.Message, id string) int { return cmpID(x.ID, id) })
+		}
+		sel = ls[max(end-limit, 0):end]
+	}
+	out := slices.Clone(sel)
+	slices.Reverse(out)
+	return out, nil
+}
+
+func (s *Session) ChannelMessage(channelID, messageID string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.findMessage(channelID, messageID)
+	if msg == nil {
+		return nil, ErrNotFound
+	}
+	return msg, nil
+}
+
+func (s *Session) ChannelMessageSend(channelID string, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content})
+}
+
+func (s *Session) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.botMessage(channelID)
+	msg.Content = data.Content
+	msg.Embeds = data.Embeds
+	msg.Components = data.Components
+	for _, f := range data.Files {
+		msg.Attachments = append(msg.Attachments, &discordgo.MessageAttachment{Filename: f.Name, URL: "attachment://" + f.Name})
+	}
+	if data.Reference != nil {
+		msg.MessageReference = data.Reference
+		msg.Type = discordgo.MessageTypeReply
+	}
+	return s.addMessage(msg), nil
+}
+
+func (s *Session) ChannelMessageEditComplex(data *discordgo.MessageEdit, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.findMessage(data.Channel, data.ID)
+	if msg == nil {
+		return nil, ErrNotFound
+	}
+	applyEdit(msg, &discordgo.WebhookEdit{Content: data.Content, Embeds: data.Embeds, Components: data.Components, Files: data.Files})
+	return msg, nil
+}
+
+func (s *Session) ChannelMessageDelete(channelID, messageID string, _ ...discordgo.RequestOption) error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.deleteMessage(channelID, messageID) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Session) ChannelMessagesBulkDelete(channelID string, messages []string, _ ...discordgo.RequestOption) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, id := range messages {
+		s.deleteMessage(channelID, id)
+	}
+	return nil
+}
+
+func (s *Session) MessageReactionAdd(channelID, messageID, emojiID string, _ ...discordgo.RequestOption) error {
+	s.Lock()
+	defer s.Unlock()
+	msg := s.findMessage(channelID, messageID)
+	if msg == nil {
+		return ErrNotFound
+	}
+	for _, r := range msg.Reactions {
+		if r.Emoji.Name == emojiID {
+			if !r.Me {
+				r.Me = true
+				r.Count++
+			}
+			return nil
+		}
+	}
+	msg.Reactions = append(msg.Reactions, &discordgo.MessageReactions{Count: 1, Me: true, Emoji: &discordgo.Emoji{Name: emojiID}})
+	return nil
+}
+
+// ChannelVoiceJoin returns a connection whose OpusSend is drained into OpusPackets.
+func (s *Session) ChannelVoiceJoin(gID, cID string, _, _ bool) (*discordgo.VoiceConnection, error) {
+	s.Lock()
+	defer s.Unlock()
+	if vc := s.voice[gID]; vc != nil {
+		vc.ChannelID = cID
+		return vc, nil
+	}
+	vc := &discordgo.VoiceConnection{Ready: true, UserID: s.State.User.ID, GuildID: gID, ChannelID: cID, OpusSend: make(chan []byte, 2)}
+	stop := make(chan struct{})
+	s.voice[gID] = vc
+	s.voiceStop[gID] = stop
+	go func() {
+		for {
+			select {
+			case <-vc.OpusSend:
+				s.Lock()
+				s.OpusPackets[gID]++
+				s.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return vc, nil
+}
+
+func (s *Session) VoiceConnection(gID string) *discordgo.VoiceConnection {
+	s.Lock()
+	defer s.Unlock()
+	return s.voice[gID]
+}
+
+func (s *Session) VoiceDisconnect(gID string) error {
+	s.Lock()
+	defer s.Unlock()
+	if stop := s.voiceStop[gID]; stop != nil {
+		close(stop)
+	}
+	delete(s.voice, gID)
+	delete(s.voiceStop, gID)
+	return nil
+}
@@ -0,0 +1,483 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
+	"jlortiz.org/jlort2/modules/commands"
+)
+
+// Request is a REST request made through the session from Discord.
+type Request struct {
+	Time   time.Time
+	Method string
+	// Relative to the API root, with the query string
+	Path string
+	// The JSON payload, without any files that were attached
+	Body   []byte
+	Status int
+}
+
+var apiRoot, _ = url.Parse(discordgo.EndpointAPI)
+
+// Discord returns a discordgo session that shares the state, for event handlers that take one.
+// Its REST requests are answered from s and kept in Requests. It never connects to Discord.
+func (s *Session) Discord() *discordgo.Session {
+	s.Lock()
+	defer s.Unlock()
+	if s.discord == nil {
+		d, _ := discordgo.New("Bot fake")
+		d.State = s.State
+		d.StateEnabled = true
+		d.MaxRestRetries = 0
+		d.Client = &http.Client{Transport: restTransport{s}}
+		s.discord = d
+	}
+	return s.discord
+}
+
+type restSession struct {
+	commands.Session
+	s *Session
+}
+
+// REST returns a commands.Session that sends everything through the session from Discord, so that it is kept in Requests.
+// Handlers added to it are run by Dispatch, and voice connections are faked as usual.
+func (s *Session) REST() commands.Session {
+	return restSession{commands.WrapSession(s.Discord()), s}
+}
+
+func (r restSession) AddHandler(handler interface{}) func() {
+	return r.s.AddHandler(handler)
+}
+
+func (r restSession) HTTPClient() *http.Client {
+	return r.s.HTTPClient()
+}
+
+func (r restSession) ChannelVoiceJoin(gID, cID string, mute, deaf bool) (*discordgo.VoiceConnection, error) {
+	return r.s.ChannelVoiceJoin(gID, cID, mute, deaf)
+}
+
+func (r restSession) VoiceConnection(gID string) *discordgo.VoiceConnection {
+	return r.s.VoiceConnection(gID)
+}
+
+func (r restSession) VoiceDisconnect(gID string) error {
+	return r.s.VoiceDisconnect(gID)
+}
+
+// Dispatch handles a gateway event the way discordgo would. The state is updated, then every handler that takes the event is called with the session from Discord.
+// Messages and reactions in the event are applied to the messages s serves first, since Discord would already have them.
+// Handlers that panic are reported in the error after the rest have run.
+func (s *Session) Dispatch(event interface{}) error {
+	d := s.Discord()
+	s.apply(event)
+	// Like discordgo, events the state can't place are still handled
+	s.State.OnInterface(d, event)
+	s.Lock()
+	handlers := slices.Clone(s.Handlers)
+	s.Unlock()
+	args := []reflect.Value{reflect.ValueOf(d), reflect.ValueOf(event)}
+	var errs []error
+	for _, h := range handlers {
+		f := reflect.ValueOf(h)
+		if h == nil || f.Kind() != reflect.Func {
+			continue
+		}
+		t := f.Type()
+		if t.NumIn() != 2 || t.In(0) != args[0].Type() || !args[1].Type().AssignableTo(t.In(1)) {
+			continue
+		}
+		errs = append(errs, callHandler(f, args))
+	}
+	return errors.Join(errs...)
+}
+
+func callHandler(f reflect.Value, args []reflect.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked: %v\n%s", runtime.FuncForPC(f.Pointer()).Name(), r, debug.Stack())
+		}
+	}()
+	f.Call(args)
+	return nil
+}
+
+// apply keeps the messages s serves in step with the events from Discord, and fills in what discordgo would.
+func (s *Session) apply(event interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	switch e := event.(type) {
+	case *discordgo.Ready:
+		for _, g := range e.Guilds {
+			setGuildIDs(g)
+		}
+	case *discordgo.GuildCreate:
+		setGuildIDs(e.Guild)
+	case *discordgo.GuildUpdate:
+		setGuildIDs(e.Guild)
+	case *discordgo.MessageCreate:
+		if s.findMessage(e.ChannelID, e.ID) == nil {
+			msg := *e.Message
+			s.addMessage(&msg)
+		}
+	case *discordgo.MessageUpdate:
+		// Updates without an author only have some of the message
+		if msg := s.findMessage(e.ChannelID, e.ID); msg != nil && e.Author != nil {
+			reactions := msg.Reactions
+			*msg = *e.Message
+			msg.Reactions = reactions
+		}
+	case *discordgo.MessageDelete:
+		s.deleteMessage(e.ChannelID, e.ID)
+	case *discordgo.MessageDeleteBulk:
+		for _, id := range e.Messages {
+			s.deleteMessage(e.ChannelID, id)
+		}
+	case *discordgo.MessageReactionAdd:
+		s.react(e.MessageReaction, 1)
+	case *discordgo.MessageReactionRemove:
+		s.react(e.MessageReaction, -1)
+	case *discordgo.MessageReactionRemoveAll:
+		if msg := s.findMessage(e.ChannelID, e.MessageID); msg != nil {
+			msg.Reactions = nil
+		}
+	case *discordgo.InteractionCreate:
+		s.interactions[e.Token] = e.Interaction
+	}
+}
+
+func (s *Session) react(r *discordgo.MessageReaction, delta int) {
+	msg := s.findMessage(r.ChannelID, r.MessageID)
+	if msg == nil {
+		return
+	}
+	name := r.Emoji.APIName()
+	ind := slices.IndexFunc(msg.Reactions, func(x *discordgo.MessageReactions) bool { return x.Emoji.APIName() == name })
+	if ind == -1 {
+		if delta < 0 {
+			return
+		}
+		emoji := r.Emoji
+		msg.Reactions = append(msg.Reactions, &discordgo.MessageReactions{Emoji: &emoji})
+		ind = len(msg.Reactions) - 1
+	}
+	x := msg.Reactions[ind]
+	if r.UserID == s.State.User.ID {
+		// The bot's own reactions were already counted when it made them
+		if x.Me == (delta > 0) {
+			return
+		}
+		x.Me = delta > 0
+	}
+	x.Count += delta
+	if x.Count <= 0 {
+		msg.Reactions = slices.Delete(msg.Reactions, ind, ind+1)
+	}
+}
+
+func (s *Session) interactionFor(id, token string) *discordgo.Interaction {
+	s.Lock()
+	defer s.Unlock()
+	if i := s.interactions[token]; i != nil {
+		return i
+	}
+	return &discordgo.Interaction{ID: id, Token: token}
+}
+
+// restTransport answers the REST API from a Session. Anything else goes to the Session's Files.
+type restTransport struct {
+	s *Session
+}
+
+type restRequest struct {
+	query   url.Values
+	payload []byte
+	files   []*discordgo.File
+}
+
+type route struct {
+	method  string
+	pattern []string
+	handle  func(s *Session, args []string, r *restRequest) (any, error)
+}
+
+func newRoute(method, pattern string, handle func(s *Session, args []string, r *restRequest) (any, error)) route {
+	return route{method, strings.Split(pattern, "/"), handle}
+}
+
+// match reports whether path fits the pattern, where * matches any one part, and returns what each * matched.
+func (r route) match(method string, path []string) ([]string, bool) {
+	if method != r.method || len(path) != len(r.pattern) {
+		return nil, false
+	}
+	var args []string
+	for i, x := range r.pattern {
+		if x == "*" {
+			args = append(args, path[i])
+		} else if x != path[i] {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// The routes that modules use. More specific patterns come first.
+var routes = []route{
+	newRoute(http.MethodPost, "channels/*/messages/bulk-delete", func(s *Session, a []string, r *restRequest) (any, error) {
+		var data struct {
+			Messages []string `json:"messages"`
+		}
+		err := json.Unmarshal(r.payload, &data)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ChannelMessagesBulkDelete(a[0], data.Messages)
+	}),
+	newRoute(http.MethodPost, "channels/*/messages", func(s *Session, a []string, r *restRequest) (any, error) {
+		var data discordgo.MessageSend
+		comps, err := decodeMessage(r.payload, &data)
+		if err != nil {
+			return nil, err
+		}
+		data.Components, data.Files = comps, r.files
+		return s.ChannelMessageSendComplex(a[0], &data)
+	}),
+	newRoute(http.MethodGet, "channels/*/messages", func(s *Session, a []string, r *restRequest) (any, error) {
+		limit, _ := strconv.Atoi(r.query.Get("limit"))
+		return s.ChannelMessages(a[0], limit, r.query.Get("before"), r.query.Get("after"), r.query.Get("around"))
+	}),
+	newRoute(http.MethodGet, "channels/*/messages/*", func(s *Session, a []string, r *restRequest) (any, error) {
+		return s.ChannelMessage(a[0], a[1])
+	}),
+	newRoute(http.MethodPatch, "channels/*/messages/*", func(s *Session, a []string, r *restRequest) (any, error) {
+		var data discordgo.MessageEdit
+		comps, err := decodeMessage(r.payload, &data)
+		if err != nil {
+			return nil, err
+		}
+		if comps != nil {
+			data.Components = &comps
+		}
+		data.Channel, data.ID, data.Files = a[0], a[1], r.files
+		return s.ChannelMessageEditComplex(&data)
+	}),
+	newRoute(http.MethodDelete, "channels/*/messages/*", func(s *Session, a []string, r *restRequest) (any, error) {
+		return nil, s.ChannelMessageDelete(a[0], a[1])
+	}),
+	newRoute(http.MethodPut, "channels/*/messages/*/reactions/*/@me", func(s *Session, a []string, r *restRequest) (any, error) {
+		return nil, s.MessageReactionAdd(a[0], a[1], a[2])
+	}),
+	newRoute(http.MethodPost, "users/@me/channels", func(s *Session, a []string, r *restRequest) (any, error) {
+		var data struct {
+			RecipientID string `json:"recipient_id"`
+		}
+		err := json.Unmarshal(r.payload, &data)
+		if err != nil {
+			return nil, err
+		}
+		return s.UserChannelCreate(data.RecipientID)
+	}),
+	newRoute(http.MethodPost, "interactions/*/*/callback", func(s *Session, a []string, r *restRequest) (any, error) {
+		var data struct {
+			Type discordgo.InteractionResponseType `json:"type"`
+			Data json.RawMessage                   `json:"data"`
+		}
+		err := json.Unmarshal(r.payload, &data)
+		if err != nil {
+			return nil, err
+		}
+		resp := &discordgo.InteractionResponse{Type: data.Type}
+		if len(data.Data) != 0 && string(data.Data) != "null" {
+			resp.Data = new(discordgo.InteractionResponseData)
+			resp.Data.Components, err = decodeMessage(data.Data, resp.Data)
+			if err != nil {
+				return nil, err
+			}
+			resp.Data.Files = r.files
+		}
+		return nil, s.InteractionRespond(s.interactionFor(a[0], a[1]), resp)
+	}),
+	newRoute(http.MethodPatch, "webhooks/*/*/messages/@original", func(s *Session, a []string, r *restRequest) (any, error) {
+		data, err := decodeWebhookEdit(r)
+		if err != nil {
+			return nil, err
+		}
+		return s.InteractionResponseEdit(s.interactionFor("", a[1]), data)
+	}),
+	newRoute(http.MethodDelete, "webhooks/*/*/messages/@original", func(s *Session, a []string, r *restRequest) (any, error) {
+		return nil, s.InteractionResponseDelete(s.interactionFor("", a[1]))
+	}),
+	newRoute(http.MethodPost, "webhooks/*/*", func(s *Session, a []string, r *restRequest) (any, error) {
+		var data discordgo.WebhookParams
+		comps, err := decodeMessage(r.payload, &data)
+		if err != nil {
+			return nil, err
+		}
+		data.Components, data.Files = comps, r.files
+		return s.FollowupMessageCreate(s.interactionFor("", a[1]), true, &data)
+	}),
+	newRoute(http.MethodPatch, "webhooks/*/*/messages/*", func(s *Session, a []string, r *restRequest) (any, error) {
+		data, err := decodeWebhookEdit(r)
+		if err != nil {
+			return nil, err
+		}
+		return s.FollowupMessageEdit(s.interactionFor("", a[1]), a[2], data)
+	}),
+}
+
+func decodeWebhookEdit(r *restRequest) (*discordgo.WebhookEdit, error) {
+	data := new(discordgo.WebhookEdit)
+	comps, err := decodeMessage(r.payload, data)
+	if err != nil {
+		return nil, err
+	}
+	if comps != nil {
+		data.Components = &comps
+	}
+	data.Files = r.files
+	return data, nil
+}
+
+// decodeMessage reads a message payload into v and returns its components separately, since encoding/json can't fill in interfaces.
+func decodeMessage(payload []byte, v any) ([]discordgo.MessageComponent, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(payload, &fields)
+	if err != nil {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	if x, ok := fields["components"]; ok {
+		err = json.Unmarshal(x, &raw)
+		if err != nil {
+			return nil, err
+		}
+		delete(fields, "components")
+	}
+	rest, _ := json.Marshal(fields)
+	err = json.Unmarshal(rest, v)
+	if err != nil {
+		return nil, err
+	}
+	var comps []discordgo.MessageComponent
+	for _, x := range raw {
+		c, err := discordgo.MessageComponentFromJSON(x)
+		if err != nil {
+			return nil, err
+		}
+		comps = append(comps, c)
+	}
+	return comps, nil
+}
+
+// readBody returns the JSON payload of a request and any files attached to it.
+func readBody(req *http.Request) ([]byte, []*discordgo.File, error) {
+	if req.Body == nil {
+		return nil, nil, nil
+	}
+	defer req.Body.Close()
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		b, err := io.ReadAll(req.Body)
+		return b, nil, err
+	}
+	var payload []byte
+	var files []*discordgo.File
+	mr := multipart.NewReader(req.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return payload, files, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		b, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == "payload_json" {
+			payload = b
+		} else if part.FileName() != "" {
+			files = append(files, &discordgo.File{Name: part.FileName(), ContentType: part.Header.Get("Content-Type"), Reader: bytes.NewReader(b)})
+		}
+	}
+}
+
+func (t restTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path, ok := strings.CutPrefix(req.URL.Path, apiRoot.Path)
+	if req.URL.Host != apiRoot.Host || !ok {
+		return t.s.RoundTrip(req)
+	}
+	payload, files, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	status, body := http.StatusNotFound, []byte(`{"message": "fake: no such route", "code": 0}`)
+	parts := strings.Split(path, "/")
+	for _, r := range routes {
+		args, ok := r.match(req.Method, parts)
+		if !ok {
+			continue
+		}
+		out, err := r.handle(t.s, args, &restRequest{req.URL.Query(), payload, files})
+		switch {
+		case errors.Is(err, ErrNotFound):
+			status, body = http.StatusNotFound, []byte(`{"message": "Unknown Message", "code": 10008}`)
+		case err != nil:
+			status, body = http.StatusBadRequest, fmt.Appendf(nil, `{"message": %q, "code": 50035}`, err.Error())
+		case out == nil:
+			status, body = http.StatusNoContent, nil
+		default:
+			status = http.StatusOK
+			body, err = json.Marshal(out)
+			if err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+	if req.URL.RawQuery != "" {
+		path += "?" + req.URL.RawQuery
+	}
+	t.s.Lock()
+	t.s.Requests = append(t.s.Requests, Request{clock.Now(), req.Method, path, payload, status})
+	t.s.Unlock()
+	resp := &http.Response{Request: req, Header: make(http.Header), StatusCode: status, Status: http.StatusText(status)}
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
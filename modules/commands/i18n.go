@@ -0,0 +1,167 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// FallbackLanguage is used when a message has no translation for the user's or the server's language.
+const FallbackLanguage = "en"
+
+//go:embed locales/*.json
+var baseCatalog embed.FS
+
+// Language -> key -> message
+var catalog = make(map[string]map[string]string)
+var catalogLock sync.RWMutex
+
+func init() {
+	err := LoadCatalog(baseCatalog)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// LoadCatalog adds the messages in every locales/<language>.json file of fsys to the catalog.
+// Each file is a flat JSON object from key to message. Keys should be prefixed with the module name.
+func LoadCatalog(fsys fs.FS) error {
+	files, err := fs.Glob(fsys, "locales/*.json")
+	if err != nil {
+		return err
+	}
+	catalogLock.Lock()
+	defer catalogLock.Unlock()
+	for _, name := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return fmt.Errorf("failed to read catalog %s: %w", name, err)
+		}
+		var messages map[string]string
+		err = json.Unmarshal(data, &messages)
+		if err != nil {
+			return fmt.Errorf("failed to parse catalog %s: %w", name, err)
+		}
+		lang := strings.TrimSuffix(path.Base(name), ".json")
+		if catalog[lang] == nil {
+			catalog[lang] = make(map[string]string, len(messages))
+		}
+		for k, v := range messages {
+			catalog[lang][k] = v
+		}
+	}
+	return nil
+}
+
+func lookupMessage(locale discordgo.Locale, key string) (string, bool) {
+	if locale == "" {
+		return "", false
+	}
+	// Discord locales look like "es-ES" or "de", try the full tag before the bare language
+	lang := string(locale)
+	if msg, ok := catalog[lang][key]; ok {
+		return msg, true
+	}
+	lang, _, _ = strings.Cut(lang, "-")
+	msg, ok := catalog[lang][key]
+	return msg, ok
+}
+
+// Translate looks up a message for a locale, falling back to English, then to the key itself.
+// That last fallback means plain English text can be passed where a key is expected.
+// If args are given, the message is used as a format string.
+func Translate(locale discordgo.Locale, key string, args ...any) string {
+	catalogLock.RLock()
+	msg, ok := lookupMessage(locale, key)
+	if !ok {
+		msg, ok = catalog[FallbackLanguage][key]
+	}
+	catalogLock.RUnlock()
+	if !ok {
+		log.Debug("No message for " + key)
+		msg = key
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// T gets a message in the user's language, or the server's language if there is no translation for the user's.
+func (ctx *Context) T(key string, args ...any) string {
+	catalogLock.RLock()
+	msg, ok := lookupMessage(ctx.Locale, key)
+	if !ok && ctx.GuildLocale != nil {
+		msg, ok = lookupMessage(*ctx.GuildLocale, key)
+	}
+	catalogLock.RUnlock()
+	if !ok {
+		return Translate("", key, args...)
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// Localize sets the name and description shown to users with the given locale.
+// Either may be empty to leave it untranslated. For subcommands, name is only the last word.
+func (c commandStruct) Localize(locale discordgo.Locale, name, description string) commandStruct {
+	if name != "" {
+		if c.NameLocalizations == nil {
+			m := make(map[discordgo.Locale]string)
+			c.NameLocalizations = &m
+		}
+		(*c.NameLocalizations)[locale] = name
+	}
+	if description != "" && c.Type == discordgo.ChatApplicationCommand {
+		if c.DescriptionLocalizations == nil {
+			m := make(map[discordgo.Locale]string)
+			c.DescriptionLocalizations = &m
+		}
+		(*c.DescriptionLocalizations)[locale] = description
+	}
+	return c
+}
+
+// Localize sets the name and description shown to users with the given locale.
+// Either may be empty to leave it untranslated.
+func (c *commandOption) Localize(locale discordgo.Locale, name, description string) *commandOption {
+	if name != "" {
+		if c.NameLocalizations == nil {
+			c.NameLocalizations = make(map[discordgo.Locale]string)
+		}
+		c.NameLocalizations[locale] = name
+	}
+	if description != "" {
+		if c.DescriptionLocalizations == nil {
+			c.DescriptionLocalizations = make(map[discordgo.Locale]string)
+		}
+		c.DescriptionLocalizations[locale] = description
+	}
+	return c
+}
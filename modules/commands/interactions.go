@@ -0,0 +1,161 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// InteractionDeadline is how long Discord waits for the first response to an interaction.
+const InteractionDeadline = 3 * time.Second
+
+// Interactions are small, anything bigger than this is refused
+const maxInteractionBody = 1 << 20
+
+type httpReply struct {
+	resp    chan *discordgo.InteractionResponse
+	written chan error
+}
+
+// httpSession sends the first response to an interaction that came in over HTTP as the HTTP response.
+// Everything else goes to the session it wraps.
+type httpSession struct {
+	Session
+	lock    sync.Mutex
+	pending map[string]*httpReply
+}
+
+func (s *httpSession) InteractionRespond(i *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	s.lock.Lock()
+	reply, ok := s.pending[i.ID]
+	delete(s.pending, i.ID)
+	s.lock.Unlock()
+	if !ok {
+		return s.Session.InteractionRespond(i, resp, options...)
+	}
+	reply.resp <- resp
+	// Edits that follow only work once Discord has the response
+	return <-reply.written
+}
+
+// claim stops the interaction from being answered over HTTP, and reports whether it already was.
+func (s *httpSession) claim(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, unclaimed := s.pending[id]
+	delete(s.pending, id)
+	return !unclaimed
+}
+
+// InteractionHandler serves an interactions endpoint, for Discord to send interactions to over HTTP instead of the gateway.
+// Requests that are not signed with key are refused, and pings are answered here. Each other interaction is passed to dispatch with a session that sends the first response back as the HTTP response.
+func InteractionHandler(self Session, key ed25519.PublicKey, dispatch func(Session, *discordgo.Interaction)) http.Handler {
+	s := &httpSession{Session: self, pending: make(map[string]*httpReply)}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInteractionBody))
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "failed to read request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if !discordgo.VerifyInteraction(r, key) {
+			http.Error(w, "invalid request signature", http.StatusUnauthorized)
+			return
+		}
+		i := new(discordgo.Interaction)
+		err = json.Unmarshal(body, i)
+		if err != nil || i.ID == "" {
+			http.Error(w, "malformed interaction", http.StatusBadRequest)
+			return
+		}
+		if i.Type == discordgo.InteractionPing {
+			// Discord checks the endpoint with these before using it
+			writeInteractionResponse(w, &discordgo.InteractionResponse{Type: discordgo.InteractionResponsePong})
+			return
+		}
+		reply := &httpReply{make(chan *discordgo.InteractionResponse, 1), make(chan error, 1)}
+		s.lock.Lock()
+		s.pending[i.ID] = reply
+		s.lock.Unlock()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			dispatch(s, i)
+		}()
+		t := time.NewTimer(InteractionDeadline)
+		defer t.Stop()
+		var resp *discordgo.InteractionResponse
+		select {
+		case resp = <-reply.resp:
+		case <-done:
+		case <-t.C:
+		}
+		if resp == nil && s.claim(i.ID) {
+			// It was answered just as the wait ended
+			resp = <-reply.resp
+		}
+		if resp == nil {
+			log.Warn("Interaction " + i.ID + " was not answered in time")
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+		reply.written <- writeInteractionResponse(w, resp)
+	})
+}
+
+func writeInteractionResponse(w http.ResponseWriter, resp *discordgo.InteractionResponse) error {
+	var body []byte
+	var err error
+	contentType := "application/json"
+	if resp.Data != nil && len(resp.Data.Files) != 0 {
+		contentType, body, err = discordgo.MultipartBodyWithJSON(resp, resp.Data.Files)
+	} else {
+		body, err = json.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	_, err = w.Write(body)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/commands/fake"
+)
+
+func newEndpoint(t *testing.T) (*fake.Session, ed25519.PrivateKey, http.Handler) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fake.New(&discordgo.User{ID: "1", Username: "owner"})
+	dispatch := func(self commands.Session, i *discordgo.Interaction) {
+		self.InteractionRespond(i, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: "hello " + i.ID},
+		})
+	}
+	return s, priv, commands.InteractionHandler(s, pub, dispatch)
+}
+
+func serve(h http.Handler, req *http.Request) (*http.Response, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp := rec.Result()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestInteractionValidSignature(t *testing.T) {
+	s, key, h := newEndpoint(t)
+	i := s.Command(&discordgo.User{ID: "2"}, "", "3", "ping")
+	resp, body := serve(h, fake.SignedRequest(key, "http://bot/interactions", i))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+	var out discordgo.InteractionResponse
+	err := json.Unmarshal([]byte(body), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Type != discordgo.InteractionResponseChannelMessageWithSource || out.Data.Content != "hello "+i.ID {
+		t.Errorf("response %s", body)
+	}
+	// The response went over HTTP, not to the session
+	if len(s.Responses) != 0 {
+		t.Errorf("%d responses reached the session", len(s.Responses))
+	}
+}
+
+func TestInteractionTampered(t *testing.T) {
+	s, key, h := newEndpoint(t)
+	i := s.Command(&discordgo.User{ID: "2"}, "", "3", "ping")
+
+	req := fake.SignedRequest(key, "http://bot/interactions", i)
+	body, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(bytes.Replace(body, []byte(`"ping"`), []byte(`"pong"`), 1)))
+	if resp, out := serve(h, req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("tampered body: status %d: %s", resp.StatusCode, out)
+	}
+
+	req = fake.SignedRequest(key, "http://bot/interactions", i)
+	sig := []byte(req.Header.Get("X-Signature-Ed25519"))
+	sig[0] ^= 1
+	req.Header.Set("X-Signature-Ed25519", string(sig))
+	if resp, out := serve(h, req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("tampered signature: status %d: %s", resp.StatusCode, out)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	if resp, out := serve(h, fake.SignedRequest(otherKey, "http://bot/interactions", i)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d: %s", resp.StatusCode, out)
+	}
+	if len(s.Responses) != 0 {
+		t.Errorf("a refused interaction was dispatched")
+	}
+}
+
+func TestInteractionPing(t *testing.T) {
+	_, key, h := newEndpoint(t)
+	i := &discordgo.Interaction{ID: "10", Type: discordgo.InteractionPing, AppID: "20", Token: "t"}
+	resp, body := serve(h, fake.SignedRequest(key, "http://bot/interactions", i))
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(body) != `{"type":1}` {
+		t.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestInteractionTooLarge(t *testing.T) {
+	s, key, h := newEndpoint(t)
+	i := s.Command(&discordgo.User{ID: "2"}, "", "3", "ping", fake.Option("text", strings.Repeat("a", 2<<20)))
+	resp, body := serve(h, fake.SignedRequest(key, "http://bot/interactions", i))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestInteractionMethod(t *testing.T) {
+	_, _, h := newEndpoint(t)
+	resp, _ := serve(h, httptest.NewRequest(http.MethodGet, "http://bot/interactions", nil))
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("status %d, allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
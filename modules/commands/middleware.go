@@ -0,0 +1,202 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// Middleware wraps a command to run shared checks or bookkeeping around it.
+// To stop the command from running, it can respond and return without calling next.
+type Middleware func(next Command) Command
+
+// Guarded by cmdLock
+var globalMiddleware []Middleware
+
+// Use adds middleware that wraps every command, component handler and modal handler.
+// Middleware added first runs first, and global middleware runs before the middleware of a single command.
+func Use(mw ...Middleware) {
+	cmdLock.Lock()
+	globalMiddleware = append(globalMiddleware, mw...)
+	cmdLock.Unlock()
+}
+
+// Use adds middleware to this command and its component and modal handlers.
+// Subcommands registered after it get it too.
+func (c commandStruct) Use(mw ...Middleware) commandStruct {
+	c.middleware = append(slices.Clip(c.middleware), mw...)
+	return c
+}
+
+// wrap must be called with cmdLock held.
+func wrap(cmd Command, mw []Middleware) Command {
+	if cmd == nil {
+		return nil
+	}
+	for i := len(mw) - 1; i >= 0; i-- {
+		cmd = mw[i](cmd)
+	}
+	for i := len(globalMiddleware) - 1; i >= 0; i-- {
+		cmd = globalMiddleware[i](cmd)
+	}
+	return cmd
+}
+
+// PanicError is what Recover turns a panic into.
+type PanicError struct {
+	Value any
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprint("panic: ", e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Recover turns a panic in the command into a *PanicError.
+func Recover(next Command) Command {
+	return func(ctx *Context) (err error) {
+		defer func() {
+			x := recover()
+			if x != nil {
+				err = &PanicError{x, string(debug.Stack())}
+			}
+		}()
+		return next(ctx)
+	}
+}
+
+// Logging logs how long the command took, and the error if it failed.
+// Put it before Recover to log panics too.
+func Logging(next Command) Command {
+	return func(ctx *Context) error {
+		start := time.Now()
+		err := next(ctx)
+		var optErr *OptionError
+		if err == nil || errors.As(err, &optErr) || errors.Is(err, ErrStateExpired) {
+			log.Debug(fmt.Sprintf("%s took %s", ctx.Path(), time.Since(start)))
+			return err
+		}
+		if ctx.Type == discordgo.InteractionMessageComponent {
+			log.Errors("Error in message component")
+		} else {
+			log.Errors(fmt.Sprintf("Error in command %s", ctx.Path()))
+		}
+		log.Error(err)
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			log.Errors(panicErr.Stack)
+		}
+		return err
+	}
+}
+
+// GuildOnly refuses to run the command outside of servers.
+// Commands marked with Guild have it already.
+func GuildOnly(next Command) Command {
+	return func(ctx *Context) error {
+		if ctx.GuildID == "" {
+			return ctx.RespondPrivate(ctx.T("commands.guildOnly"))
+		}
+		return next(ctx)
+	}
+}
+
+// RequirePerms refuses to run the command unless the user has all of perms in the channel.
+// Unlike Perms, server admins can't override this.
+func RequirePerms(perms int64) Middleware {
+	return func(next Command) Command {
+		return func(ctx *Context) error {
+			if !ctx.HasPermission(perms) {
+				return ctx.RespondPrivate(ctx.T("commands.needPerms", PermissionNames(perms)))
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// BotPerms refuses to run the command unless the bot has all of perms in the channel.
+// Outside of servers it does nothing.
+func BotPerms(perms int64) Middleware {
+	return func(next Command) Command {
+		return func(ctx *Context) error {
+			if ctx.GuildID != "" && ctx.AppPermissions&perms != perms && ctx.AppPermissions&discordgo.PermissionAdministrator == 0 {
+				return ctx.RespondPrivate(ctx.T("commands.botNeedsPerms", PermissionNames(perms&^ctx.AppPermissions)))
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// HasPermission reports whether the user has all of perms in this channel.
+// Outside of servers, there is nothing to check and it is always true.
+func (ctx *Context) HasPermission(perms int64) bool {
+	if ctx.Member == nil {
+		return true
+	}
+	p := ctx.Member.Permissions
+	return p&perms == perms || p&discordgo.PermissionAdministrator != 0
+}
+
+var permissionNames = []struct {
+	p    int64
+	name string
+}{
+	{discordgo.PermissionAdministrator, "Administrator"},
+	{discordgo.PermissionManageGuild, "Manage Server"},
+	{discordgo.PermissionManageRoles, "Manage Roles"},
+	{discordgo.PermissionManageChannels, "Manage Channels"},
+	{discordgo.PermissionManageMessages, "Manage Messages"},
+	{discordgo.PermissionKickMembers, "Kick Members"},
+	{discordgo.PermissionBanMembers, "Ban Members"},
+	{discordgo.PermissionViewChannel, "View Channel"},
+	{discordgo.PermissionSendMessages, "Send Messages"},
+	{discordgo.PermissionEmbedLinks, "Embed Links"},
+	{discordgo.PermissionAttachFiles, "Attach Files"},
+	{discordgo.PermissionReadMessageHistory, "Read Message History"},
+	{discordgo.PermissionAddReactions, "Add Reactions"},
+	{discordgo.PermissionVoiceConnect, "Connect"},
+	{discordgo.PermissionVoiceSpeak, "Speak"},
+}
+
+// PermissionNames lists the permissions in perms the way the Discord client names them.
+func PermissionNames(perms int64) string {
+	var out []string
+	for _, x := range permissionNames {
+		if perms&x.p != 0 {
+			out = append(out, x.name)
+			perms &^= x.p
+		}
+	}
+	if perms != 0 {
+		out = append(out, fmt.Sprintf("0x%x", perms))
+	}
+	return strings.Join(out, ", ")
+}
@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// responseRecorder is a Session that only takes interaction responses.
+type responseRecorder struct {
+	Session
+	responses []*discordgo.InteractionResponse
+}
+
+func (r *responseRecorder) InteractionRespond(_ *discordgo.Interaction, resp *discordgo.InteractionResponse, _ ...discordgo.RequestOption) error {
+	r.responses = append(r.responses, resp)
+	return nil
+}
+
+func TestRecover(t *testing.T) {
+	errBoom := errors.New("boom")
+	tests := []struct {
+		name  string
+		cmd   Command
+		value any
+	}{
+		{"string", func(*Context) error { panic("boom") }, "boom"},
+		{"error", func(*Context) error { panic(errBoom) }, errBoom},
+	}
+	for _, tt := range tests {
+		err := Recover(tt.cmd)(&Context{})
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) {
+			t.Errorf("%s: got %v", tt.name, err)
+			continue
+		}
+		if panicErr.Value != tt.value || !strings.Contains(panicErr.Stack, "TestRecover") {
+			t.Errorf("%s: value %v, stack %s", tt.name, panicErr.Value, panicErr.Stack)
+		}
+	}
+	if err := Recover(func(*Context) error { return errBoom })(&Context{}); err != errBoom {
+		t.Errorf("error changed to %v", err)
+	}
+	if err := Recover(func(*Context) error { panic(errBoom) })(&Context{}); !errors.Is(err, errBoom) {
+		t.Errorf("%v doesn't unwrap to the panicked error", err)
+	}
+}
+
+func TestWrapOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next Command) Command {
+			return func(ctx *Context) error {
+				calls = append(calls, name)
+				return next(ctx)
+			}
+		}
+	}
+	old := globalMiddleware
+	t.Cleanup(func() { globalMiddleware = old })
+	globalMiddleware = []Middleware{record("global 1"), record("global 2")}
+	cmd := wrap(func(*Context) error {
+		calls = append(calls, "command")
+		return nil
+	}, []Middleware{record("command 1"), record("command 2")})
+	cmd(&Context{})
+	if want := []string{"global 1", "global 2", "command 1", "command 2", "command"}; !slices.Equal(calls, want) {
+		t.Errorf("calls %q, want %q", calls, want)
+	}
+}
+
+func TestPermissionMiddleware(t *testing.T) {
+	const need = discordgo.PermissionManageMessages | discordgo.PermissionEmbedLinks
+	tests := []struct {
+		name    string
+		mw      Middleware
+		guild   bool
+		user    int64
+		bot     int64
+		runs    bool
+		missing string
+	}{
+		{"user has them", RequirePerms(need), true, need, 0, true, ""},
+		{"user is admin", RequirePerms(need), true, discordgo.PermissionAdministrator, 0, true, ""},
+		{"user lacks one", RequirePerms(need), true, discordgo.PermissionManageMessages, 0, false, "Manage Messages, Embed Links"},
+		{"user in DMs", RequirePerms(need), false, 0, 0, true, ""},
+		{"bot has them", BotPerms(need), true, 0, need | discordgo.PermissionSendMessages, true, ""},
+		{"bot is admin", BotPerms(need), true, 0, discordgo.PermissionAdministrator, true, ""},
+		{"bot lacks one", BotPerms(need), true, need, discordgo.PermissionManageMessages, false, "Embed Links"},
+		{"bot in DMs", BotPerms(need), false, 0, 0, true, ""},
+	}
+	for _, tt := range tests {
+		rec := new(responseRecorder)
+		i := &discordgo.Interaction{Type: discordgo.InteractionApplicationCommand, AppPermissions: tt.bot, User: &discordgo.User{ID: "1"}}
+		if tt.guild {
+			i.GuildID = "2"
+			i.Member = &discordgo.Member{User: i.User, Permissions: tt.user}
+		}
+		ran := false
+		err := tt.mw(func(*Context) error {
+			ran = true
+			return nil
+		})(&Context{Interaction: i, Bot: rec})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if ran != tt.runs {
+			t.Errorf("%s: ran %v, want %v", tt.name, ran, tt.runs)
+		}
+		if tt.runs {
+			if len(rec.responses) != 0 {
+				t.Errorf("%s: responded %+v", tt.name, rec.responses[0].Data)
+			}
+			continue
+		}
+		if len(rec.responses) != 1 {
+			t.Errorf("%s: %d responses", tt.name, len(rec.responses))
+			continue
+		}
+		data := rec.responses[0].Data
+		if data.Flags&discordgo.MessageFlagsEphemeral == 0 || !strings.HasSuffix(data.Content, ": "+tt.missing) {
+			t.Errorf("%s: responded %q", tt.name, data.Content)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// Module is a part of the bot that can be started and stopped on its own.
+// Modules call RegisterModule from an init function, so importing the package is enough to load it.
+type Module interface {
+	// Name must be unique. It is what other modules list in Deps.
+	Name() string
+	// Deps are the names of modules that must be started before this one.
+	Deps() []string
+	// Init registers commands and handlers and prepares anything the module needs.
+	// If it returns an error, the module's commands and handlers are removed again and its dependents are not started.
+	Init(self Session) error
+	// Cleanup is only called if Init succeeded.
+	Cleanup(self Session)
+	// Health reports a problem with a running module, or nil if there is none.
+	Health() error
+}
+
+// StatusReporter is implemented by modules that have something to add to /admin status.
+type StatusReporter interface {
+	// Status is a short line like "3 pending reminders".
+	Status() string
+}
+
+// ModuleStatus describes a module for status reports.
+type ModuleStatus struct {
+	Name    string
+	Running bool
+	// Why the module failed to start, or what Health reported
+	Err error
+	// From StatusReporter, if the module is running and implements it
+	Info string
+}
+
+type moduleEntry struct {
+	Module
+	running  bool
+	err      error
+	commands []string
+	removers []func()
+}
+
+var modules = make(map[string]*moduleEntry)
+
+// Start order, filled in by StartModules
+var moduleOrder []*moduleEntry
+
+// The module whose Init is running, so Register knows who owns each command
+var loadingModule *moduleEntry
+
+// Held while modules are being started or stopped
+var moduleLock sync.Mutex
+
+// ErrModuleOff is the status of a module that was turned off by the owner.
+var ErrModuleOff = errors.New("turned off")
+
+// RegisterModule adds a module to be started by StartModules.
+func RegisterModule(m Module) {
+	if _, ok := modules[m.Name()]; ok {
+		panic("module registered twice: " + m.Name())
+	}
+	modules[m.Name()] = &moduleEntry{Module: m}
+}
+
+// moduleSession remembers the handlers a module adds so they can be removed if it fails.
+// Each call to a handler is tracked, so shutdown waits for the running ones and later events are dropped.
+type moduleSession struct {
+	Session
+	e *moduleEntry
+}
+
+func (s moduleSession) AddHandler(handler interface{}) func() {
+	remove := s.Session.AddHandler(trackHandler(handler))
+	s.e.removers = append(s.e.removers, remove)
+	return remove
+}
+
+// trackHandler wraps an event handler in Track, keeping its type so the session still knows which events it takes.
+func trackHandler(handler interface{}) interface{} {
+	f := reflect.ValueOf(handler)
+	if f.Kind() != reflect.Func {
+		return handler
+	}
+	return reflect.MakeFunc(f.Type(), func(args []reflect.Value) []reflect.Value {
+		done, ok := Track()
+		if !ok {
+			return nil
+		}
+		defer done()
+		return f.Call(args)
+	}).Interface()
+}
+
+func sortModules() ([]*moduleEntry, error) {
+	names := make([]string, 0, len(modules))
+	for k := range modules {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	order := make([]*moduleEntry, 0, len(modules))
+	// 0 = unvisited, 1 = in progress, 2 = done
+	state := make(map[string]int, len(modules))
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("module dependency cycle: %s", strings.Join(append(chain, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		e := modules[name]
+		for _, dep := range e.Deps() {
+			if _, ok := modules[dep]; !ok {
+				continue
+			}
+			err := visit(dep, append(chain, name))
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, e)
+		return nil
+	}
+	for _, name := range names {
+		err := visit(name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+func startModule(self Session, e *moduleEntry) (err error) {
+	for _, dep := range e.Deps() {
+		d, ok := modules[dep]
+		if !ok {
+			return fmt.Errorf("missing dependency %s", dep)
+		}
+		if !d.running {
+			return fmt.Errorf("dependency %s is not running", dep)
+		}
+	}
+	loadingModule = e
+	defer func() {
+		loadingModule = nil
+		if x := recover(); x != nil {
+			err = fmt.Errorf("panic during init: %v", x)
+		}
+	}()
+	return e.Init(moduleSession{self, e})
+}
+
+// StartModules starts every registered module after the modules it depends on.
+// Modules that fail are logged and left disabled. The returned error lists all of the failures.
+func StartModules(self Session) error {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	order, err := sortModules()
+	if err != nil {
+		return err
+	}
+	moduleOrder = order
+	var errs []error
+	for _, e := range order {
+		if e.Name() != "commands" && isModuleOff(e.Name()) {
+			e.err = ErrModuleOff
+			log.Info("Module " + e.Name() + " is turned off")
+			continue
+		}
+		e.err = startModule(self, e)
+		if e.err != nil {
+			disableModule(e)
+			log.Errors("Module " + e.Name() + " failed to start")
+			log.Error(e.err)
+			errs = append(errs, fmt.Errorf("%s: %w", e.Name(), e.err))
+			continue
+		}
+		e.running = true
+		log.Info("Loaded " + e.Name())
+	}
+	return errors.Join(errs...)
+}
+
+// StopModules cleans up the running modules in the reverse of the order they were started.
+// It returns an error for every module whose cleanup panicked.
+func StopModules(self Session) error {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	var errs []error
+	for i := len(moduleOrder) - 1; i >= 0; i-- {
+		e := moduleOrder[i]
+		if !e.running {
+			continue
+		}
+		// Handlers go first so nothing reaches the module while it cleans up
+		disableModule(e)
+		err := stopModule(self, e)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func stopModule(self Session, e *moduleEntry) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("module %s panicked during cleanup: %v", e.Name(), x)
+			log.Error(err)
+		}
+	}()
+	e.running = false
+	e.Cleanup(self)
+	return nil
+}
+
+func isModuleOff(name string) bool {
+	if db == nil {
+		return false
+	}
+	var x int
+	return db.QueryRow("SELECT 1 FROM disabledModules WHERE name=?001;", name).Scan(&x) == nil
+}
+
+// EnableModule starts a module that is not running and remembers that it should run from now on.
+// The command list is synced afterwards if it had already been uploaded.
+func EnableModule(self Session, name string) error {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	e, ok := modules[name]
+	if !ok {
+		return fmt.Errorf("there is no module called %s", name)
+	}
+	if e.running {
+		return fmt.Errorf("%s is already running", name)
+	}
+	e.err = startModule(self, e)
+	if e.err != nil {
+		disableModule(e)
+		return e.err
+	}
+	e.running = true
+	log.Info("Loaded " + name)
+	_, err := db.Exec("DELETE FROM disabledModules WHERE name=?001;", name)
+	if err != nil {
+		return fmt.Errorf("failed to save module state: %w", err)
+	}
+	if resync != nil {
+		return resync()
+	}
+	return nil
+}
+
+// DisableModule stops a module, takes away its commands and handlers, and remembers that it should not run from now on.
+// Modules that other running modules depend on cannot be disabled.
+func DisableModule(self Session, name string) error {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	e, ok := modules[name]
+	if !ok {
+		return fmt.Errorf("there is no module called %s", name)
+	}
+	if name == "commands" {
+		return errors.New("the commands module cannot be disabled")
+	}
+	if e.running {
+		var users []string
+		for _, x := range moduleOrder {
+			if x.running && slices.Contains(x.Deps(), name) {
+				users = append(users, x.Name())
+			}
+		}
+		if len(users) != 0 {
+			return fmt.Errorf("%s is needed by %s", name, strings.Join(users, ", "))
+		}
+		// Handlers go first so nothing reaches the module while it cleans up
+		disableModule(e)
+		stopModule(self, e)
+		log.Info("Unloaded " + name)
+	}
+	e.err = ErrModuleOff
+	_, err := db.Exec("INSERT OR IGNORE INTO disabledModules (name) VALUES (?001);", name)
+	if err != nil {
+		return fmt.Errorf("failed to save module state: %w", err)
+	}
+	if resync != nil {
+		return resync()
+	}
+	return nil
+}
+
+// ModuleStatuses reports on every module, in start order.
+func ModuleStatuses() []ModuleStatus {
+	moduleLock.Lock()
+	defer moduleLock.Unlock()
+	out := make([]ModuleStatus, len(moduleOrder))
+	for i, e := range moduleOrder {
+		out[i] = ModuleStatus{Name: e.Name(), Running: e.running, Err: e.err}
+		if e.running {
+			out[i].Err = e.Health()
+			if r, ok := e.Module.(StatusReporter); ok {
+				out[i].Info = r.Status()
+			}
+		}
+	}
+	return out
+}
+
+// disableModule takes away everything a module registered.
+func disableModule(e *moduleEntry) {
+	for _, remove := range e.removers {
+		remove()
+	}
+	e.removers = nil
+	for i := len(e.commands) - 1; i >= 0; i-- {
+		unregister(e.commands[i])
+	}
+	e.commands = nil
+}
+
+// unregister is the reverse of Register.
+func unregister(path string) {
+	cmdLock.Lock()
+	defer cmdLock.Unlock()
+	delete(cmdMap, path)
+	parts := strings.Split(path, " ")
+	if len(parts) == 1 {
+		batchCmdList = slices.DeleteFunc(batchCmdList, func(c commandStruct) bool { return c.Name == path })
+		return
+	}
+	var parent *[]*discordgo.ApplicationCommandOption
+	for _, x := range batchCmdList {
+		if x.Type == discordgo.ChatApplicationCommand && x.Name == parts[0] {
+			parent = &x.Options
+			break
+		}
+	}
+	if parent != nil && len(parts) == 3 {
+		parent = findSubcommand(*parent, parts[1])
+	}
+	if parent != nil {
+		name := parts[len(parts)-1]
+		*parent = slices.DeleteFunc(*parent, func(o *discordgo.ApplicationCommandOption) bool { return o.Name == name })
+	}
+}
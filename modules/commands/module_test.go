@@ -0,0 +1,135 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type testModule struct {
+	name    string
+	deps    []string
+	initErr error
+	// Where Init and Cleanup write down the module's name
+	started, stopped *[]string
+}
+
+func (m testModule) Name() string   { return m.name }
+func (m testModule) Deps() []string { return m.deps }
+func (m testModule) Health() error  { return nil }
+
+func (m testModule) Init(Session) error {
+	if m.initErr != nil {
+		return m.initErr
+	}
+	*m.started = append(*m.started, m.name)
+	return nil
+}
+
+func (m testModule) Cleanup(Session) {
+	*m.stopped = append(*m.stopped, m.name)
+}
+
+// useModules replaces the registered modules for the rest of the test.
+func useModules(t *testing.T, ms ...testModule) {
+	oldModules, oldOrder := modules, moduleOrder
+	t.Cleanup(func() {
+		modules, moduleOrder = oldModules, oldOrder
+	})
+	modules = make(map[string]*moduleEntry)
+	moduleOrder = nil
+	for _, m := range ms {
+		RegisterModule(m)
+	}
+}
+
+func moduleNames(ls []*moduleEntry) []string {
+	out := make([]string, len(ls))
+	for i, e := range ls {
+		out[i] = e.Name()
+	}
+	return out
+}
+
+func TestSortModules(t *testing.T) {
+	var started []string
+	useModules(t,
+		testModule{name: "a", deps: []string{"c"}, started: &started},
+		testModule{name: "b", deps: []string{"commands"}, started: &started},
+		testModule{name: "c", deps: []string{"commands", "b"}, started: &started},
+		testModule{name: "commands", started: &started},
+		testModule{name: "d", started: &started},
+	)
+	order, err := sortModules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := moduleNames(order), []string{"commands", "b", "c", "a", "d"}; !slices.Equal(got, want) {
+		t.Errorf("order %q, want %q", got, want)
+	}
+}
+
+func TestSortModulesCycle(t *testing.T) {
+	useModules(t,
+		testModule{name: "a", deps: []string{"b"}},
+		testModule{name: "b", deps: []string{"c"}},
+		testModule{name: "c", deps: []string{"a"}},
+	)
+	_, err := sortModules()
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> c -> a") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestStartModulesFailures(t *testing.T) {
+	var started, stopped []string
+	failed := errors.New("no config")
+	useModules(t,
+		testModule{name: "base", started: &started, stopped: &stopped},
+		testModule{name: "broken", deps: []string{"base"}, initErr: failed, started: &started, stopped: &stopped},
+		testModule{name: "needsBroken", deps: []string{"broken"}, started: &started, stopped: &stopped},
+		testModule{name: "needsNeedsBroken", deps: []string{"needsBroken"}, started: &started, stopped: &stopped},
+		testModule{name: "orphan", deps: []string{"missing"}, started: &started, stopped: &stopped},
+		testModule{name: "zfine", deps: []string{"base"}, started: &started, stopped: &stopped},
+	)
+	err := StartModules(nil)
+	if !errors.Is(err, failed) {
+		t.Errorf("error %v doesn't include the failed Init", err)
+	}
+	if want := []string{"base", "zfine"}; !slices.Equal(started, want) {
+		t.Errorf("started %q, want %q", started, want)
+	}
+	for name, want := range map[string]string{
+		"broken":           "no config",
+		"needsBroken":      "dependency broken is not running",
+		"needsNeedsBroken": "dependency needsBroken is not running",
+		"orphan":           "missing dependency missing",
+	} {
+		e := modules[name]
+		if e.running || e.err == nil || e.err.Error() != want {
+			t.Errorf("%s: running %v, error %v, want %q", name, e.running, e.err, want)
+		}
+	}
+	StopModules(nil)
+	if want := []string{"zfine", "base"}; !slices.Equal(stopped, want) {
+		t.Errorf("stopped %q, want %q", stopped, want)
+	}
+}
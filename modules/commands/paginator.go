@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"strconv"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// PageFetcher builds the embed for the items from offset to offset+limit and reports how many items there are in total.
+type PageFetcher func(ctx *Context, offset, limit int) (*discordgo.MessageEmbed, int, error)
+
+// Paginator shows a listing one page at a time with first, previous, next and last buttons.
+// Use Respond as both the command and the component handler.
+type Paginator struct {
+	PageSize int
+	Fetch    PageFetcher
+	// Sent instead of a page when there are no items, may be a catalog key
+	Empty   string
+	Private bool
+}
+
+type pagerPos struct {
+	Page int
+	// Which button this is, since two buttons can point to the same page
+	Button uint8
+}
+
+var pagerState = NewStateCodec[pagerPos]("pager", 1)
+
+func (p *Paginator) Respond(ctx *Context) error {
+	page := 0
+	if ctx.Type == discordgo.InteractionMessageComponent {
+		pos, err := pagerState.Decode(ctx)
+		if err != nil {
+			return err
+		}
+		page = max(pos.Page, 0)
+	}
+	embed, total, err := p.Fetch(ctx, page*p.PageSize, p.PageSize)
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		return ctx.RespondPrivate(ctx.T(p.Empty))
+	}
+	pages := (total + p.PageSize - 1) / p.PageSize
+	if page >= pages {
+		// The listing shrank since the buttons were made
+		page = pages - 1
+		embed, total, err = p.Fetch(ctx, page*p.PageSize, p.PageSize)
+		if err != nil {
+			return err
+		}
+		pages = max((total+p.PageSize-1)/p.PageSize, 1)
+	}
+	if pages > 1 {
+		ctx.SetComponents(
+			discordgo.Button{CustomID: pagerState.Encode(ctx, pagerPos{0, 0}), Emoji: &discordgo.ComponentEmoji{Name: "\u23EE"}, Disabled: page == 0, Style: discordgo.SecondaryButton},
+			discordgo.Button{CustomID: pagerState.Encode(ctx, pagerPos{page - 1, 1}), Emoji: &discordgo.ComponentEmoji{Name: "\u2B05"}, Disabled: page == 0, Style: discordgo.SecondaryButton},
+			discordgo.Button{CustomID: pagerState.Encode(ctx, pagerPos{page, 2}), Label: strconv.Itoa(page+1) + "/" + strconv.Itoa(pages), Disabled: true, Style: discordgo.SecondaryButton},
+			discordgo.Button{CustomID: pagerState.Encode(ctx, pagerPos{page + 1, 3}), Emoji: &discordgo.ComponentEmoji{Name: "\u27A1"}, Disabled: page == pages-1, Style: discordgo.SecondaryButton},
+			discordgo.Button{CustomID: pagerState.Encode(ctx, pagerPos{pages - 1, 4}), Emoji: &discordgo.ComponentEmoji{Name: "\u23ED"}, Disabled: page == pages-1, Style: discordgo.SecondaryButton},
+		)
+	}
+	return ctx.RespondEmbed(embed, p.Private)
+}
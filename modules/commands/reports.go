@@ -0,0 +1,337 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// How often the owner gets a DM about new errors
+const errorDigestInterval = 10 * time.Minute
+
+// Stacks longer than this are sent as a file by /errors show
+const maxInlineStack = 1000
+
+var stmtReportUpsert *sql.Stmt
+var reportLock sync.Mutex
+var digestStopper chan struct{}
+
+type reportsModule struct{}
+
+func init() {
+	RegisterModule(reportsModule{})
+}
+
+func (reportsModule) Name() string {
+	return "errors"
+}
+
+func (reportsModule) Deps() []string {
+	return []string{"commands"}
+}
+
+func (reportsModule) Init(self Session) error {
+	err := createTables(`CREATE TABLE IF NOT EXISTS errorReports (
+		id INTEGER PRIMARY KEY,
+		fingerprint VARCHAR(16) UNIQUE NOT NULL,
+		command VARCHAR(100),
+		options TEXT,
+		message TEXT,
+		stack TEXT,
+		gid UNSIGNED BIGINT,
+		first INTEGER,
+		last INTEGER,
+		count INTEGER,
+		notified INTEGER
+	);`)
+	if err != nil {
+		return err
+	}
+	stmt, err := db.Prepare(`INSERT INTO errorReports (fingerprint, command, options, message, stack, gid, first, last, count, notified)
+		VALUES (?001, ?002, ?003, ?004, ?005, ?006, ?007, ?007, 1, 0)
+		ON CONFLICT (fingerprint) DO UPDATE SET options = ?003, message = ?004, gid = ?006, last = ?007, count = count + 1
+		RETURNING id;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	reportLock.Lock()
+	stmtReportUpsert = stmt
+	reportLock.Unlock()
+	PrepareCommand("errors", "Look through error reports").Use(OwnerOnly).Register(nil, nil)
+	PrepareCommand("errors list", "List error reports, most recent first").Component(errorList.Respond).Register(errorList.Respond, nil)
+	PrepareCommand("errors show", "Show an error report").Register(errorShow, []*discordgo.ApplicationCommandOption{
+		NewCommandOption("id", "Report number").AsInt().SetMinMax(1, 1<<31-1).Required().Finalize(),
+	})
+	digestStopper = make(chan struct{})
+	go digestSender(self, digestStopper)
+	return nil
+}
+
+func (reportsModule) Cleanup(self Session) {
+	close(digestStopper)
+	reportLock.Lock()
+	stmtReportUpsert.Close()
+	stmtReportUpsert = nil
+	reportLock.Unlock()
+	// Don't lose whatever happened since the last digest
+	sendDigest(self)
+}
+
+func (reportsModule) Health() error {
+	return nil
+}
+
+var stackAddr = regexp.MustCompile(`(?m)(\([0-9a-fx, .{}]*\)| \+0x[0-9a-f]+$|^goroutine \d+ \[.*\]:$)`)
+var errorNumbers = regexp.MustCompile(`[0-9]+`)
+
+// fingerprint identifies errors that are really the same error.
+// Panics are told apart by where they happened, other errors by what they say with numbers like IDs taken out.
+func fingerprint(command, msg, stack string) string {
+	h := sha256.New()
+	h.Write([]byte(command))
+	h.Write([]byte{0})
+	if stack != "" {
+		h.Write([]byte(stackAddr.ReplaceAllString(stack, "")))
+	} else {
+		h.Write([]byte(errorNumbers.ReplaceAllString(msg, "#")))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+func describeOptions(ctx *Context) string {
+	switch ctx.Type {
+	case discordgo.InteractionApplicationCommand:
+		opts := make(map[string]any)
+		for _, o := range ctx.Options() {
+			opts[o.Name] = o.Value
+		}
+		b, _ := json.Marshal(opts)
+		return string(b)
+	case discordgo.InteractionMessageComponent:
+		return "component " + ctx.MessageComponentData().CustomID
+	case discordgo.InteractionModalSubmit:
+		return "modal " + ctx.ModalSubmitData().CustomID
+	}
+	return ""
+}
+
+// ReportError stores an error so the owner can look at it with /errors, and returns its report number.
+// Repeats of a stored error only bump its count. It returns 0 if the errors module is not running.
+func ReportError(ctx *Context, err error, stack string) int64 {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	if stmtReportUpsert == nil {
+		return 0
+	}
+	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
+	msg := err.Error()
+	var id int64
+	err = stmtReportUpsert.QueryRow(fingerprint(ctx.Path(), msg, stack), ctx.Path(), describeOptions(ctx), msg, stack, gid, time.Now().Unix()).Scan(&id)
+	if err != nil {
+		log.Error(fmt.Errorf("failed to store error report: %w", err))
+		return 0
+	}
+	return id
+}
+
+func digestSender(self Session, stopper <-chan struct{}) {
+	t := time.NewTicker(errorDigestInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			// Cleanup sends the last one during shutdown
+			if done, ok := Track(); ok {
+				sendDigest(self)
+				done()
+			}
+		case <-stopper:
+			return
+		}
+	}
+}
+
+// sendDigest DMs the owner one message about every report that happened again since the last one.
+func sendDigest(self Session) {
+	rows, err := db.Query("SELECT id, command, message, count - notified, count FROM errorReports WHERE count > notified ORDER BY last DESC;")
+	if err != nil {
+		log.Error(fmt.Errorf("failed to query error reports: %w", err))
+		return
+	}
+	// The count read here is what gets marked as notified, so reports that happen
+	// while the digest is being sent show up in the next one.
+	var ids []int64
+	var counts []int
+	output := new(strings.Builder)
+	output.WriteString("Errors since the last digest:\n")
+	more := 0
+	for rows.Next() {
+		var id int64
+		var command, msg string
+		var fresh, count int
+		err = rows.Scan(&id, &command, &msg, &fresh, &count)
+		if err != nil {
+			rows.Close()
+			log.Error(fmt.Errorf("failed to read error report: %w", err))
+			return
+		}
+		ids = append(ids, id)
+		counts = append(counts, count)
+		line := fmt.Sprintf("#%d `%s` %dx", id, command, fresh)
+		if fresh == count {
+			line += " (new)"
+		}
+		line += ": " + truncate(msg, 100) + "\n"
+		if output.Len()+len(line) > 1900 {
+			more++
+			continue
+		}
+		output.WriteString(line)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return
+	}
+	if more != 0 {
+		fmt.Fprintf(output, "...and %d more. Use /errors list to see them all.", more)
+	}
+	owner := Owner(self.GetState().Application)
+	if owner == nil {
+		return
+	}
+	channel, err := self.UserChannelCreate(owner.ID)
+	if err == nil {
+		_, err = self.ChannelMessageSend(channel.ID, output.String())
+	}
+	if err != nil {
+		log.Error(fmt.Errorf("failed to send error digest: %w", err))
+		return
+	}
+	for i, id := range ids {
+		_, err = db.Exec("UPDATE errorReports SET notified = ?001 WHERE id = ?002;", counts[i], id)
+		if err != nil {
+			log.Error(fmt.Errorf("failed to mark error report as notified: %w", err))
+		}
+	}
+}
+
+func truncate(s string, n int) string {
+	s, _, _ = strings.Cut(s, "\n")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// ~!errors list
+// @OwnerOnly
+// Lists stored error reports
+var errorList = &Paginator{PageSize: 10, Fetch: errorListPage, Empty: "There are no error reports.", Private: true}
+
+func errorListPage(ctx *Context, offset, limit int) (*discordgo.MessageEmbed, int, error) {
+	var total int
+	err := ctx.Database.QueryRow("SELECT COUNT(*) FROM errorReports;").Scan(&total)
+	if err != nil || total == 0 {
+		return nil, total, err
+	}
+	rows, err := ctx.Database.Query("SELECT id, command, message, count, last FROM errorReports ORDER BY last DESC LIMIT ?001 OFFSET ?002;", limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query error reports: %w", err)
+	}
+	defer rows.Close()
+	output := new(strings.Builder)
+	for rows.Next() {
+		var id, last int64
+		var command, msg string
+		var count int
+		err = rows.Scan(&id, &command, &msg, &count, &last)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read error report: %w", err)
+		}
+		fmt.Fprintf(output, "**#%d** `%s` %dx, last <t:%d:R>\n%s\n", id, command, count, last, truncate(msg, 120))
+	}
+	embed := new(discordgo.MessageEmbed)
+	embed.Title = "Error reports"
+	embed.Description = output.String()
+	embed.Color = 0xcc3333
+	return embed, total, nil
+}
+
+// ~!errors show <id>
+// @OwnerOnly
+// Shows everything stored about an error
+// Long stack traces are attached as a file.
+func errorShow(ctx *Context) error {
+	var args struct {
+		ID int64 `option:"id,required"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	var command, options, msg, stack string
+	var gid, first, last int64
+	var count int
+	err = ctx.Database.QueryRow("SELECT command, options, message, stack, gid, first, last, count FROM errorReports WHERE id = ?001;", args.ID).
+		Scan(&command, &options, &msg, &stack, &gid, &first, &last, &count)
+	if err == sql.ErrNoRows {
+		return ctx.RespondPrivate(ctx.T("commands.noReport", args.ID))
+	} else if err != nil {
+		return fmt.Errorf("failed to query error report: %w", err)
+	}
+	embed := new(discordgo.MessageEmbed)
+	embed.Title = fmt.Sprintf("Error #%d in %s", args.ID, command)
+	embed.Color = 0xcc3333
+	if len(msg) > 1000 {
+		ctx.AttachFile(fmt.Sprintf("error-%d-message.txt", args.ID), "text/plain", strings.NewReader(msg))
+		msg = truncate(msg, 1000)
+	}
+	embed.Description = "```\n" + msg + "\n```"
+	where := "DM"
+	if gid != 0 {
+		where = strconv.FormatUint(uint64(gid), 10)
+		if g, err := ctx.State.Guild(where); err == nil {
+			where = g.Name + " (" + where + ")"
+		}
+	}
+	embed.Fields = []*discordgo.MessageEmbedField{
+		{Name: "Seen", Value: fmt.Sprintf("%d times, first <t:%d:f>, last <t:%d:f>", count, first, last)},
+		{Name: "Last server", Value: where},
+	}
+	if options != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Last options", Value: "`" + truncate(options, 1000) + "`"})
+	}
+	if len(stack) > maxInlineStack {
+		ctx.AttachFile(fmt.Sprintf("error-%d-stack.txt", args.ID), "text/plain", strings.NewReader(stack))
+	} else if stack != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Stack", Value: "```\n" + stack + "\n```"})
+	}
+	return ctx.RespondEmbed(embed, true)
+}
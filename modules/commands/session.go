@@ -0,0 +1,85 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Session is the part of a Discord connection that modules are allowed to use.
+// A live bot gets one from WrapSession. The fake package provides an in-memory one so modules can be run offline.
+type Session interface {
+	AddHandler(handler interface{}) func()
+	GetState() *discordgo.State
+	HeartbeatLatency() time.Duration
+	HTTPClient() *http.Client
+
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+	InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error
+	FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	FollowupMessageEdit(interaction *discordgo.Interaction, messageID string, data *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error)
+	ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageEditComplex(data *discordgo.MessageEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error
+	ChannelMessagesBulkDelete(channelID string, messages []string, options ...discordgo.RequestOption) error
+	MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error
+
+	ChannelVoiceJoin(gID, cID string, mute, deaf bool) (*discordgo.VoiceConnection, error)
+	VoiceConnection(gID string) *discordgo.VoiceConnection
+	VoiceDisconnect(gID string) error
+}
+
+type discordSession struct {
+	*discordgo.Session
+}
+
+// WrapSession adapts a live discordgo session to the Session interface.
+func WrapSession(s *discordgo.Session) Session {
+	return discordSession{s}
+}
+
+func (s discordSession) GetState() *discordgo.State {
+	return s.State
+}
+
+func (s discordSession) HTTPClient() *http.Client {
+	return s.Client
+}
+
+func (s discordSession) VoiceConnection(gID string) *discordgo.VoiceConnection {
+	s.RLock()
+	defer s.RUnlock()
+	return s.VoiceConnections[gID]
+}
+
+func (s discordSession) VoiceDisconnect(gID string) error {
+	vc := s.VoiceConnection(gID)
+	if vc == nil {
+		return nil
+	}
+	return vc.Disconnect()
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"sync"
+	"time"
+)
+
+var workLock sync.Mutex
+var work sync.WaitGroup
+var draining bool
+var shuttingDown = make(chan struct{})
+
+// Track marks the start of work that shutdown should wait for, like a running command.
+// Once shutdown has begun it returns false, and the work should not be started. Otherwise done must be called when it finishes.
+func Track() (done func(), ok bool) {
+	workLock.Lock()
+	defer workLock.Unlock()
+	if draining {
+		return nil, false
+	}
+	work.Add(1)
+	return sync.OnceFunc(work.Done), true
+}
+
+// ShuttingDown is closed when shutdown begins. Long running work can watch it to stop early.
+func ShuttingDown() <-chan struct{} {
+	return shuttingDown
+}
+
+// Drain stops new work from being tracked and waits for the tracked work to finish.
+// It returns false if the work is still running after timeout, or if abort is closed first.
+func Drain(timeout time.Duration, abort <-chan struct{}) bool {
+	workLock.Lock()
+	if !draining {
+		draining = true
+		close(shuttingDown)
+	}
+	workLock.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		work.Wait()
+		close(finished)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-finished:
+		return true
+	case <-t.C:
+	case <-abort:
+	}
+	return false
+}
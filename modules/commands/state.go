@@ -0,0 +1,158 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"reflect"
+)
+
+// ErrStateExpired is returned when a component's state was made by an older version of the bot, with a different key, or not by the bot at all.
+var ErrStateExpired = errors.New("component state expired")
+
+const stateMacLen = 8
+
+var stateKey []byte
+
+func init() {
+	// Until SetStateKey is called, buttons only survive as long as the process does
+	stateKey = make([]byte, 32)
+	rand.Read(stateKey)
+}
+
+// SetStateKey sets the secret used to sign component state. It should stay the same across restarts.
+func SetStateKey(key []byte) {
+	stateKey = key
+}
+
+// StateCodec stores a T in a component custom ID and checks that it comes back unmodified.
+// T must be a struct whose fields are all exported ints, uints, bools or strings.
+// Buttons on the same message need different values, since Discord requires unique custom IDs.
+type StateCodec[T any] struct {
+	kind    string
+	version byte
+}
+
+// NewStateCodec makes a codec for a kind of state. Bump the version whenever T changes so old buttons are rejected instead of misread.
+func NewStateCodec[T any](kind string, version byte) StateCodec[T] {
+	if reflect.TypeFor[T]().Kind() != reflect.Struct {
+		panic("component state must be a struct")
+	}
+	return StateCodec[T]{kind, version}
+}
+
+// mac signs b for the command at path, so that state made for one command can't be replayed against another.
+func (c StateCodec[T]) mac(path string, b []byte) []byte {
+	h := hmac.New(sha256.New, stateKey)
+	h.Write([]byte(c.kind))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)[:stateMacLen]
+}
+
+// Encode returns a custom ID for v, to be passed to SetComponents on ctx.
+// SetComponents refuses it if it doesn't fit in a custom ID along with the command name.
+func (c StateCodec[T]) Encode(ctx *Context, v T) string {
+	b := appendStateFields([]byte{c.version}, reflect.ValueOf(v))
+	b = append(b, c.mac(ctx.path, b)...)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decode reads the state from the component that was used.
+func (c StateCodec[T]) Decode(ctx *Context) (T, error) {
+	var out T
+	raw, err := base64.RawURLEncoding.DecodeString(ctx.MessageComponentData().CustomID)
+	if err != nil || len(raw) <= stateMacLen {
+		return out, ErrStateExpired
+	}
+	body, sum := raw[:len(raw)-stateMacLen], raw[len(raw)-stateMacLen:]
+	if !hmac.Equal(sum, c.mac(ctx.path, body)) || body[0] != c.version {
+		return out, ErrStateExpired
+	}
+	if !readStateFields(body[1:], reflect.ValueOf(&out).Elem()) {
+		return out, ErrStateExpired
+	}
+	return out, nil
+}
+
+func appendStateFields(b []byte, v reflect.Value) []byte {
+	for i := range v.NumField() {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			b = binary.AppendVarint(b, f.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			b = binary.AppendUvarint(b, f.Uint())
+		case reflect.Bool:
+			if f.Bool() {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case reflect.String:
+			b = binary.AppendUvarint(b, uint64(f.Len()))
+			b = append(b, f.String()...)
+		default:
+			panic("unsupported field type in component state: " + f.Type().String())
+		}
+	}
+	return b
+}
+
+func readStateFields(b []byte, v reflect.Value) bool {
+	for i := range v.NumField() {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			x, n := binary.Varint(b)
+			if n <= 0 {
+				return false
+			}
+			f.SetInt(x)
+			b = b[n:]
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			x, n := binary.Uvarint(b)
+			if n <= 0 {
+				return false
+			}
+			f.SetUint(x)
+			b = b[n:]
+		case reflect.Bool:
+			if len(b) == 0 {
+				return false
+			}
+			f.SetBool(b[0] != 0)
+			b = b[1:]
+		case reflect.String:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return false
+			}
+			f.SetString(string(b[n : n+int(l)]))
+			b = b[n+int(l):]
+		}
+	}
+	return len(b) == 0
+}
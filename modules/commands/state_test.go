@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type testState struct {
+	Index int
+	Page  uint16
+	Flag  bool
+	Name  string
+}
+
+// componentCtx makes the context a component handler for path would get for customID.
+func componentCtx(path, customID string) *Context {
+	return &Context{
+		Interaction: &discordgo.Interaction{
+			Type: discordgo.InteractionMessageComponent,
+			Data: discordgo.MessageComponentInteractionData{CustomID: customID},
+		},
+		path:     path,
+		origName: path,
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	codec := NewStateCodec[testState]("test", 1)
+	for _, v := range []testState{
+		{},
+		{Index: -5, Page: 3, Flag: true, Name: "abc"},
+		{Index: 1 << 40, Page: 65535, Name: "ü\a"},
+	} {
+		id := codec.Encode(componentCtx("quote", ""), v)
+		got, err := codec.Decode(componentCtx("quote", id))
+		if err != nil {
+			t.Errorf("%+v: %v", v, err)
+		} else if got != v {
+			t.Errorf("%+v came back as %+v", v, got)
+		}
+	}
+}
+
+func TestStateRejected(t *testing.T) {
+	codec := NewStateCodec[testState]("test", 1)
+	id := codec.Encode(componentCtx("quote", ""), testState{Index: 2, Name: "x"})
+	flip := func(i int) string {
+		raw, _ := base64.RawURLEncoding.DecodeString(id)
+		raw[(i+len(raw))%len(raw)] ^= 1
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	tests := []struct {
+		name  string
+		codec StateCodec[testState]
+		path  string
+		id    string
+	}{
+		{"version mismatch", NewStateCodec[testState]("test", 2), "quote", id},
+		{"other kind", NewStateCodec[testState]("other", 1), "quote", id},
+		{"other command", codec, "remind", id},
+		{"truncated MAC", codec, "quote", id[:len(id)-1]},
+		{"modified MAC", codec, "quote", flip(-1)},
+		{"modified version", codec, "quote", flip(0)},
+		{"modified body", codec, "quote", flip(1)},
+		{"too short", codec, "quote", id[:4]},
+		{"not base64", codec, "quote", "quote!"},
+		{"empty", codec, "quote", ""},
+	}
+	for _, tt := range tests {
+		_, err := tt.codec.Decode(componentCtx(tt.path, tt.id))
+		if !errors.Is(err, ErrStateExpired) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestStateLength(t *testing.T) {
+	codec := NewStateCodec[testState]("test", 1)
+	ctx := componentCtx("quote", "")
+	prefix := ctx.path + "\a"
+	fits := func(name string) bool {
+		_, err := prefixComponent(prefix, discordgo.Button{CustomID: codec.Encode(ctx, testState{Name: name})})
+		return err == nil
+	}
+	// 94 characters are left after "quote\a", which base64 can fill with 70 bytes.
+	// The version byte, the three short fields, the string's length and the MAC leave 57 of those for the string.
+	if !fits(strings.Repeat("a", 57)) {
+		t.Error("state that fits in a custom ID was refused")
+	}
+	if fits(strings.Repeat("a", 58)) {
+		t.Error("state longer than a custom ID was accepted")
+	}
+}
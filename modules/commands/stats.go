@@ -0,0 +1,431 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
+	"jlortiz.org/jlort2/modules/log"
+	"jlortiz.org/jlort2/modules/metrics"
+)
+
+// How a command invocation ended, for RecordInvocation.
+const (
+	OutcomeOK      = "ok"
+	OutcomeError   = "error"
+	OutcomePanic   = "panic"
+	OutcomeRefused = "refused"
+)
+
+// Raw invocations older than this are rolled up into one row per command per day.
+const statsRetention = 30 * 24 * time.Hour
+
+var stmtStatsIns *sql.Stmt
+var statsLock sync.Mutex
+var statsStopper chan struct{}
+
+type statsModule struct{}
+
+func init() {
+	RegisterModule(statsModule{})
+}
+
+func (statsModule) Name() string {
+	return "stats"
+}
+
+func (statsModule) Deps() []string {
+	return []string{"commands"}
+}
+
+func (statsModule) Init(self Session) error {
+	err := createTables(`CREATE TABLE IF NOT EXISTS cmdStats (
+		ts INTEGER,
+		name VARCHAR(100),
+		gid INTEGER,
+		uhash INTEGER,
+		latency INTEGER,
+		outcome VARCHAR(8),
+		class VARCHAR(64)
+	);
+	CREATE INDEX IF NOT EXISTS cmdStatsTs ON cmdStats (ts);
+	CREATE TABLE IF NOT EXISTS cmdStatsDaily (
+		day INTEGER,
+		name VARCHAR(100),
+		uses INTEGER,
+		errors INTEGER,
+		p50 INTEGER,
+		p95 INTEGER,
+		PRIMARY KEY (day, name)
+	);`)
+	if err != nil {
+		return err
+	}
+	stmt, err := db.Prepare("INSERT INTO cmdStats (ts, name, gid, uhash, latency, outcome, class) VALUES (?001, ?002, ?003, ?004, ?005, ?006, ?007);")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	statsLock.Lock()
+	stmtStatsIns = stmt
+	statsLock.Unlock()
+	PrepareCommand("stats", "See how commands are being used").Use(OwnerOnly).Register(stats, []*discordgo.ApplicationCommandOption{
+		NewCommandOption("window", "How far back to look, default day").AsString().Choice([]*discordgo.ApplicationCommandOptionChoice{
+			{Name: "Last hour", Value: "hour"},
+			{Name: "Last day", Value: "day"},
+			{Name: "Last week", Value: "week"},
+			{Name: "Last month", Value: "month"},
+			{Name: "All time", Value: "all"},
+		}).Finalize(),
+	})
+	statsStopper = make(chan struct{})
+	go statsRoller(statsStopper)
+	return nil
+}
+
+func (statsModule) Cleanup(_ Session) {
+	close(statsStopper)
+	statsLock.Lock()
+	stmtStatsIns.Close()
+	stmtStatsIns = nil
+	statsLock.Unlock()
+}
+
+func (statsModule) Health() error {
+	return nil
+}
+
+var metricCommands = metrics.NewCounter("jlort_commands_total", "Commands run, by outcome.", "command", "outcome")
+var metricCommandTime = metrics.NewHistogram("jlort_command_duration_seconds", "How long commands took to run.", metrics.DurationBuckets, "command")
+
+// RecordInvocation stores one use of a command for /stats and the metrics.
+// class says what kind of error or refusal happened, see ErrorClass.
+func RecordInvocation(ctx *Context, latency time.Duration, outcome, class string) {
+	metricCommands.Inc(ctx.Path(), outcome)
+	metricCommandTime.ObserveDuration(latency, ctx.Path())
+	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
+	var uhash int64
+	if ctx.User != nil {
+		uhash = userHash(ctx.User.ID)
+	}
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	if stmtStatsIns == nil {
+		return
+	}
+	_, err := stmtStatsIns.Exec(clock.Now().UnixMilli(), ctx.Path(), gid, uhash, latency.Microseconds(), outcome, class)
+	if err != nil {
+		log.Error(fmt.Errorf("failed to record command use: %w", err))
+	}
+}
+
+// userHash lets /stats count distinct users without storing who they are.
+func userHash(uid string) int64 {
+	h := hmac.New(sha256.New, stateKey)
+	h.Write([]byte("user\x00"))
+	h.Write([]byte(uid))
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)))
+}
+
+// ErrorClass gives a short name for the kind of error, like "*discordgo.RESTError".
+func ErrorClass(err error) string {
+	var optErr *OptionError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrStateExpired):
+		return "expired"
+	case errors.As(err, &optErr):
+		return "option"
+	}
+	for {
+		inner := errors.Unwrap(err)
+		if inner == nil {
+			break
+		}
+		err = inner
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+// rollupStats folds old invocations into cmdStatsDaily so the raw table stays small.
+func rollupStats() error {
+	cutoff := clock.Now().Add(-statsRetention).Truncate(24 * time.Hour)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT ts / 86400000, name, latency, outcome FROM cmdStats WHERE ts < ?001 ORDER BY 1, 2, 3;", cutoff.UnixMilli())
+	if err != nil {
+		return err
+	}
+	type dayKey struct {
+		day  int64
+		name string
+	}
+	groups := make(map[dayKey]*statGroup)
+	var keys []dayKey
+	for rows.Next() {
+		var k dayKey
+		var latency int64
+		var outcome string
+		err = rows.Scan(&k.day, &k.name, &latency, &outcome)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		g := groups[k]
+		if g == nil {
+			g = new(statGroup)
+			groups[k] = g
+			keys = append(keys, k)
+		}
+		g.add(latency, outcome)
+	}
+	rows.Close()
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, k := range keys {
+		g := groups[k]
+		_, err = tx.Exec(`INSERT INTO cmdStatsDaily (day, name, uses, errors, p50, p95) VALUES (?001, ?002, ?003, ?004, ?005, ?006)
+			ON CONFLICT (day, name) DO UPDATE SET uses = uses + ?003, errors = errors + ?004,
+			p50 = (p50 * uses + ?005 * ?003) / (uses + ?003), p95 = (p95 * uses + ?006 * ?003) / (uses + ?003);`,
+			k.day, k.name, g.uses, g.errors, g.percentile(50), g.percentile(95))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DELETE FROM cmdStats WHERE ts < ?001;", cutoff.UnixMilli())
+	if err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("Rolled up %d days of command stats", len(keys)))
+	return tx.Commit()
+}
+
+func statsRoller(stopper <-chan struct{}) {
+	t := time.NewTicker(12 * time.Hour)
+	defer t.Stop()
+	for {
+		if done, ok := Track(); ok {
+			err := rollupStats()
+			done()
+			if err != nil {
+				log.Error(fmt.Errorf("failed to roll up command stats: %w", err))
+			}
+		}
+		select {
+		case <-t.C:
+		case <-stopper:
+			return
+		}
+	}
+}
+
+type statGroup struct {
+	name      string
+	uses      int
+	errors    int
+	latencies []int64
+	// Only set for rolled up days, where the exact latencies are gone
+	p50sum, p95sum int64
+}
+
+func (g *statGroup) add(latency int64, outcome string) {
+	g.uses++
+	if outcome == OutcomeError || outcome == OutcomePanic {
+		g.errors++
+	}
+	g.latencies = append(g.latencies, latency)
+}
+
+// percentile expects the latencies to be sorted.
+func (g *statGroup) percentile(p int) int64 {
+	if len(g.latencies) == 0 {
+		if g.uses == 0 {
+			return 0
+		}
+		// Weighted average of the daily values, which is only an estimate
+		if p == 50 {
+			return g.p50sum / int64(g.uses)
+		}
+		return g.p95sum / int64(g.uses)
+	}
+	return g.latencies[(len(g.latencies)-1)*p/100]
+}
+
+func formatLatency(us int64) string {
+	if us < 10000 {
+		return strconv.FormatFloat(float64(us)/1000, 'f', 1, 64) + "ms"
+	}
+	return strconv.FormatInt(us/1000, 10) + "ms"
+}
+
+var statsWindows = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": statsRetention,
+}
+
+// loadStats groups the command uses in a window from statsWindows, or all time for any other name.
+// It also returns how many distinct users there were, which is only known for the raw rows.
+func loadStats(d *sql.DB, windowName string) (map[string]*statGroup, int, error) {
+	groups := make(map[string]*statGroup)
+	users := make(map[int64]struct{})
+	var rows *sql.Rows
+	var err error
+	if window, ok := statsWindows[windowName]; ok {
+		rows, err = d.Query("SELECT name, latency, outcome, uhash FROM cmdStats WHERE ts >= ?001 ORDER BY latency;", clock.Now().Add(-window).UnixMilli())
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to query stats: %w", err)
+		}
+		for rows.Next() {
+			var name, outcome string
+			var latency, uhash int64
+			err = rows.Scan(&name, &latency, &outcome, &uhash)
+			if err != nil {
+				rows.Close()
+				return nil, 0, fmt.Errorf("failed to read stats: %w", err)
+			}
+			g := groups[name]
+			if g == nil {
+				g = &statGroup{name: name}
+				groups[name] = g
+			}
+			g.add(latency, outcome)
+			users[uhash] = struct{}{}
+		}
+		rows.Close()
+	} else {
+		// All time has to combine the rolled up days with the raw rows
+		rows, err = d.Query(`SELECT name, SUM(uses), SUM(errors), SUM(p50 * uses), SUM(p95 * uses) FROM cmdStatsDaily GROUP BY name
+			UNION ALL
+			SELECT name, COUNT(*), SUM(outcome IN ('error', 'panic')), 0, 0 FROM cmdStats GROUP BY name;`)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to query stats: %w", err)
+		}
+		for rows.Next() {
+			var name string
+			var uses, errCount int
+			var p50, p95 int64
+			err = rows.Scan(&name, &uses, &errCount, &p50, &p95)
+			if err != nil {
+				rows.Close()
+				return nil, 0, fmt.Errorf("failed to read stats: %w", err)
+			}
+			g := groups[name]
+			if g == nil {
+				g = &statGroup{name: name}
+				groups[name] = g
+			}
+			g.uses += uses
+			g.errors += errCount
+			g.p50sum += p50
+			g.p95sum += p95
+		}
+		rows.Close()
+		// Raw rows join the estimate with their own percentiles, weighted by how many there are
+		rows, err = d.Query("SELECT name, latency FROM cmdStats ORDER BY name, latency;")
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to query stats: %w", err)
+		}
+		raw := make(map[string][]int64)
+		for rows.Next() {
+			var name string
+			var latency int64
+			err = rows.Scan(&name, &latency)
+			if err != nil {
+				rows.Close()
+				return nil, 0, fmt.Errorf("failed to read stats: %w", err)
+			}
+			raw[name] = append(raw[name], latency)
+		}
+		rows.Close()
+		for name, ls := range raw {
+			tmp := statGroup{latencies: ls}
+			groups[name].p50sum += tmp.percentile(50) * int64(len(ls))
+			groups[name].p95sum += tmp.percentile(95) * int64(len(ls))
+		}
+	}
+	return groups, len(users), nil
+}
+
+// ~!stats [window]
+// @OwnerOnly
+// Shows which commands get used, how often they fail and how slow they are
+// The window can be the last hour, day, week, month, or all time. All time latencies are estimates.
+func stats(ctx *Context) error {
+	args := struct {
+		Window string `option:"window"`
+	}{Window: "day"}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	groups, users, err := loadStats(ctx.Database, args.Window)
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return ctx.RespondPrivate(ctx.T("commands.noStats"))
+	}
+	ls := make([]*statGroup, 0, len(groups))
+	total, totalErr := 0, 0
+	for _, g := range groups {
+		ls = append(ls, g)
+		total += g.uses
+		totalErr += g.errors
+	}
+	slices.SortFunc(ls, func(a, b *statGroup) int {
+		if a.uses != b.uses {
+			return b.uses - a.uses
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	if len(ls) > 20 {
+		ls = ls[:20]
+	}
+	output := new(strings.Builder)
+	for _, g := range ls {
+		fmt.Fprintf(output, "`%s` %d uses, %.1f%% errors, p50 %s, p95 %s\n", g.name, g.uses, float64(g.errors)*100/float64(g.uses), formatLatency(g.percentile(50)), formatLatency(g.percentile(95)))
+	}
+	embed := new(discordgo.MessageEmbed)
+	embed.Title = "Command stats: " + args.Window
+	embed.Description = output.String()
+	embed.Color = 0x7289da
+	footer := fmt.Sprintf("%d uses, %.1f%% errors", total, float64(totalErr)*100/float64(total))
+	if users != 0 {
+		footer += fmt.Sprintf(", %d users", users)
+	}
+	embed.Footer = &discordgo.MessageEmbedFooter{Text: footer}
+	return ctx.RespondEmbed(embed, true)
+}
@@ -0,0 +1,176 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"testing"
+	"time"
+
+	"jlortiz.org/jlort2/modules/clock"
+)
+
+var statsNow = time.Date(2023, 11, 14, 12, 0, 0, 0, time.UTC)
+
+// useStats empties the stats tables and fixes the time at statsNow.
+func useStats(t *testing.T) {
+	t.Helper()
+	_, err := db.Exec("DELETE FROM cmdStats; DELETE FROM cmdStatsDaily;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Use(clock.NewVirtual(statsNow))
+	t.Cleanup(func() { clock.Use(clock.Real) })
+}
+
+// insertUses adds one raw row per latency, the first errors of them failed.
+func insertUses(t *testing.T, ts time.Time, name string, errors int, latencies ...int64) {
+	t.Helper()
+	for i, latency := range latencies {
+		outcome := OutcomeOK
+		if i < errors {
+			outcome = OutcomeError
+		}
+		_, err := db.Exec("INSERT INTO cmdStats (ts, name, gid, uhash, latency, outcome, class) VALUES (?001, ?002, 0, ?003, ?004, ?005, '');",
+			ts.UnixMilli(), name, i, latency, outcome)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type dailyRow struct {
+	uses, errors int
+	p50, p95     int64
+}
+
+func readDaily(t *testing.T, day time.Time, name string) dailyRow {
+	t.Helper()
+	var r dailyRow
+	err := db.QueryRow("SELECT uses, errors, p50, p95 FROM cmdStatsDaily WHERE day = ?001 AND name = ?002;", day.UnixMilli()/86400000, name).
+		Scan(&r.uses, &r.errors, &r.p50, &r.p95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRollupStats(t *testing.T) {
+	useStats(t)
+	old := statsNow.Add(-40 * 24 * time.Hour)
+	recent := statsNow.Add(-time.Hour)
+	// Out of order on purpose, the rollup has to sort them
+	insertUses(t, old, "ping", 2, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1)
+	insertUses(t, old.Add(24*time.Hour), "ping", 0, 50)
+	insertUses(t, recent, "ping", 0, 1000)
+
+	err := rollupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readDaily(t, old, "ping")
+	want := dailyRow{uses: 10, errors: 2, p50: 5, p95: 9}
+	if got != want {
+		t.Errorf("old day = %+v, want %+v", got, want)
+	}
+	got = readDaily(t, old.Add(24*time.Hour), "ping")
+	want = dailyRow{uses: 1, p50: 50, p95: 50}
+	if got != want {
+		t.Errorf("next day = %+v, want %+v", got, want)
+	}
+	var left int
+	err = db.QueryRow("SELECT COUNT(*) FROM cmdStats;").Scan(&left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 1 {
+		t.Errorf("%d raw rows left, want only the recent one", left)
+	}
+
+	// Rows that arrive late for a day already rolled up are merged, weighted by uses
+	insertUses(t, old, "ping", 1, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100)
+	err = rollupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = readDaily(t, old, "ping")
+	want = dailyRow{uses: 20, errors: 3, p50: (5*10 + 100*10) / 20, p95: (9*10 + 100*10) / 20}
+	if got != want {
+		t.Errorf("merged day = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadStatsWindow(t *testing.T) {
+	useStats(t)
+	insertUses(t, statsNow.Add(-2*time.Hour), "ping", 0, 500)
+	insertUses(t, statsNow.Add(-time.Minute), "ping", 1, 40, 30, 20, 10)
+	insertUses(t, statsNow.Add(-time.Minute), "quote", 0, 7)
+
+	groups, users, err := loadStats(db, "hour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d commands, want 2", len(groups))
+	}
+	g := groups["ping"]
+	if g.uses != 4 || g.errors != 1 {
+		t.Errorf("ping has %d uses and %d errors, want 4 and 1", g.uses, g.errors)
+	}
+	if p50, p95 := g.percentile(50), g.percentile(95); p50 != 20 || p95 != 30 {
+		t.Errorf("ping p50 = %d, p95 = %d, want 20 and 30", p50, p95)
+	}
+	// insertUses numbers users from 0 in each call
+	if users != 4 {
+		t.Errorf("got %d users, want 4", users)
+	}
+}
+
+func TestLoadStatsAllTime(t *testing.T) {
+	useStats(t)
+	old := statsNow.Add(-40 * 24 * time.Hour)
+	insertUses(t, old, "ping", 1, 10, 20, 30)
+	insertUses(t, old.Add(24*time.Hour), "ping", 0, 100)
+	err := rollupStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertUses(t, statsNow.Add(-time.Minute), "ping", 0, 1, 2, 3, 4)
+
+	groups, users, err := loadStats(db, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := groups["ping"]
+	if g == nil {
+		t.Fatal("ping is missing")
+	}
+	if g.uses != 8 || g.errors != 1 {
+		t.Errorf("ping has %d uses and %d errors, want 8 and 1", g.uses, g.errors)
+	}
+	// Daily p50s are 20 and 100 and the raw p50 is 2, so (20*3 + 100*1 + 2*4) / 8
+	if p50 := g.percentile(50); p50 != 21 {
+		t.Errorf("p50 = %d, want 21", p50)
+	}
+	// Daily p95s are 20 and 100 and the raw p95 is 3, so (20*3 + 100*1 + 3*4) / 8
+	if p95 := g.percentile(95); p95 != 21 {
+		t.Errorf("p95 = %d, want 21", p95)
+	}
+	if users != 0 {
+		t.Errorf("got %d users, all time doesn't know them", users)
+	}
+}
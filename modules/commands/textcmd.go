@@ -0,0 +1,517 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// DefaultPrefix starts text commands in DMs, and in servers that turn them on without picking a prefix.
+const DefaultPrefix = "~!"
+
+// Prefixes of servers that turned text commands on
+var prefixes map[string]string
+var prefixLock sync.RWMutex
+
+type textModule struct{}
+
+func init() {
+	RegisterModule(textModule{})
+}
+
+func (textModule) Name() string {
+	return "text"
+}
+
+func (textModule) Deps() []string {
+	return []string{"commands"}
+}
+
+func (textModule) Init(self Session) error {
+	err := createTables(`CREATE TABLE IF NOT EXISTS guildPrefix (
+		gid UNSIGNED BIGINT PRIMARY KEY,
+		prefix VARCHAR(10) NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT gid, prefix FROM guildPrefix;")
+	if err != nil {
+		return fmt.Errorf("failed to load prefixes: %w", err)
+	}
+	loaded := make(map[string]string)
+	for rows.Next() {
+		var gid uint64
+		var prefix string
+		rows.Scan(&gid, &prefix)
+		loaded[strconv.FormatUint(gid, 10)] = prefix
+	}
+	rows.Close()
+	prefixLock.Lock()
+	prefixes = loaded
+	prefixLock.Unlock()
+	self.AddHandler(onGuildDeletePrefix)
+	PrepareCommand("prefix", "Turn text commands on or off for this server").Guild().Perms(discordgo.PermissionManageGuild).Register(setPrefix, []*discordgo.ApplicationCommandOption{
+		NewCommandOption("enable", "Should text commands work here?").AsBool().Required().Finalize(),
+		NewCommandOption("prefix", "What text commands start with, default "+DefaultPrefix).AsString().SetLength(1, 10).Finalize(),
+	})
+	return nil
+}
+
+func (textModule) Cleanup(_ Session) {
+	prefixLock.Lock()
+	prefixes = nil
+	prefixLock.Unlock()
+}
+
+func (textModule) Health() error {
+	return nil
+}
+
+// ~!prefix <enable> [prefix]
+// @GuildOnly
+// @ManageServer
+// Turns text commands like ~!quote on or off for this server
+func setPrefix(ctx *Context) error {
+	args := struct {
+		Enable bool   `option:"enable,required"`
+		Prefix string `option:"prefix,min=1,max=10"`
+	}{Prefix: DefaultPrefix}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsFunc(args.Prefix, unicode.IsSpace) {
+		return &OptionError{"prefix", "can't contain spaces"}
+	}
+	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
+	prefixLock.Lock()
+	defer prefixLock.Unlock()
+	if !args.Enable {
+		_, err = ctx.Database.Exec("DELETE FROM guildPrefix WHERE gid = ?001;", gid)
+		if err != nil {
+			return fmt.Errorf("failed to save prefix: %w", err)
+		}
+		delete(prefixes, ctx.GuildID)
+		return ctx.RespondPrivate(ctx.T("commands.prefixOff"))
+	}
+	_, err = ctx.Database.Exec("INSERT INTO guildPrefix (gid, prefix) VALUES (?001, ?002) ON CONFLICT (gid) DO UPDATE SET prefix = ?002;", gid, args.Prefix)
+	if err != nil {
+		return fmt.Errorf("failed to save prefix: %w", err)
+	}
+	prefixes[ctx.GuildID] = args.Prefix
+	return ctx.RespondPrivate(ctx.T("commands.prefixOn", args.Prefix))
+}
+
+func onGuildDeletePrefix(_ *discordgo.Session, event *discordgo.GuildDelete) {
+	if !event.Unavailable {
+		gid, _ := strconv.ParseUint(event.ID, 10, 64)
+		db.Exec("DELETE FROM guildPrefix WHERE gid=?001;", gid)
+		prefixLock.Lock()
+		delete(prefixes, event.ID)
+		prefixLock.Unlock()
+	}
+}
+
+// Alias lets a text command be called by other names too. It only works on top-level slash commands.
+func (c commandStruct) Alias(names ...string) commandStruct {
+	c.aliases = append(slices.Clip(c.aliases), names...)
+	return c
+}
+
+// textPrefix returns the prefix for text commands in a channel, or "" if they are off.
+func textPrefix(guildID string) string {
+	prefixLock.RLock()
+	defer prefixLock.RUnlock()
+	if prefixes == nil {
+		return ""
+	}
+	if guildID == "" {
+		return DefaultPrefix
+	}
+	return prefixes[guildID]
+}
+
+type textToken struct {
+	val string
+	// The raw text from the start of this token to the end of the message
+	rest string
+}
+
+// tokenize splits on whitespace, keeping text in double quotes together.
+func tokenize(s string) []textToken {
+	var out []textToken
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return out
+		}
+		t := textToken{rest: s}
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end != -1 {
+				t.val = s[1 : end+1]
+				s = s[end+2:]
+				out = append(out, t)
+				continue
+			}
+		}
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end == -1 {
+			end = len(s)
+		}
+		t.val = s[:end]
+		s = s[end:]
+		out = append(out, t)
+	}
+}
+
+// ParseTextCommand turns a message starting with the prefix into a command and a Context that replies to the message.
+// Arguments are matched to the command's options in order, or by name as name=value. A string option at the end takes the rest of the message.
+// It returns a nil Context if the message isn't a text command. If the arguments don't fit, it returns an *OptionError along with the Context to report it on.
+func ParseTextCommand(self Session, m *discordgo.Message) (*Context, Command, error) {
+	if m.Author == nil || m.Author.Bot {
+		return nil, nil, nil
+	}
+	prefix := textPrefix(m.GuildID)
+	if prefix == "" || !strings.HasPrefix(m.Content, prefix) {
+		return nil, nil, nil
+	}
+	tokens := tokenize(m.Content[len(prefix):])
+	if len(tokens) == 0 {
+		return nil, nil, nil
+	}
+	cmdLock.RLock()
+	var app *discordgo.ApplicationCommand
+	name := strings.ToLower(tokens[0].val)
+	for _, x := range batchCmdList {
+		if x.Type == discordgo.ChatApplicationCommand && (x.Name == name || slices.Contains(x.aliases, name)) {
+			app = x.ApplicationCommand
+			break
+		}
+	}
+	cmdLock.RUnlock()
+	if app == nil {
+		return nil, nil, nil
+	}
+	tokens = tokens[1:]
+
+	i := textInteraction(self.GetState(), m)
+	data := discordgo.ApplicationCommandInteractionData{ID: app.ID, Name: app.Name, CommandType: app.Type}
+	data.Resolved = &discordgo.ApplicationCommandInteractionDataResolved{
+		Users:    make(map[string]*discordgo.User),
+		Members:  make(map[string]*discordgo.Member),
+		Roles:    make(map[string]*discordgo.Role),
+		Channels: make(map[string]*discordgo.Channel),
+	}
+	// Walk down to the subcommand
+	schema := app.Options
+	leaf := &data.Options
+	path := app.Name
+	var err error
+	for len(schema) != 0 && (schema[0].Type == discordgo.ApplicationCommandOptionSubCommand || schema[0].Type == discordgo.ApplicationCommandOptionSubCommandGroup) {
+		names := make([]string, len(schema))
+		for j, x := range schema {
+			names[j] = x.Name
+		}
+		var sub *discordgo.ApplicationCommandOption
+		if len(tokens) != 0 {
+			for _, x := range schema {
+				if x.Name == strings.ToLower(tokens[0].val) {
+					sub = x
+					break
+				}
+			}
+		}
+		if sub == nil {
+			err = &OptionError{path, "expected one of " + strings.Join(names, ", ")}
+			break
+		}
+		tokens = tokens[1:]
+		path += " " + sub.Name
+		opt := &discordgo.ApplicationCommandInteractionDataOption{Name: sub.Name, Type: sub.Type}
+		*leaf = append(*leaf, opt)
+		leaf = &opt.Options
+		schema = sub.Options
+	}
+	if err == nil {
+		*leaf, err = textOptions(self.GetState(), m, schema, tokens, data.Resolved)
+	}
+	i.Data = data
+	ctx := MakeContext(self, i)
+	ctx.message = m
+	if err != nil {
+		return ctx, nil, err
+	}
+	cmd := GetCommand(path)
+	if cmd == nil {
+		return nil, nil, nil
+	}
+	// Discord only enforces these for slash commands
+	if app.DefaultMemberPermissions != nil && *app.DefaultMemberPermissions != 0 {
+		cmd = RequirePerms(*app.DefaultMemberPermissions)(cmd)
+	}
+	return ctx, cmd, nil
+}
+
+// textInteraction makes an interaction for a message, with the permissions and locale that Discord would have sent.
+func textInteraction(state *discordgo.State, m *discordgo.Message) *discordgo.Interaction {
+	i := new(discordgo.Interaction)
+	i.ID = m.ID
+	i.Type = discordgo.InteractionApplicationCommand
+	i.ChannelID = m.ChannelID
+	i.GuildID = m.GuildID
+	if m.GuildID == "" {
+		i.User = m.Author
+		return i
+	}
+	mem, err := state.Member(m.GuildID, m.Author.ID)
+	if err == nil {
+		copied := *mem
+		i.Member = &copied
+	} else if m.Member != nil {
+		copied := *m.Member
+		i.Member = &copied
+	} else {
+		i.Member = new(discordgo.Member)
+	}
+	i.Member.User = m.Author
+	i.Member.GuildID = m.GuildID
+	i.Member.Permissions, err = state.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Could not get permissions for text command: %v", err))
+	}
+	i.AppPermissions, _ = state.UserChannelPermissions(state.User.ID, m.ChannelID)
+	g, err := state.Guild(m.GuildID)
+	if err == nil && g.PreferredLocale != "" {
+		locale := discordgo.Locale(g.PreferredLocale)
+		i.GuildLocale = &locale
+	}
+	return i
+}
+
+// textOptions fills in options from the arguments of a text command.
+func textOptions(state *discordgo.State, m *discordgo.Message, schema []*discordgo.ApplicationCommandOption, tokens []textToken, resolved *discordgo.ApplicationCommandInteractionDataResolved) ([]*discordgo.ApplicationCommandInteractionDataOption, error) {
+	named := make(map[string]string)
+	var positional []textToken
+	// Whether the positional arguments are all at the end, so the last option can take the raw text
+	trailing := true
+	for _, t := range tokens {
+		k, v, ok := strings.Cut(t.val, "=")
+		if ok && optionByName(schema, k) != nil {
+			named[k] = v
+			trailing = len(positional) == 0
+			continue
+		}
+		positional = append(positional, t)
+	}
+	out := make([]*discordgo.ApplicationCommandInteractionDataOption, 0, len(schema))
+	for j, o := range schema {
+		raw, ok := named[o.Name]
+		if !ok && len(positional) != 0 {
+			raw = positional[0].val
+			last := true
+			for _, o2 := range schema[j+1:] {
+				if _, ok := named[o2.Name]; !ok {
+					last = false
+				}
+			}
+			if last && trailing && o.Type == discordgo.ApplicationCommandOptionString && len(positional) > 1 {
+				raw = strings.TrimSpace(positional[0].rest)
+				positional = nil
+			} else {
+				positional = positional[1:]
+			}
+			ok = true
+		}
+		if !ok {
+			continue
+		}
+		v, err := textValue(state, m, o, raw, resolved)
+		if err != nil {
+			return out, &OptionError{o.Name, err.Error()}
+		}
+		out = append(out, &discordgo.ApplicationCommandInteractionDataOption{Name: o.Name, Type: o.Type, Value: v})
+	}
+	if len(positional) != 0 {
+		return out, &OptionError{positional[0].val, "too many arguments"}
+	}
+	return out, nil
+}
+
+func optionByName(schema []*discordgo.ApplicationCommandOption, name string) *discordgo.ApplicationCommandOption {
+	for _, o := range schema {
+		if o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// mentionID takes the ID out of a mention like <@123>, <@!123>, <@&123> or <#123>, or returns s if it is already an ID.
+func mentionID(s string, prefixes ...string) string {
+	if strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">") {
+		s = s[1 : len(s)-1]
+		for _, p := range prefixes {
+			if strings.HasPrefix(s, p) {
+				s = s[len(p):]
+				break
+			}
+		}
+	}
+	if _, err := strconv.ParseUint(s, 10, 64); err != nil {
+		return ""
+	}
+	return s
+}
+
+// textValue converts one argument to the value Discord would have sent for the option.
+func textValue(state *discordgo.State, m *discordgo.Message, o *discordgo.ApplicationCommandOption, raw string, resolved *discordgo.ApplicationCommandInteractionDataResolved) (any, error) {
+	if len(o.Choices) != 0 {
+		names := make([]string, len(o.Choices))
+		for j, c := range o.Choices {
+			if strings.EqualFold(c.Name, raw) || strings.EqualFold(fmt.Sprint(c.Value), raw) {
+				raw = fmt.Sprint(c.Value)
+				names = nil
+				break
+			}
+			names[j] = fmt.Sprint(c.Value)
+		}
+		if names != nil {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(names, ", "))
+		}
+	}
+	switch o.Type {
+	case discordgo.ApplicationCommandOptionString:
+		return raw, nil
+	case discordgo.ApplicationCommandOptionInteger:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a whole number")
+		}
+		return float64(n), nil
+	case discordgo.ApplicationCommandOptionNumber:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number")
+		}
+		return n, nil
+	case discordgo.ApplicationCommandOptionBoolean:
+		switch strings.ToLower(raw) {
+		case "true", "yes", "on", "y", "1":
+			return true, nil
+		case "false", "no", "off", "n", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("expected yes or no")
+	case discordgo.ApplicationCommandOptionUser:
+		id := mentionID(raw, "@!", "@")
+		if id == "" || !resolveUser(state, m, id, resolved) {
+			return nil, fmt.Errorf("expected a user")
+		}
+		return id, nil
+	case discordgo.ApplicationCommandOptionMentionable:
+		if id := mentionID(raw, "@&"); id != "" && strings.HasPrefix(raw, "<@&") {
+			if resolveRole(state, m.GuildID, id, resolved) {
+				return id, nil
+			}
+		} else if id := mentionID(raw, "@!", "@"); id != "" && resolveUser(state, m, id, resolved) {
+			return id, nil
+		}
+		return nil, fmt.Errorf("expected a user or role")
+	case discordgo.ApplicationCommandOptionRole:
+		id := mentionID(raw, "@&")
+		if id == "" && m.GuildID != "" {
+			// Roles can be given by name
+			if g, err := state.Guild(m.GuildID); err == nil {
+				for _, r := range g.Roles {
+					if strings.EqualFold(r.Name, raw) {
+						id = r.ID
+						break
+					}
+				}
+			}
+		}
+		if id == "" || !resolveRole(state, m.GuildID, id, resolved) {
+			return nil, fmt.Errorf("expected a role")
+		}
+		return id, nil
+	case discordgo.ApplicationCommandOptionChannel:
+		id := mentionID(raw, "#")
+		if id == "" && m.GuildID != "" {
+			// Channels can be given by name
+			name := strings.TrimPrefix(raw, "#")
+			if g, err := state.Guild(m.GuildID); err == nil {
+				for _, c := range g.Channels {
+					if strings.EqualFold(c.Name, name) {
+						id = c.ID
+						break
+					}
+				}
+			}
+		}
+		c, err := state.Channel(id)
+		if id == "" || err != nil {
+			return nil, fmt.Errorf("expected a channel")
+		}
+		if len(o.ChannelTypes) != 0 && !slices.Contains(o.ChannelTypes, c.Type) {
+			return nil, fmt.Errorf("that kind of channel can't be used here")
+		}
+		resolved.Channels[id] = c
+		return id, nil
+	}
+	return nil, fmt.Errorf("can't be given in a text command")
+}
+
+func resolveUser(state *discordgo.State, m *discordgo.Message, id string, resolved *discordgo.ApplicationCommandInteractionDataResolved) bool {
+	if m.GuildID != "" {
+		if mem, err := state.Member(m.GuildID, id); err == nil {
+			resolved.Users[id] = mem.User
+			resolved.Members[id] = mem
+			return true
+		}
+	}
+	for _, u := range m.Mentions {
+		if u.ID == id {
+			resolved.Users[id] = u
+			return true
+		}
+	}
+	if m.Author.ID == id {
+		resolved.Users[id] = m.Author
+		return true
+	}
+	return false
+}
+
+func resolveRole(state *discordgo.State, guildID, id string, resolved *discordgo.ApplicationCommandInteractionDataResolved) bool {
+	r, err := state.Role(guildID, id)
+	if err != nil {
+		return false
+	}
+	resolved.Roles[id] = r
+	return true
+}
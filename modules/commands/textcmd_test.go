@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/commands/fake"
+)
+
+var bot *fake.Session
+var owner = &discordgo.User{ID: "1", Username: "owner"}
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "commands-test-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "persistent.db")
+	schema, err := os.ReadFile("../../dbGen.sql")
+	if err != nil {
+		panic(err)
+	}
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec(string(schema))
+	db.Close()
+	if err != nil {
+		panic(err)
+	}
+	commands.SetDatabaseFile(dbFile)
+	bot = fake.New(owner)
+	err = commands.StartModules(bot)
+	if err != nil {
+		panic(err)
+	}
+	defer commands.StopModules(bot)
+	return m.Run()
+}
+
+// runText sends a message in a channel and runs the text command in it, if there is one.
+func runText(t *testing.T, guildID, channelID, content string) *discordgo.Message {
+	t.Helper()
+	m := bot.AddMessage(&discordgo.Message{ChannelID: channelID, GuildID: guildID, Author: owner, Content: content})
+	ctx, cmd, err := commands.ParseTextCommand(bot, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx == nil {
+		t.Fatalf("%q is not a text command", content)
+	}
+	err = cmd(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTextPrivateResponse(t *testing.T) {
+	gid, cid := bot.NewID(), bot.NewID()
+	bot.AddGuild(&discordgo.Guild{
+		ID:       gid,
+		Name:     t.Name(),
+		OwnerID:  owner.ID,
+		Channels: []*discordgo.Channel{{ID: cid, Name: "general", Type: discordgo.ChannelTypeGuildText}},
+		Members:  []*discordgo.Member{{User: owner}},
+	})
+	err := bot.Run(bot.Command(owner, gid, cid, "prefix", fake.Option("enable", true), fake.Option("prefix", "!")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := runText(t, gid, cid, "!prefix true ?")
+	if last := bot.LastMessage(cid); last.ID != m.ID {
+		t.Errorf("private response was sent to the server: %q", last.Content)
+	}
+	dm, err := bot.UserChannelCreate(owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := bot.LastMessage(dm.ID)
+	if reply == nil || reply.Content != "Text commands are on. Start them with ?" {
+		t.Fatalf("DM: %+v", reply)
+	}
+	if reply.MessageReference != nil {
+		t.Error("DM refers to a message in the server")
+	}
+
+	// In a DM there is nobody else to hide the response from
+	m = runText(t, "", dm.ID, "~!purge")
+	if reply = bot.LastMessage(dm.ID); reply.MessageReference == nil || reply.MessageReference.MessageID != m.ID {
+		t.Errorf("DM response is not a reply: %+v", reply)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The guildCommands table lists the commands that are disabled in each guild.
+var stmtDisabled *sql.Stmt
+
+// IsDisabled reports whether the invoked command has been turned off in this guild with /commands disable.
+func IsDisabled(ctx *Context) bool {
+	if ctx.GuildID == "" || stmtDisabled == nil {
+		return false
+	}
+	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
+	return stmtDisabled.QueryRow(gid, lookup(ctx.path).top).Scan(new(int)) == nil
+}
+
+// isToggleable must be called with cmdLock held.
+func isToggleable(name string) bool {
+	e, ok := cmdMap[name]
+	return ok && e.top == name && name != "commands" && name != "admin"
+}
+
+// ~!commands enable <command>
+// ~!commands disable <command>
+// @GuildOnly
+// @ManageServer
+// Turns a command on or off for this server
+// Disabled commands still show up in the command list, but I will refuse to run them.
+func toggleCommand(ctx *Context) error {
+	var args struct {
+		Command string `option:"command,required"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	name := args.Command
+	cmdLock.RLock()
+	ok := isToggleable(name)
+	cmdLock.RUnlock()
+	if !ok {
+		return ctx.RespondPrivate(ctx.T("commands.notToggleable", name))
+	}
+	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
+	if ctx.Path() == "commands enable" {
+		_, err = ctx.Database.Exec("DELETE FROM guildCommands WHERE gid=?001 AND name=?002;", gid, name)
+		if err != nil {
+			return fmt.Errorf("failed to enable command: %w", err)
+		}
+		return ctx.RespondPrivate(ctx.T("commands.enabled", name))
+	}
+	_, err = ctx.Database.Exec("INSERT OR IGNORE INTO guildCommands (gid, name) VALUES (?001, ?002);", gid, name)
+	if err != nil {
+		return fmt.Errorf("failed to disable command: %w", err)
+	}
+	return ctx.RespondPrivate(ctx.T("commands.disabledOn", name))
+}
+
+func toggleCommandAuto(ctx *Context) []*discordgo.ApplicationCommandOptionChoice {
+	_, typed := ctx.Focused()
+	prefix := strings.ToLower(typed)
+	cmdLock.RLock()
+	names := make([]string, 0, len(cmdMap))
+	for k := range cmdMap {
+		if isToggleable(k) && strings.HasPrefix(strings.ToLower(k), prefix) {
+			names = append(names, k)
+		}
+	}
+	cmdLock.RUnlock()
+	slices.Sort(names)
+	if len(names) > 25 {
+		names = names[:25]
+	}
+	out := make([]*discordgo.ApplicationCommandOptionChoice, len(names))
+	for i, x := range names {
+		out[i] = &discordgo.ApplicationCommandOptionChoice{Name: x, Value: x}
+	}
+	return out
+}
+
+func onGuildDeleteCommands(_ *discordgo.Session, event *discordgo.GuildDelete) {
+	if !event.Unavailable {
+		gid, _ := strconv.ParseUint(event.ID, 10, 64)
+		db.Exec("DELETE FROM guildCommands WHERE gid=?001;", gid)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// UploadCommands makes the registered commands match the prepared ones.
+// Only commands that were added, changed or removed are sent, so command IDs stay stable across restarts.
+// In test mode, every command goes to guildId. Otherwise commands marked Gsm go to guildId and the rest are global.
+func UploadCommands(self *discordgo.Session, appId string, guildId string, testMode bool) {
+	resync = func() error {
+		return uploadCommands(self, appId, guildId, testMode)
+	}
+	err := resync()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Set by UploadCommands so that the commands can be synced again when a module is turned on or off
+var resync func() error
+
+func uploadCommands(self *discordgo.Session, appId string, guildId string, testMode bool) error {
+	cmdLock.RLock()
+	defer cmdLock.RUnlock()
+	if testMode {
+		ls := make([]*discordgo.ApplicationCommand, len(batchCmdList))
+		for i, x := range batchCmdList {
+			ls[i] = x.ApplicationCommand
+		}
+		return syncCommands(self, appId, guildId, ls)
+	}
+	ls := make([]*discordgo.ApplicationCommand, 0, len(batchCmdList))
+	ls2 := make([]*discordgo.ApplicationCommand, 0, 4)
+	for _, x := range batchCmdList {
+		if x.gsm {
+			ls2 = append(ls2, x.ApplicationCommand)
+		} else {
+			ls = append(ls, x.ApplicationCommand)
+		}
+	}
+	err := syncCommands(self, appId, "", ls)
+	if err == nil && guildId != "" {
+		err = syncCommands(self, appId, guildId, ls2)
+	}
+	return err
+}
+
+func ClearGuildCommands(self *discordgo.Session, appId string, guildID string) {
+	_, err := self.ApplicationCommandBulkOverwrite(appId, guildID, nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type cmdKey struct {
+	t    discordgo.ApplicationCommandType
+	name string
+}
+
+func syncCommands(self *discordgo.Session, appId, guildId string, want []*discordgo.ApplicationCommand) error {
+	scope := "global"
+	if guildId != "" {
+		scope = "guild " + guildId
+	}
+	have, err := self.ApplicationCommands(appId, guildId)
+	if err != nil {
+		return fmt.Errorf("failed to get %s commands: %w", scope, err)
+	}
+	existing := make(map[cmdKey]*discordgo.ApplicationCommand, len(have))
+	for _, x := range have {
+		existing[cmdKey{x.Type, x.Name}] = x
+	}
+	var errs []error
+	changed := false
+	for _, x := range want {
+		k := cmdKey{x.Type, x.Name}
+		old := existing[k]
+		delete(existing, k)
+		if old == nil {
+			log.Info(fmt.Sprintf("Commands (%s): + %s", scope, x.Name))
+			changed = true
+			created, err := self.ApplicationCommandCreate(appId, guildId, x)
+			if err != nil {
+				errs = append(errs, describeUploadError(err, x))
+			} else {
+				x.ID = created.ID
+			}
+			continue
+		}
+		x.ID = old.ID
+		diff := diffCommand(old, x)
+		if len(diff) == 0 {
+			continue
+		}
+		log.Info(fmt.Sprintf("Commands (%s): ~ %s (%s)", scope, x.Name, strings.Join(diff, ", ")))
+		changed = true
+		_, err := self.ApplicationCommandEdit(appId, guildId, old.ID, x)
+		if err != nil {
+			errs = append(errs, describeUploadError(err, x))
+		}
+	}
+	for _, x := range existing {
+		log.Info(fmt.Sprintf("Commands (%s): - %s", scope, x.Name))
+		changed = true
+		err := self.ApplicationCommandDelete(appId, guildId, x.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete command %s: %w", x.Name, err))
+		}
+	}
+	if !changed {
+		log.Debug(fmt.Sprintf("Commands (%s): up to date", scope))
+	}
+	return errors.Join(errs...)
+}
+
+// describeUploadError decodes an invalid form body error into the paths of the offending fields.
+func describeUploadError(err error, cmd *discordgo.ApplicationCommand) error {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return fmt.Errorf("failed to upload command %s: %w", cmd.Name, err)
+	}
+	var errBody struct {
+		Errors map[string]any
+		Code   int
+	}
+	json.Unmarshal(restErr.ResponseBody, &errBody)
+	if errBody.Code != discordgo.ErrCodeInvalidFormBody {
+		return fmt.Errorf("failed to upload command %s: %w", cmd.Name, err)
+	}
+	var problems []string
+	flattenFormErrors("", errBody.Errors, &problems)
+	sort.Strings(problems)
+	return fmt.Errorf("invalid command %s:\n%s", cmd.Name, strings.Join(problems, "\n"))
+}
+
+func flattenFormErrors(path string, tree map[string]any, out *[]string) {
+	for k, v := range tree {
+		if k == "_errors" {
+			ls, _ := v.([]any)
+			for _, e := range ls {
+				e2, _ := e.(map[string]any)
+				*out = append(*out, fmt.Sprintf(" - %s: %v", path, e2["message"]))
+			}
+			continue
+		}
+		sub, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		if path != "" {
+			flattenFormErrors(path+"."+k, sub, out)
+		} else {
+			flattenFormErrors(k, sub, out)
+		}
+	}
+}
+
+// diffCommand returns the names of the fields that differ between a registered command and a prepared one.
+func diffCommand(have, want *discordgo.ApplicationCommand) []string {
+	var out []string
+	if have.Description != want.Description {
+		out = append(out, "description")
+	}
+	if !sameLocalizations(have.NameLocalizations, want.NameLocalizations) {
+		out = append(out, "name localizations")
+	}
+	if !sameLocalizations(have.DescriptionLocalizations, want.DescriptionLocalizations) {
+		out = append(out, "description localizations")
+	}
+	if (have.NSFW != nil && *have.NSFW) != (want.NSFW != nil && *want.NSFW) {
+		out = append(out, "nsfw")
+	}
+	if (have.DefaultMemberPermissions == nil) != (want.DefaultMemberPermissions == nil) || (have.DefaultMemberPermissions != nil && *have.DefaultMemberPermissions != *want.DefaultMemberPermissions) {
+		out = append(out, "permissions")
+	}
+	if !slices.Equal(normContexts(have.Contexts), normContexts(want.Contexts)) {
+		out = append(out, "contexts")
+	}
+	if !slices.Equal(normIntegrationTypes(have.IntegrationTypes), normIntegrationTypes(want.IntegrationTypes)) {
+		out = append(out, "integration types")
+	}
+	return append(out, diffOptions("options", have.Options, want.Options)...)
+}
+
+// An unset context list means the command is available everywhere.
+func normContexts(c *[]discordgo.InteractionContextType) []discordgo.InteractionContextType {
+	if c == nil || len(*c) == 0 {
+		return []discordgo.InteractionContextType{discordgo.InteractionContextGuild, discordgo.InteractionContextBotDM, discordgo.InteractionContextPrivateChannel}
+	}
+	ls := slices.Clone(*c)
+	slices.Sort(ls)
+	return ls
+}
+
+// An unset integration type list means the command is only available where the bot is installed in a guild.
+func normIntegrationTypes(t *[]discordgo.ApplicationIntegrationType) []discordgo.ApplicationIntegrationType {
+	if t == nil || len(*t) == 0 {
+		return []discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall}
+	}
+	ls := slices.Clone(*t)
+	slices.Sort(ls)
+	return ls
+}
+
+func sameLocalizations(a, b *map[discordgo.Locale]string) bool {
+	var a2, b2 map[discordgo.Locale]string
+	if a != nil {
+		a2 = *a
+	}
+	if b != nil {
+		b2 = *b
+	}
+	return maps.Equal(a2, b2)
+}
+
+func diffOptions(path string, have, want []*discordgo.ApplicationCommandOption) []string {
+	var out []string
+	for i := 0; i < len(have) || i < len(want); i++ {
+		if i >= len(have) {
+			out = append(out, path+"."+want[i].Name+" added")
+			continue
+		}
+		if i >= len(want) {
+			out = append(out, path+"."+have[i].Name+" removed")
+			continue
+		}
+		a, b := have[i], want[i]
+		if a.Name != b.Name {
+			out = append(out, path+"."+b.Name+" replaces "+a.Name)
+			continue
+		}
+		p := path + "." + b.Name
+		if a.Type != b.Type {
+			out = append(out, p+".type")
+		}
+		if a.Description != b.Description {
+			out = append(out, p+".description")
+		}
+		if !maps.Equal(a.NameLocalizations, b.NameLocalizations) || !maps.Equal(a.DescriptionLocalizations, b.DescriptionLocalizations) {
+			out = append(out, p+".localizations")
+		}
+		if a.Required != b.Required {
+			out = append(out, p+".required")
+		}
+		if a.Autocomplete != b.Autocomplete {
+			out = append(out, p+".autocomplete")
+		}
+		if !slices.Equal(a.ChannelTypes, b.ChannelTypes) {
+			out = append(out, p+".channel_types")
+		}
+		if (a.MinValue == nil) != (b.MinValue == nil) || (a.MinValue != nil && *a.MinValue != *b.MinValue) || a.MaxValue != b.MaxValue {
+			out = append(out, p+".range")
+		}
+		if (a.MinLength == nil) != (b.MinLength == nil) || (a.MinLength != nil && *a.MinLength != *b.MinLength) || a.MaxLength != b.MaxLength {
+			out = append(out, p+".length")
+		}
+		if !sameChoices(a.Choices, b.Choices) {
+			out = append(out, p+".choices")
+		}
+		out = append(out, diffOptions(p, a.Options, b.Options)...)
+	}
+	return out
+}
+
+func sameChoices(a, b []*discordgo.ApplicationCommandOptionChoice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// Values come back from Discord as float64, so compare them as text
+		if a[i].Name != b[i].Name || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) || !maps.Equal(a[i].NameLocalizations, b[i].NameLocalizations) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// testCommand is a command as it would be prepared, and as Discord would send it back.
+func testCommand() *discordgo.ApplicationCommand {
+	c := PrepareCommand("remind", "Set a reminder").Localize(discordgo.German, "erinnern", "Eine Erinnerung setzen").ApplicationCommand
+	c.IntegrationTypes = &[]discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationUserInstall, discordgo.ApplicationIntegrationGuildInstall}
+	return c
+}
+
+func testOptions() []*discordgo.ApplicationCommandOption {
+	return []*discordgo.ApplicationCommandOption{
+		NewCommandOption("when", "When to remind you").AsString().Required().Finalize(),
+		NewCommandOption("what", "What to remind you of").AsString().Finalize(),
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *discordgo.ApplicationCommand)
+		want   []string
+	}{
+		{"unchanged", func(c *discordgo.ApplicationCommand) {}, nil},
+		{"description", func(c *discordgo.ApplicationCommand) {
+			c.Description = "Remind me"
+		}, []string{"description"}},
+		{"name localization", func(c *discordgo.ApplicationCommand) {
+			(*c.NameLocalizations)[discordgo.German] = "erinnerung"
+		}, []string{"name localizations"}},
+		{"description localization added", func(c *discordgo.ApplicationCommand) {
+			(*c.DescriptionLocalizations)[discordgo.SpanishES] = "Poner un recordatorio"
+		}, []string{"description localizations"}},
+		{"integration types", func(c *discordgo.ApplicationCommand) {
+			c.IntegrationTypes = nil
+		}, []string{"integration types"}},
+		{"option description", func(c *discordgo.ApplicationCommand) {
+			c.Options[0].Description = "When"
+		}, []string{"options.when.description"}},
+		{"option required", func(c *discordgo.ApplicationCommand) {
+			c.Options[1].Required = true
+		}, []string{"options.what.required"}},
+		{"option localization", func(c *discordgo.ApplicationCommand) {
+			c.Options[0].NameLocalizations = map[discordgo.Locale]string{discordgo.German: "wann"}
+		}, []string{"options.when.localizations"}},
+		{"option added", func(c *discordgo.ApplicationCommand) {
+			c.Options = append(c.Options, NewCommandOption("where", "Where to remind you").AsChannel(nil).Finalize())
+		}, []string{"options.where added"}},
+		{"option removed", func(c *discordgo.ApplicationCommand) {
+			c.Options = c.Options[:1]
+		}, []string{"options.what removed"}},
+		{"option renamed", func(c *discordgo.ApplicationCommand) {
+			c.Options[1].Name = "message"
+		}, []string{"options.message replaces what"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have := testCommand()
+			have.Options = testOptions()
+			want := testCommand()
+			want.Options = testOptions()
+			tt.change(want)
+			if got := diffCommand(have, want); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffCommandDefaults(t *testing.T) {
+	// Discord fills in defaults that weren't sent, which must not count as changes
+	have := PrepareCommand("ping", "Get bot latency").ApplicationCommand
+	guild := []discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall}
+	everywhere := []discordgo.InteractionContextType{discordgo.InteractionContextPrivateChannel, discordgo.InteractionContextGuild, discordgo.InteractionContextBotDM}
+	have.IntegrationTypes = &guild
+	have.Contexts = &everywhere
+	want := PrepareCommand("ping", "Get bot latency").ApplicationCommand
+	if got := diffCommand(have, want); len(got) != 0 {
+		t.Errorf("got %q", got)
+	}
+}
+
+// commandServer answers the command endpoints of the API from a list of commands, recording each change made.
+type commandServer struct {
+	sync.Mutex
+	commands []*discordgo.ApplicationCommand
+	calls    []string
+	nextID   int
+}
+
+func (s *commandServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.Lock()
+	defer s.Unlock()
+	var body any
+	var cmd discordgo.ApplicationCommand
+	if req.Body != nil {
+		json.NewDecoder(req.Body).Decode(&cmd)
+	}
+	id := req.URL.Path[strings.LastIndexByte(req.URL.Path, '/')+1:]
+	switch req.Method {
+	case http.MethodGet:
+		body = s.commands
+	case http.MethodPost:
+		s.nextID++
+		cmd.ID = "new" + strconv.Itoa(s.nextID)
+		s.calls = append(s.calls, "create "+cmd.Name)
+		body = cmd
+	case http.MethodPatch:
+		s.calls = append(s.calls, "edit "+id+" "+cmd.Name)
+		body = cmd
+	case http.MethodDelete:
+		s.calls = append(s.calls, "delete "+id)
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+	}
+	b, _ := json.Marshal(body)
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}, Body: io.NopCloser(bytes.NewReader(b)), Request: req}, nil
+}
+
+func TestSyncCommands(t *testing.T) {
+	unchanged := testCommand()
+	unchanged.Options = testOptions()
+	unchanged.ID = "1"
+	edited := PrepareCommand("ping", "Get bot latency").ApplicationCommand
+	edited.ID = "2"
+	removed := PrepareCommand("roll", "Roll dice").ApplicationCommand
+	removed.ID = "3"
+	srv := &commandServer{commands: []*discordgo.ApplicationCommand{unchanged, edited, removed}}
+	self, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	self.Client = &http.Client{Transport: srv}
+
+	want := []*discordgo.ApplicationCommand{
+		testCommand(),
+		PrepareCommand("ping", "Check that I'm alive").ApplicationCommand,
+		PrepareCommand("quote", "Get a quote").ApplicationCommand,
+	}
+	want[0].Options = testOptions()
+	err = syncCommands(self, "100", "", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"edit 2 ping", "create quote", "delete 3"}; !slices.Equal(srv.calls, expect) {
+		t.Errorf("calls %q, want %q", srv.calls, expect)
+	}
+	if want[0].ID != "1" || want[1].ID != "2" || want[2].ID != "new1" {
+		t.Errorf("IDs %q, %q, %q", want[0].ID, want[1].ID, want[2].ID)
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package config reads the settings the bot needs before it can connect.
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// DefaultFile is read unless JLORT_CONFIG names another file.
+const DefaultFile = "config.json"
+
+// LegacyFile is read if there is no config file.
+// It has the token, then a server ID, then the MOTD, one per line.
+const LegacyFile = "key.txt"
+
+// Config holds the startup settings. Every field can be overridden by the environment variable in its env tag.
+type Config struct {
+	Token            string   `json:"token" env:"JLORT_TOKEN"`
+	TestGuild        string   `json:"testGuild" env:"JLORT_TEST_GUILD"`   // Upload every command to this server only
+	GSMGuild         string   `json:"gsmGuild" env:"JLORT_GSM_GUILD"`     // Upload the GSM commands to this server
+	ClearGuild       string   `json:"clearGuild" env:"JLORT_CLEAR_GUILD"` // Delete the commands in this server and exit
+	MOTD             string   `json:"motd" env:"JLORT_MOTD"`
+	Database         string   `json:"database" env:"JLORT_DATABASE"`
+	LogLevel         string   `json:"logLevel" env:"JLORT_LOG_LEVEL"` // Empty means INFO on a terminal and WARN otherwise
+	PfpDir           string   `json:"pfpDir" env:"JLORT_PFP_DIR"`
+	ClickartDir      string   `json:"clickartDir" env:"JLORT_CLICKART_DIR"`
+	Intents          []string `json:"intents" env:"JLORT_INTENTS"`                    // Comma separated in the environment
+	ShutdownTimeout  string   `json:"shutdownTimeout" env:"JLORT_SHUTDOWN_TIMEOUT"`   // How long to wait for running commands when stopping, like "30s"
+	InteractionsAddr string   `json:"interactionsAddr" env:"JLORT_INTERACTIONS_ADDR"` // Also take interactions over HTTP on this address, like ":8080"
+	PublicKey        string   `json:"publicKey" env:"JLORT_PUBLIC_KEY"`               // Checks interactions that come over HTTP, defaults to the application's
+	MetricsAddr      string   `json:"metricsAddr" env:"JLORT_METRICS_ADDR"`           // Serve /healthz and /metrics on this address, like "127.0.0.1:9090"
+	RecordFile       string   `json:"recordFile" env:"JLORT_RECORD_FILE"`             // Append every gateway event to this file, for replaying later
+
+	// Where each setting came from by JSON name, for error messages
+	sources map[string]string
+	legacy  bool
+	offline bool
+	level   log.Level
+	intents discordgo.Intent
+	timeout time.Duration
+	key     ed25519.PublicKey
+}
+
+// Default returns the settings used when nothing else is given.
+func Default() *Config {
+	c := new(Config)
+	c.Database = "persistent.db"
+	c.PfpDir = "pfps"
+	c.ClickartDir = "modules/clickart"
+	c.Intents = []string{"Guilds", "GuildMembers", "GuildVoiceStates", "GuildMessages", "GuildMessageReactions", "MessageContent"}
+	c.ShutdownTimeout = "30s"
+	c.sources = make(map[string]string)
+	return c
+}
+
+// Load reads the config file, or key.txt if there is none, then applies environment overrides and validates the result.
+// With neither file, everything must come from the environment.
+func Load() (*Config, error) {
+	return load(Default())
+}
+
+// LoadOffline is like Load, but the token may be missing, since nothing will connect to Discord.
+func LoadOffline() (*Config, error) {
+	c := Default()
+	c.offline = true
+	return load(c)
+}
+
+func load(c *Config) (*Config, error) {
+	path, explicit := os.LookupEnv("JLORT_CONFIG")
+	if !explicit {
+		path = DefaultFile
+	}
+	err := c.readFile(path)
+	if !explicit && errors.Is(err, fs.ErrNotExist) {
+		err = c.readLegacy(LegacyFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = c.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Legacy reports whether the settings came from key.txt.
+func (c *Config) Legacy() bool {
+	return c.legacy
+}
+
+// Level returns the configured log level, or false if there is none.
+func (c *Config) Level() (log.Level, bool) {
+	return c.level, c.LogLevel != ""
+}
+
+// IntentMask returns the gateway intents to identify with.
+func (c *Config) IntentMask() discordgo.Intent {
+	return c.intents
+}
+
+// ShutdownWait returns how long to wait for running commands when stopping.
+func (c *Config) ShutdownWait() time.Duration {
+	return c.timeout
+}
+
+// VerifyKey returns the key to check interactions that come over HTTP with, or nil if the application's should be used.
+func (c *Config) VerifyKey() ed25519.PublicKey {
+	return c.key
+}
+
+// lineCol turns a byte offset into a line and column for error messages.
+func lineCol(data []byte, offset int64) (int, int) {
+	data = data[:min(int(offset), len(data))]
+	line := bytes.Count(data, []byte{'\n'}) + 1
+	col := len(data) - bytes.LastIndexByte(data, '\n')
+	return line, col
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(c)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		line, col := lineCol(data, syntaxErr.Offset)
+		return fmt.Errorf("%s:%d:%d: %w", path, line, col, err)
+	} else if errors.As(err, &typeErr) {
+		line, col := lineCol(data, typeErr.Offset)
+		return fmt.Errorf("%s:%d:%d: %s should be %s, not %s", path, line, col, typeErr.Field, friendlyType(typeErr.Type), typeErr.Value)
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var keys map[string]json.RawMessage
+	json.Unmarshal(data, &keys)
+	for k := range keys {
+		c.sources[k] = path
+	}
+	return nil
+}
+
+func friendlyType(t reflect.Type) string {
+	if t.Kind() == reflect.Slice {
+		return "a list of strings"
+	}
+	return "a string"
+}
+
+func (c *Config) readLegacy(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.legacy = true
+	lines := strings.Split(string(data), "\n")
+	for i, x := range lines {
+		lines[i] = strings.TrimSuffix(x, "\r")
+	}
+	c.Token = lines[0]
+	c.sources["token"] = path + ":1"
+	if len(lines) > 1 && lines[1] != "" {
+		guild := lines[1]
+		switch guild[0] {
+		case 't':
+			c.TestGuild = guild[1:]
+			c.sources["testGuild"] = path + ":2"
+		case '-':
+			c.ClearGuild = guild[1:]
+			c.sources["clearGuild"] = path + ":2"
+		default:
+			c.GSMGuild = guild
+			c.sources["gsmGuild"] = path + ":2"
+		}
+	}
+	if len(lines) > 2 {
+		c.MOTD = lines[2]
+		c.sources["motd"] = path + ":3"
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		env := f.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.String:
+			v.Field(i).SetString(value)
+		case reflect.Slice:
+			var ls []string
+			for _, x := range strings.Split(value, ",") {
+				x = strings.TrimSpace(x)
+				if x != "" {
+					ls = append(ls, x)
+				}
+			}
+			v.Field(i).Set(reflect.ValueOf(ls))
+		default:
+			return fmt.Errorf("config: field %s has unsupported type %s", f.Name, f.Type)
+		}
+		c.sources[f.Tag.Get("json")] = env
+	}
+	return nil
+}
+
+// fieldError names the setting and where it came from.
+func (c *Config) fieldError(name string, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if where, ok := c.sources[name]; ok {
+		return fmt.Errorf("%s (from %s): %s", name, where, msg)
+	}
+	return fmt.Errorf("%s: %s", name, msg)
+}
+
+var intentNames = map[string]discordgo.Intent{
+	"guilds":                      discordgo.IntentGuilds,
+	"guildmembers":                discordgo.IntentGuildMembers,
+	"guildmoderation":             discordgo.IntentGuildModeration,
+	"guildemojis":                 discordgo.IntentGuildEmojis,
+	"guildintegrations":           discordgo.IntentGuildIntegrations,
+	"guildwebhooks":               discordgo.IntentGuildWebhooks,
+	"guildinvites":                discordgo.IntentGuildInvites,
+	"guildvoicestates":            discordgo.IntentGuildVoiceStates,
+	"guildpresences":              discordgo.IntentGuildPresences,
+	"guildmessages":               discordgo.IntentGuildMessages,
+	"guildmessagereactions":       discordgo.IntentGuildMessageReactions,
+	"guildmessagetyping":          discordgo.IntentGuildMessageTyping,
+	"directmessages":              discordgo.IntentDirectMessages,
+	"directmessagereactions":      discordgo.IntentDirectMessageReactions,
+	"directmessagetyping":         discordgo.IntentDirectMessageTyping,
+	"messagecontent":              discordgo.IntentMessageContent,
+	"guildscheduledevents":        discordgo.IntentGuildScheduledEvents,
+	"automoderationconfiguration": discordgo.IntentAutoModerationConfiguration,
+	"automoderationexecution":     discordgo.IntentAutoModerationExecution,
+	"guildmessagepolls":           discordgo.IntentGuildMessagePolls,
+	"directmessagepolls":          discordgo.IntentDirectMessagePolls,
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	if c.Token == "" {
+		if !c.offline {
+			errs = append(errs, c.fieldError("token", "missing, set it in %s or JLORT_TOKEN", DefaultFile))
+		}
+	} else if strings.HasPrefix(c.Token, "Bot ") {
+		errs = append(errs, c.fieldError("token", "should not start with \"Bot \""))
+	} else if strings.ContainsFunc(c.Token, unicode.IsSpace) {
+		errs = append(errs, c.fieldError("token", "contains whitespace"))
+	}
+	for _, x := range []struct{ name, value string }{{"testGuild", c.TestGuild}, {"gsmGuild", c.GSMGuild}, {"clearGuild", c.ClearGuild}} {
+		if x.value == "" {
+			continue
+		}
+		if _, err := strconv.ParseUint(x.value, 10, 64); err != nil {
+			errs = append(errs, c.fieldError(x.name, "%q is not a server ID", x.value))
+		}
+	}
+	if c.TestGuild != "" && c.GSMGuild != "" {
+		errs = append(errs, c.fieldError("gsmGuild", "can't be used with testGuild, which gets every command"))
+	}
+	if len(c.MOTD) > 128 {
+		errs = append(errs, c.fieldError("motd", "is %d characters long, the limit is 128", len(c.MOTD)))
+	}
+	if c.Database == "" {
+		errs = append(errs, c.fieldError("database", "missing"))
+	}
+	if c.LogLevel != "" {
+		var err error
+		c.level, err = log.ParseLevel(c.LogLevel)
+		if err != nil {
+			errs = append(errs, c.fieldError("logLevel", "%s", err.Error()))
+		}
+	}
+	for _, x := range []struct{ name, value string }{{"pfpDir", c.PfpDir}, {"clickartDir", c.ClickartDir}} {
+		// The defaults are allowed to be missing, since the features that need them just turn off
+		if c.sources[x.name] == "" {
+			continue
+		}
+		stat, err := os.Stat(x.value)
+		if err != nil {
+			errs = append(errs, c.fieldError(x.name, "%s", err.Error()))
+		} else if !stat.IsDir() {
+			errs = append(errs, c.fieldError(x.name, "%s is not a directory", x.value))
+		}
+	}
+	var err error
+	c.timeout, err = time.ParseDuration(c.ShutdownTimeout)
+	if err != nil {
+		errs = append(errs, c.fieldError("shutdownTimeout", "%q is not a duration like \"30s\"", c.ShutdownTimeout))
+	} else if c.timeout < 0 {
+		errs = append(errs, c.fieldError("shutdownTimeout", "can't be negative"))
+	}
+	for _, x := range []struct{ name, value string }{{"interactionsAddr", c.InteractionsAddr}, {"metricsAddr", c.MetricsAddr}} {
+		if x.value == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(x.value); err != nil {
+			errs = append(errs, c.fieldError(x.name, "%s", err.Error()))
+		}
+	}
+	if c.InteractionsAddr != "" && c.InteractionsAddr == c.MetricsAddr {
+		errs = append(errs, c.fieldError("metricsAddr", "can't be the same as interactionsAddr"))
+	}
+	c.key = nil
+	if c.PublicKey != "" {
+		key, err := hex.DecodeString(c.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			errs = append(errs, c.fieldError("publicKey", "should be %d hex digits, as shown on the developer portal", ed25519.PublicKeySize*2))
+		} else {
+			c.key = key
+		}
+	}
+	c.intents = 0
+	for _, x := range c.Intents {
+		intent, ok := intentNames[strings.ToLower(strings.TrimPrefix(x, "Intent"))]
+		if !ok {
+			errs = append(errs, c.fieldError("intents", "unknown intent %q", x))
+		}
+		c.intents |= intent
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,145 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		// Empty if the settings are fine
+		want string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"duration", func(c *Config) { c.ShutdownTimeout = "1m30s" }, ""},
+		{"bad duration", func(c *Config) { c.ShutdownTimeout = "30" }, `shutdownTimeout: "30" is not a duration`},
+		{"negative duration", func(c *Config) { c.ShutdownTimeout = "-5s" }, "shutdownTimeout: can't be negative"},
+		{"intent prefix and case", func(c *Config) { c.Intents = []string{"IntentGuilds", "directMESSAGES"} }, ""},
+		{"unknown intent", func(c *Config) { c.Intents = []string{"Guilds", "GuildVoice"} }, `intents: unknown intent "GuildVoice"`},
+		{"testGuild alone", func(c *Config) { c.TestGuild = "123" }, ""},
+		{"testGuild with gsmGuild", func(c *Config) { c.TestGuild, c.GSMGuild = "123", "456" }, "gsmGuild: can't be used with testGuild"},
+		{"bad guild", func(c *Config) { c.GSMGuild = "general" }, `gsmGuild: "general" is not a server ID`},
+		{"missing token", func(c *Config) { c.Token = "" }, "token: missing"},
+		{"Bot prefix", func(c *Config) { c.Token = "Bot abc" }, `token: should not start with "Bot "`},
+		{"same addresses", func(c *Config) { c.InteractionsAddr, c.MetricsAddr = ":8080", ":8080" }, "metricsAddr: can't be the same"},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.Token = "abc"
+		tt.change(c)
+		err := c.validate()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestValidateParses(t *testing.T) {
+	c := Default()
+	c.Token = "abc"
+	c.ShutdownTimeout = "2m"
+	c.Intents = []string{"Guilds", "MessageContent"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.ShutdownWait() != 2*time.Minute {
+		t.Errorf("shutdown wait %v", c.ShutdownWait())
+	}
+	if c.IntentMask() != discordgo.IntentGuilds|discordgo.IntentMessageContent {
+		t.Errorf("intents %b", c.IntentMask())
+	}
+}
+
+// writeFile writes data to a new file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(data), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := writeFile(t, "config.json", `{"token": "fromfile", "motd": "from file", "intents": ["Guilds"], "shutdownTimeout": "10s"}`)
+	t.Setenv("JLORT_CONFIG", path)
+	t.Setenv("JLORT_TOKEN", "fromenv")
+	t.Setenv("JLORT_INTENTS", "Guilds, GuildMessages,,")
+	t.Setenv("JLORT_SHUTDOWN_TIMEOUT", "soon")
+	_, err := Load()
+	// The error names the variable the bad setting came from
+	if err == nil || !strings.Contains(err.Error(), "shutdownTimeout (from JLORT_SHUTDOWN_TIMEOUT)") {
+		t.Fatalf("got %v", err)
+	}
+
+	t.Setenv("JLORT_SHUTDOWN_TIMEOUT", "1m")
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "fromenv" || c.MOTD != "from file" || c.ShutdownWait() != time.Minute {
+		t.Errorf("token %q, motd %q, shutdown wait %v", c.Token, c.MOTD, c.ShutdownWait())
+	}
+	if !slices.Equal(c.Intents, []string{"Guilds", "GuildMessages"}) {
+		t.Errorf("intents %q", c.Intents)
+	}
+}
+
+func TestReadLegacy(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		token string
+		test  string
+		gsm   string
+		clear string
+		motd  string
+	}{
+		{"token only", "abc", "abc", "", "", "", ""},
+		{"gsm guild", "abc\n123\nhello", "abc", "", "123", "", "hello"},
+		{"test guild", "abc\nt123\n", "abc", "123", "", "", ""},
+		{"clear guild", "abc\n-123", "abc", "", "", "123", ""},
+		{"CRLF", "abc\r\nt123\r\nhello there\r\n", "abc", "123", "", "", "hello there"},
+		{"no guild", "abc\n\nhello", "abc", "", "", "", "hello"},
+	}
+	for _, tt := range tests {
+		c := Default()
+		if err := c.readLegacy(writeFile(t, "key.txt", tt.data)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !c.Legacy() || c.Token != tt.token || c.TestGuild != tt.test || c.GSMGuild != tt.gsm || c.ClearGuild != tt.clear || c.MOTD != tt.motd {
+			t.Errorf("%s: got token %q, test %q, gsm %q, clear %q, motd %q", tt.name, c.Token, c.TestGuild, c.GSMGuild, c.ClearGuild, c.MOTD)
+		}
+	}
+}
@@ -19,33 +19,51 @@ package kek
 
 import (
 	"database/sql"
+	"embed"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
 	"jlortiz.org/jlort2/modules/commands"
 	"jlortiz.org/jlort2/modules/log"
+	"jlortiz.org/jlort2/modules/metrics"
 )
 
+//go:embed locales/*.json
+var catalog embed.FS
+
 var queryKekEnabled *sql.Stmt
 var setKekMsg *sql.Stmt
 var queryKek *sql.Stmt
+var queryKekAll *sql.Stmt
+var cleanStopper chan struct{}
+
+var metricVotes = metrics.NewCounter("jlort_kek_votes_total", "Kek reactions counted.")
 
 // ~!kekage [user]
 // Checks someone's kekage
 // If not specified, gives the kekage of the command runner.
 func kekage(ctx *commands.Context) error {
+	var args struct {
+		User *discordgo.User `option:"user"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
 	target := ctx.User
 	data := ctx.ApplicationCommandData()
-	if len(data.Options) > 0 && ctx.GuildID != "" {
-		target = data.Options[0].UserValue(ctx.Bot)
+	if args.User != nil && ctx.GuildID != "" {
+		target = args.User
 	} else if data.TargetID != "" {
 		target = data.Resolved.Users[data.TargetID]
 	}
 	if target.Bot {
-		return ctx.RespondPrivate("Bots can't be kek.")
+		return ctx.RespondPrivate(ctx.T("kek.bot"))
 	}
 	name := target.DisplayName()
 	if ctx.GuildID != "" {
@@ -59,27 +77,27 @@ func kekage(ctx *commands.Context) error {
 	result := queryKek.QueryRow(uid)
 	result.Scan(&kekI)
 	kekI *= 50
-	var msg string
+	var key string
 	if kekI == 0 {
-		return ctx.RespondPrivate(name + " is in perfect harmony between kek and cringe.\nAll they have to do now is turn off thier computer and get a life.")
+		return ctx.RespondPrivate(ctx.T("kek.zero", name))
 	} else if kekI < 0 {
 		if kekI > -1000 {
-			msg = "%s is at %s cringe.\nThey should be wary, lest they falter further."
+			key = "kek.cringeLow"
 		} else if kekI > -1000000 {
-			msg = "%s is at %s cringe.\nEvil spirits are strengthening from their presence."
+			key = "kek.cringeMid"
 		} else {
-			msg = "%s is at %s cringe.\nAnton Chigurh has offered to kill them for free."
+			key = "kek.cringeHigh"
 		}
 	} else {
 		if kekI < 1000 {
-			msg = "%s is at %s kek.\nThey are but starting on the path to enlightenment."
+			key = "kek.kekLow"
 		} else if kekI < 1000000 {
-			msg = "%s is at %s kek.\nSomething great stirs within them."
+			key = "kek.kekMid"
 		} else {
-			msg = "%s is at %s kek.\nThey are blessed with the power of good vibes."
+			key = "kek.kekHigh"
 		}
 	}
-	return ctx.RespondPrivate(fmt.Sprintf(msg, name, convertKek(kekI)))
+	return ctx.RespondPrivate(ctx.T(key, name, convertKek(kekI)))
 }
 
 const kekreport_paginate_amount = 20
@@ -87,69 +105,59 @@ const kekreport_paginate_amount = 20
 // ~!kekReport
 // @GuildOnly
 // Gets the kekage of everyone
-func kekReport(ctx *commands.Context) error {
-	var ind int
-	if ctx.Type == discordgo.InteractionMessageComponent {
-		cid := ctx.MessageComponentData().CustomID
-		ind, _ = strconv.Atoi(cid[1:])
-		if cid[0] == 'r' {
-			ind += kekreport_paginate_amount
-		} else {
-			ind -= kekreport_paginate_amount
-		}
-	}
+var kekReport = &commands.Paginator{PageSize: kekreport_paginate_amount, Fetch: kekReportPage, Empty: "kek.none", Private: true}
+
+func kekReportPage(ctx *commands.Context, offset, limit int) (*discordgo.MessageEmbed, int, error) {
 	guild, err := ctx.State.Guild(ctx.GuildID)
 	if err != nil {
-		return fmt.Errorf("failed to get guild: %w", err)
+		return nil, 0, fmt.Errorf("failed to get guild: %w", err)
 	}
-	mList := make([]*discordgo.Member, 0, len(guild.Members)-1)
-	for _, x := range guild.Members {
-		if !x.User.Bot {
-			mList = append(mList, x)
-		}
+	rows, err := queryKekAll.Query()
+	if err != nil {
+		return nil, 0, err
 	}
-	if ind >= len(mList) {
-		ind = len(mList) - kekreport_paginate_amount
-	} else if ind < 0 {
-		ind = 0
+	defer rows.Close()
+	scores := make(map[string]int)
+	var uid uint64
+	var kekI int
+	for rows.Next() {
+		rows.Scan(&uid, &kekI)
+		scores[strconv.FormatUint(uid, 10)] = kekI
 	}
-	mList2 := mList[ind:]
-	if len(mList2) > kekreport_paginate_amount {
-		mList2 = mList2[:kekreport_paginate_amount]
+	type entry struct {
+		name string
+		kek  int
 	}
-	output := new(strings.Builder)
-	tx, err := ctx.Database.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Commit()
-	stmt := tx.Stmt(queryKek)
-	defer stmt.Close()
-	for _, mem := range mList2 {
-		if mem.User.Bot {
-			continue
-		}
-		var kekI int
-		uid, _ := strconv.ParseUint(mem.User.ID, 10, 64)
-		result := queryKek.QueryRow(uid)
-		if result.Scan(&kekI) == nil && kekI != 0 {
-			output.WriteString(mem.DisplayName())
-			output.WriteString(": ")
-			if kekI < 0 {
-				output.WriteByte('-')
-			}
-			output.WriteString(convertKek(kekI * 50))
-			output.WriteByte('\n')
+	ls := make([]entry, 0, len(scores))
+	for _, mem := range guild.Members {
+		if kekI, ok := scores[mem.User.ID]; ok && !mem.User.Bot {
+			ls = append(ls, entry{mem.DisplayName(), kekI})
 		}
 	}
-	if output.Len() == 0 {
-		return ctx.RespondPrivate("All keks are zero.")
+	if offset >= len(ls) {
+		return nil, len(ls), nil
 	}
-	if len(mList) > kekreport_paginate_amount {
-		ctx.SetComponents(discordgo.Button{CustomID: "l" + strconv.Itoa(ind), Disabled: ind == 0, Emoji: &discordgo.ComponentEmoji{Name: "\u2B05"}, Style: discordgo.SecondaryButton},
-			discordgo.Button{CustomID: "r" + strconv.Itoa(ind), Emoji: &discordgo.ComponentEmoji{Name: "\u27A1"}, Disabled: len(mList) <= ind+kekreport_paginate_amount, Style: discordgo.SecondaryButton})
+	slices.SortFunc(ls, func(a, b entry) int {
+		if a.kek != b.kek {
+			return b.kek - a.kek
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	output := new(strings.Builder)
+	for _, x := range ls[offset:min(offset+limit, len(ls))] {
+		output.WriteString(x.name)
+		output.WriteString(": ")
+		if x.kek < 0 {
+			output.WriteByte('-')
+		}
+		output.WriteString(convertKek(x.kek * 50))
+		output.WriteByte('\n')
 	}
-	return ctx.RespondPrivate(output.String())
+	embed := new(discordgo.MessageEmbed)
+	embed.Title = ctx.T("kek.reportTitle", guild.Name)
+	embed.Description = output.String()
+	embed.Color = 0x7289da
+	return embed, len(ls), nil
 }
 
 // ~!kekOn
@@ -158,13 +166,20 @@ func kekReport(ctx *commands.Context) error {
 // Toggles kekage on a server
 // You must have Manage Server to do this.
 func kekOn(ctx *commands.Context) error {
+	var args struct {
+		Enable bool `option:"enable,required"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
 	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
-	if ctx.ApplicationCommandData().Options[0].BoolValue() {
+	if args.Enable {
 		ctx.Database.Exec("INSERT INTO kekGuilds VALUES (?001);", gid)
-		return ctx.RespondPrivate("Kek enabled on this server.")
+		return ctx.RespondPrivate(ctx.T("kek.enabled"))
 	}
 	ctx.Database.Exec("DELETE FROM kekGuilds WHERE gid=?001;", gid)
-	return ctx.RespondPrivate("Kek disabled on this server.")
+	return ctx.RespondPrivate(ctx.T("kek.disabled"))
 }
 
 func onMessageKek(self *discordgo.Session, event *discordgo.MessageCreate) {
@@ -206,7 +221,7 @@ func onReactionAdd(self *discordgo.Session, event *discordgo.MessageReactionAdd)
 	if err != nil {
 		return
 	}
-	if msg.Timestamp.AddDate(0, 0, 4).Before(time.Now()) {
+	if msg.Timestamp.AddDate(0, 0, 4).Before(clock.Now()) {
 		return
 	}
 	total := 0
@@ -222,7 +237,9 @@ func onReactionAdd(self *discordgo.Session, event *discordgo.MessageReactionAdd)
 	_, err = setKekMsg.Exec(uid, mid, total)
 	if err != nil {
 		log.Error(err)
+		return
 	}
+	metricVotes.Inc()
 }
 
 func onReactionRemoveWrapper(self *discordgo.Session, event *discordgo.MessageReactionRemove) {
@@ -256,14 +273,32 @@ func convertKek(kek int) string {
 	}
 }
 
-// Init is defined in the command interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
-// Here, it also initializes the cooldown and duel maps and loads the kek data from disk, as well as collapsing old kek data.
-func Init(self *discordgo.Session) {
-	commands.PrepareCommand("kek", "Kek or cringe with "+self.State.Application.Name).Register(kekage, []*discordgo.ApplicationCommandOption{
+type module struct{}
+
+func init() {
+	commands.RegisterModule(module{})
+}
+
+func (module) Name() string {
+	return "kek"
+}
+
+func (module) Deps() []string {
+	return []string{"commands"}
+}
+
+// Init is defined in the Module interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
+// Here, it also starts collapsing old kek data.
+func (module) Init(self commands.Session) error {
+	err := commands.LoadCatalog(catalog)
+	if err != nil {
+		return err
+	}
+	commands.PrepareCommand("kek", "Kek or cringe with "+self.GetState().Application.Name).Alias("kekage").Register(kekage, []*discordgo.ApplicationCommandOption{
 		commands.NewCommandOption("user", "Person to check the kekage of, default you").AsUser().Finalize(),
 	})
-	commands.PrepareCommand("kekreport", "Reddit Recap for everyone").Guild().Component(kekReport).Register(kekReport, nil)
-	commands.PrepareCommand("kekenabled", "Enable or disable kek on this server").Guild().Perms(
+	commands.PrepareCommand("kekreport", "Reddit Recap for everyone").Guild().Component(kekReport.Respond).Register(kekReport.Respond, nil)
+	commands.PrepareCommand("kekenabled", "Enable or disable kek on this server").Alias("kekon").Guild().Perms(
 		discordgo.PermissionManageGuild).Register(kekOn, []*discordgo.ApplicationCommandOption{
 		commands.NewCommandOption("enable", "Should kek be enabled on this server?").AsBool().Required().Finalize()})
 	self.AddHandler(onMessageKek)
@@ -273,63 +308,93 @@ func Init(self *discordgo.Session) {
 	self.AddHandler(onGuildRemoveKek)
 
 	db := commands.GetDatabase()
-	var err error
-	queryKekEnabled, err = db.Prepare("SELECT gid FROM kekGuilds WHERE gid=?001;")
-	if err != nil {
-		log.Error(err)
-	}
-	setKekMsg, err = db.Prepare("INSERT INTO kekMsgs (uid, mid, score) VALUES (?001, ?002, ?003);")
-	if err != nil {
-		log.Error(err)
-	}
-	queryKek, err = db.Prepare(`SELECT u.score + ifnull(SUM(m.score), 0)
+	stmts := []struct {
+		dest  **sql.Stmt
+		query string
+	}{
+		{&queryKekEnabled, "SELECT gid FROM kekGuilds WHERE gid=?001;"},
+		{&setKekMsg, "INSERT INTO kekMsgs (uid, mid, score) VALUES (?001, ?002, ?003);"},
+		{&queryKek, `SELECT u.score + ifnull(SUM(m.score), 0)
 		FROM kekUsers u LEFT OUTER JOIN kekMsgs m ON m.uid = u.uid
-		WHERE u.uid = ?001;`)
-	if err != nil {
-		log.Error(err)
+		WHERE u.uid = ?001;`},
+		{&queryKekAll, `SELECT u.uid, u.score + ifnull(SUM(m.score), 0) total
+		FROM kekUsers u LEFT OUTER JOIN kekMsgs m ON m.uid = u.uid
+		GROUP BY u.uid HAVING total != 0;`},
+	}
+	for i, x := range stmts {
+		var err error
+		*x.dest, err = db.Prepare(x.query)
+		if err != nil {
+			for _, y := range stmts[:i] {
+				(*y.dest).Close()
+			}
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
 	}
-	go cleanKekDB()
+	cleanStopper = make(chan struct{})
+	go cleanKekDB(cleanStopper)
+	return nil
 }
 
-func cleanKekDB() {
-	t := time.Tick(time.Hour * 12)
+func cleanKekDB(stopper <-chan struct{}) {
+	tick := make(chan struct{}, 1)
 	for {
-		db := commands.GetDatabase()
-		snowflake := uint64(time.Now().AddDate(0, 0, -4).UnixMilli()) - 1420070400000
-		snowflake <<= 22
-		tx, err := db.Begin()
-		if err != nil {
-			log.Error(err)
-			<-t
-			continue
+		if done, ok := commands.Track(); ok {
+			collapseKek()
+			done()
 		}
-
-		result, err := tx.Exec(`
-		UPDATE kekUsers SET score = score + m.total FROM (
-			SELECT uid, SUM(score) total FROM kekMsgs
-			WHERE mid < ?001
-			GROUP BY uid
-		) m WHERE m.uid = kekUsers.uid;
-		DELETE FROM kekMsgs WHERE mid < ?001;
-		`, snowflake, snowflake)
-		if err != nil {
-			tx.Rollback()
-			log.Error(err)
-		} else if rows, _ := result.RowsAffected(); rows > 0 {
-			tx.Commit()
-			log.Info(fmt.Sprintf("Kek database cleaned, affected %d rows", rows))
-		} else {
-			tx.Rollback()
+		// Not a ticker, so that a replay's clock can move it along
+		t := clock.AfterFunc(time.Hour*12, func() { tick <- struct{}{} })
+		select {
+		case <-tick:
+		case <-stopper:
+			t.Stop()
+			return
 		}
-		<-t
 	}
 }
 
-// Cleanup is defined in the command interface to clean up the module when the bot unloads.
-// Here, it saves the kek data to disk.
-func Cleanup(_ *discordgo.Session) {
+// collapseKek folds votes on messages too old to vote on into the users' scores.
+func collapseKek() {
+	db := commands.GetDatabase()
+	snowflake := uint64(clock.Now().AddDate(0, 0, -4).UnixMilli()) - 1420070400000
+	snowflake <<= 22
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	result, err := tx.Exec(`
+	UPDATE kekUsers SET score = score + m.total FROM (
+		SELECT uid, SUM(score) total FROM kekMsgs
+		WHERE mid < ?001
+		GROUP BY uid
+	) m WHERE m.uid = kekUsers.uid;
+	DELETE FROM kekMsgs WHERE mid < ?001;
+	`, snowflake, snowflake)
+	if err != nil {
+		tx.Rollback()
+		log.Error(err)
+	} else if rows, _ := result.RowsAffected(); rows > 0 {
+		tx.Commit()
+		log.Info(fmt.Sprintf("Kek database cleaned, affected %d rows", rows))
+	} else {
+		tx.Rollback()
+	}
+}
+
+// Cleanup is defined in the Module interface to clean up the module when the bot unloads.
+// Here, it throws out zero scores.
+func (module) Cleanup(_ commands.Session) {
+	close(cleanStopper)
 	commands.GetDatabase().Exec("DELETE FROM kekMsgs WHERE score=0; DELETE FROM kekUsers WHERE score=0 AND uid NOT IN (SELECT uid FROM kekMsgs);")
 	queryKekEnabled.Close()
 	setKekMsg.Close()
 	queryKek.Close()
+	queryKekAll.Close()
+}
+
+func (module) Health() error {
+	return nil
 }
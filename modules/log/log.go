@@ -24,6 +24,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"strings"
 )
 
 //go:generate stringer -type Level -trimprefix Level
@@ -110,6 +111,16 @@ func GetLevel() Level {
 	return curLvl
 }
 
+// ParseLevel finds the level with the given name, ignoring case.
+func ParseLevel(name string) (Level, error) {
+	for l := LevelNONE; l <= LevelFINE; l++ {
+		if strings.EqualFold(l.String(), name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of NONE, FATAL, ERROR, WARN, INFO, DEBUG, FINE", name)
+}
+
 func Fatal(msg string) {
 	logOut(LevelFATAL, msg)
 }
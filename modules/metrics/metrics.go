@@ -0,0 +1,356 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package metrics keeps counters, gauges and histograms that every module reports into,
+// and writes them in the Prometheus text format.
+// Metrics should be made once, in package variables, since making two with the same name panics.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var registryLock sync.Mutex
+var registry = make(map[string]metric)
+
+func register(name string, m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metrics: " + name + " registered twice")
+	}
+	registry[name] = m
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, kind)
+}
+
+// key checks that the right number of label values were given and joins them into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats label pairs, with extra added at the end for histogram buckets.
+func (d *desc) labelString(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	b := new(strings.Builder)
+	b.WriteByte('{')
+	for i, l := range d.labels {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%s=\"%s\"", l, escapeLabel(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(b, "%s=\"%s\"", extra[i], escapeLabel(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type series struct {
+	values []string
+	v      float64
+}
+
+// scalar is what counters and gauges have in common.
+type scalar struct {
+	desc
+	kind   string
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func newScalar(kind, name, help string, labels []string) *scalar {
+	s := &scalar{desc: desc{name, help, labels}, kind: kind, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		// So that it shows up as 0 before anything happens
+		s.series[""] = &series{}
+	}
+	register(name, s)
+	return s
+}
+
+func (s *scalar) add(v float64, values []string) {
+	k := s.key(values)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	x := s.series[k]
+	if x == nil {
+		x = &series{values: slices.Clone(values)}
+		s.series[k] = x
+	}
+	x.v += v
+}
+
+func (s *scalar) set(v float64, values []string) {
+	k := s.key(values)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	x := s.series[k]
+	if x == nil {
+		x = &series{values: slices.Clone(values)}
+		s.series[k] = x
+	}
+	x.v = v
+}
+
+func (s *scalar) write(w *bufio.Writer) {
+	s.header(w, s.kind)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, k := range sortedKeys(s.series) {
+		x := s.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", s.name, s.labelString(x.values), formatFloat(x.v))
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Counter is a number that only goes up, like how many times something happened.
+type Counter struct {
+	s *scalar
+}
+
+// NewCounter makes a counter with the given label names. Counter names should end in _total.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newScalar("counter", name, help, labels)}
+}
+
+// Inc adds 1 to the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.s.add(1, values)
+}
+
+// Add adds v, which must not be negative, to the series with the given label values.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.s.name + " can't go down")
+	}
+	c.s.add(v, values)
+}
+
+// Gauge is a number that can go up and down, like how many of something there are right now.
+type Gauge struct {
+	s *scalar
+}
+
+// NewGauge makes a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newScalar("gauge", name, help, labels)}
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.s.set(v, values)
+}
+
+// Add adds v to the series with the given label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.s.add(v, values)
+}
+
+type gaugeFunc struct {
+	desc
+	f func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.f()))
+}
+
+// NewGaugeFunc makes a gauge whose value comes from calling f each time the metrics are read.
+func NewGaugeFunc(name, help string, f func() float64) {
+	register(name, &gaugeFunc{desc{name, help, nil}, f})
+}
+
+// DurationBuckets suit how long commands and requests take, in seconds.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histSeries struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations, like durations, in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histSeries
+}
+
+// NewHistogram makes a histogram with the given upper bounds, which must be sorted, and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, series: make(map[string]*histSeries)}
+	register(name, h)
+	return h
+}
+
+// Observe records v in the series with the given label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	k := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	x := h.series[k]
+	if x == nil {
+		x = &histSeries{values: slices.Clone(values), counts: make([]uint64, len(h.buckets))}
+		h.series[k] = x
+	}
+	i, _ := slices.BinarySearch(h.buckets, v)
+	if i < len(x.counts) {
+		x.counts[i]++
+	}
+	x.sum += v
+	x.count++
+}
+
+// ObserveDuration records d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration, values ...string) {
+	h.Observe(d.Seconds(), values...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, k := range sortedKeys(h.series) {
+		x := h.series[k]
+		var total uint64
+		for i, b := range h.buckets {
+			total += x.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(x.values, "le", formatFloat(b)), total)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(x.values, "le", "+Inf"), x.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(x.values), formatFloat(x.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(x.values), x.count)
+	}
+}
+
+var startTime = time.Now()
+
+// runtimeStats reports on the Go runtime, reading the memory stats once for all of them.
+type runtimeStats struct{}
+
+func (runtimeStats) write(w *bufio.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+	}
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	gauge("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", float64(mem.HeapAlloc))
+	gauge("go_memstats_heap_objects", "Number of allocated objects.", float64(mem.HeapObjects))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from the OS.", float64(mem.Sys))
+	gauge("go_memstats_next_gc_bytes", "Heap size at which the next garbage collection will happen.", float64(mem.NextGC))
+	fmt.Fprintf(w, "# HELP go_gc_cycles_total Number of completed garbage collection cycles.\n# TYPE go_gc_cycles_total counter\ngo_gc_cycles_total %d\n", mem.NumGC)
+	fmt.Fprintf(w, "# HELP go_gc_pause_seconds_total Time spent paused for garbage collection.\n# TYPE go_gc_pause_seconds_total counter\ngo_gc_pause_seconds_total %s\n", formatFloat(float64(mem.PauseTotalNs)/1e9))
+	gauge("process_start_time_seconds", "Start time of the process since the Unix epoch in seconds.", float64(startTime.Unix()))
+}
+
+func init() {
+	register("go_", runtimeStats{})
+}
+
+// Write writes every metric in the Prometheus text format.
+func Write(out io.Writer) error {
+	registryLock.Lock()
+	names := sortedKeys(registry)
+	ms := make([]metric, len(names))
+	for i, k := range names {
+		ms[i] = registry[k]
+	}
+	registryLock.Unlock()
+	w := bufio.NewWriter(out)
+	for _, m := range ms {
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+// Handler serves the metrics to Prometheus.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package metrics
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func written(m metric) string {
+	b := new(strings.Builder)
+	w := bufio.NewWriter(b)
+	m.write(w)
+	w.Flush()
+	return b.String()
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "How long\nit took, in \\seconds.", []float64{0.5, 1, 5}, "command")
+	// A value equal to a bound counts in that bucket
+	h.Observe(0.5, "a\"b\\c\n")
+	h.Observe(0.75, "a\"b\\c\n")
+	h.Observe(1, "a\"b\\c\n")
+	h.Observe(7, "a\"b\\c\n")
+	h.Observe(0.25, "ping")
+
+	want := `# HELP test_duration_seconds How long\nit took, in \\seconds.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{command="a\"b\\c\n",le="0.5"} 1
+test_duration_seconds_bucket{command="a\"b\\c\n",le="1"} 3
+test_duration_seconds_bucket{command="a\"b\\c\n",le="5"} 3
+test_duration_seconds_bucket{command="a\"b\\c\n",le="+Inf"} 4
+test_duration_seconds_sum{command="a\"b\\c\n"} 9.25
+test_duration_seconds_count{command="a\"b\\c\n"} 4
+test_duration_seconds_bucket{command="ping",le="0.5"} 1
+test_duration_seconds_bucket{command="ping",le="1"} 1
+test_duration_seconds_bucket{command="ping",le="5"} 1
+test_duration_seconds_bucket{command="ping",le="+Inf"} 1
+test_duration_seconds_sum{command="ping"} 0.25
+test_duration_seconds_count{command="ping"} 1
+`
+	if got := written(h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramWriteNoLabels(t *testing.T) {
+	h := NewHistogram("test_size_bytes", "Sizes.", []float64{1, 10})
+	h.Observe(1)
+	h.Observe(20)
+
+	want := `# HELP test_size_bytes Sizes.
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{le="1"} 1
+test_size_bytes_bucket{le="10"} 1
+test_size_bytes_bucket{le="+Inf"} 2
+test_size_bytes_sum 21
+test_size_bytes_count 2
+`
+	if got := written(h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestScalarWrite(t *testing.T) {
+	c := NewCounter("test_events_total", "Events.")
+	g := NewGauge("test_queue_length", "Queue length.", "queue", "shard")
+	g.Set(3, "b", "1")
+	g.Set(2, "a", "2")
+	g.Add(-0.5, "a", "2")
+
+	want := `# HELP test_events_total Events.
+# TYPE test_events_total counter
+test_events_total 0
+`
+	if got := written(c.s); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	want = `# HELP test_queue_length Queue length.
+# TYPE test_queue_length gauge
+test_queue_length{queue="a",shard="2"} 1.5
+test_queue_length{queue="b",shard="1"} 3
+`
+	if got := written(g.s); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
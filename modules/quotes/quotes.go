@@ -19,20 +19,30 @@ package quotes
 
 import (
 	"database/sql"
+	"embed"
 	"fmt"
 	"math/rand"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"jlortiz.org/jlort2/modules/commands"
-	"jlortiz.org/jlort2/modules/log"
 )
 
 const quotes_max = 200
 const quotes_paginate_amount = 10
 
-var queryGetLen, queryGetInd *sql.Stmt
+var queryGetLen, queryGetInd, querySearch *sql.Stmt
+
+//go:embed locales/*.json
+var catalog embed.FS
+
+type quoteRoll struct {
+	Index int
+}
+
+var rollState = commands.NewStateCodec[quoteRoll]("quote", 1)
 
 // ~!quote [index]
 // @GuildOnly
@@ -50,19 +60,25 @@ func quote(ctx *commands.Context) error {
 	var total int
 	result.Scan(&total)
 	if total == 0 {
-		return ctx.RespondPrivate("There are no quotes. Use /addquote to add some.")
+		return ctx.RespondPrivate(ctx.T("quotes.none"))
+	}
+	var args struct {
+		Index *int `option:"index"`
+	}
+	err = ctx.Bind(&args)
+	if err != nil {
+		return err
 	}
 	var sel int
-	args := ctx.ApplicationCommandData().Options
-	if len(args) > 0 {
-		sel = int(args[0].IntValue())
+	if args.Index != nil {
+		sel = *args.Index
 		if sel < 1 || sel > total {
-			return ctx.RespondPrivate("Index out of bounds, expected 1-" + strconv.Itoa(total))
+			return ctx.RespondPrivate(ctx.T("quotes.outOfBounds", total))
 		}
 	} else {
 		sel = rand.Intn(total) + 1
 	}
-	ctx.SetComponents(discordgo.Button{Emoji: &discordgo.ComponentEmoji{Name: "\U0001f3b2"}, CustomID: strconv.Itoa(sel)})
+	ctx.SetComponents(discordgo.Button{Emoji: &discordgo.ComponentEmoji{Name: "\U0001f3b2"}, CustomID: rollState.Encode(ctx, quoteRoll{sel})})
 	result = tx.Stmt(queryGetInd).QueryRow(gid, sel)
 	var q string
 	result.Scan(&q)
@@ -70,6 +86,10 @@ func quote(ctx *commands.Context) error {
 }
 
 func quoteReroll(ctx *commands.Context) error {
+	prev, err := rollState.Decode(ctx)
+	if err != nil {
+		return err
+	}
 	tx, err := ctx.Database.Begin()
 	if err != nil {
 		return err
@@ -80,9 +100,9 @@ func quoteReroll(ctx *commands.Context) error {
 	var total int
 	result.Scan(&total)
 	if total == 0 {
-		return ctx.RespondPrivate("There are no quotes. Use /addquote to add some.")
+		return ctx.RespondPrivate(ctx.T("quotes.none"))
 	}
-	sel2, _ := strconv.Atoi(ctx.MessageComponentData().CustomID)
+	sel2 := prev.Index
 	if total == 1 && sel2 == 1 {
 		return ctx.RespondEmpty()
 	}
@@ -90,7 +110,7 @@ func quoteReroll(ctx *commands.Context) error {
 	for sel == sel2 {
 		sel = rand.Intn(total) + 1
 	}
-	ctx.SetComponents(discordgo.Button{Emoji: &discordgo.ComponentEmoji{Name: "\U0001f3b2"}, CustomID: strconv.Itoa(sel)})
+	ctx.SetComponents(discordgo.Button{Emoji: &discordgo.ComponentEmoji{Name: "\U0001f3b2"}, CustomID: rollState.Encode(ctx, quoteRoll{sel})})
 	result = tx.Stmt(queryGetInd).QueryRow(gid, sel)
 	var q string
 	result.Scan(&q)
@@ -100,42 +120,30 @@ func quoteReroll(ctx *commands.Context) error {
 // ~!quotes
 // @GuildOnly
 // Gets all quotes
-func quotes(ctx *commands.Context) error {
-	var ind int
-	if ctx.Type == discordgo.InteractionMessageComponent {
-		cid := ctx.MessageComponentData().CustomID
-		ind, _ = strconv.Atoi(cid[1:])
-		if cid[0] == 'r' {
-			ind += quotes_paginate_amount
-		} else {
-			ind -= quotes_paginate_amount
-		}
-	}
+var quotes = &commands.Paginator{PageSize: quotes_paginate_amount, Fetch: quotesPage, Empty: "quotes.none"}
+
+func quotesPage(ctx *commands.Context, offset, limit int) (*discordgo.MessageEmbed, int, error) {
 	tx, err := ctx.Database.Begin()
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer tx.Rollback()
 	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
 	result := tx.Stmt(queryGetLen).QueryRow(gid)
 	var total int
 	result.Scan(&total)
-	if total == 0 {
-		return ctx.RespondPrivate("There are no quotes. Use /addquote to add some.")
-	}
-	if ind >= total {
-		ind = total - quotes_paginate_amount
-	} else if ind < 0 {
-		ind = 0
+	if total == 0 || offset >= total {
+		return nil, total, nil
 	}
 	guild, err := ctx.State.Guild(ctx.GuildID)
 	if err != nil {
-		return fmt.Errorf("failed to get guild: %w", err)
+		return nil, 0, fmt.Errorf("failed to get guild: %w", err)
 	}
-	results, err := tx.Query("SELECT ind, quote FROM quotes WHERE gid=?001 ORDER BY ind LIMIT ?002 OFFSET ?003;", gid, quotes_paginate_amount, ind)
+	results, err := tx.Query("SELECT ind, quote FROM quotes WHERE gid=?001 ORDER BY ind LIMIT ?002 OFFSET ?003;", gid, limit, offset)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
+	defer results.Close()
 	builder := new(strings.Builder)
 	var i int
 	var v string
@@ -150,27 +158,63 @@ func quotes(ctx *commands.Context) error {
 	output.Title = "Quotes from " + guild.Name
 	output.Description = builder.String()[:builder.Len()-1]
 	output.Color = 0x7289da
-	if total > quotes_paginate_amount {
-		ctx.SetComponents(discordgo.Button{CustomID: "l" + strconv.Itoa(ind), Disabled: ind == 0, Emoji: &discordgo.ComponentEmoji{Name: "\u2B05"}, Style: discordgo.SecondaryButton},
-			discordgo.Button{CustomID: "r" + strconv.Itoa(ind), Emoji: &discordgo.ComponentEmoji{Name: "\u27A1"}, Disabled: total <= ind+quotes_paginate_amount, Style: discordgo.SecondaryButton})
-	}
-	err = ctx.RespondEmbed(output, false)
-	return err
+	return output, total, nil
 }
 
-// ~!addquote <quote>
+// ~!addquote [quote]
 // @GuildOnly
 // Adds a quote
+// If the quote is left out, a form pops up so it can span multiple lines.
 func addquote(ctx *commands.Context) error {
+	var args struct {
+		Quote string `option:"quote"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	if args.Quote == "" {
+		return ctx.RespondModal(ctx.T("quotes.modalTitle"), discordgo.TextInput{CustomID: "quote", Label: ctx.T("quotes.modalLabel"), Style: discordgo.TextInputParagraph, Required: true, MaxLength: 512})
+	}
+	return insertQuote(ctx, args.Quote)
+}
+
+func addquoteModal(ctx *commands.Context) error {
+	return insertQuote(ctx, ctx.ModalValue("quote"))
+}
+
+func insertQuote(ctx *commands.Context, q string) error {
 	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
 	result := queryGetLen.QueryRow(gid)
 	var total int
 	result.Scan(&total)
 	if total >= quotes_max {
-		return ctx.RespondPrivate("Maximum number of quotes reached.")
+		return ctx.RespondPrivate(ctx.T("quotes.full"))
+	}
+	ctx.Database.Exec("INSERT INTO quotes (gid, ind, quote) SELECT ?001, COUNT(*) + 1, ?002 FROM quotes WHERE gid=?001;", gid, q)
+	return ctx.RespondPrivate(ctx.T("quotes.added"))
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// quoteAuto suggests quotes whose text or number contains what has been typed.
+func quoteAuto(ctx *commands.Context) []*discordgo.ApplicationCommandOptionChoice {
+	_, typed := ctx.Focused()
+	gid, _ := strconv.ParseUint(ctx.GuildID, 10, 64)
+	rows, err := querySearch.Query(gid, likeEscaper.Replace(typed))
+	if err != nil {
+		return nil
 	}
-	ctx.Database.Exec("INSERT INTO quotes (gid, ind, quote) SELECT ?001, COUNT(*) + 1, ?002 FROM quotes WHERE gid=?001;", gid, ctx.ApplicationCommandData().Options[0].StringValue())
-	return ctx.RespondPrivate("Quote added.")
+	defer rows.Close()
+	var out []*discordgo.ApplicationCommandOptionChoice
+	for rows.Next() {
+		var ind int
+		var q string
+		rows.Scan(&ind, &q)
+		q = strings.ReplaceAll(q, "\n", " ")
+		out = append(out, &discordgo.ApplicationCommandOptionChoice{Name: commands.ChoiceName(strconv.Itoa(ind) + ". " + q), Value: ind})
+	}
+	return out
 }
 
 // ~!delquote <index>
@@ -186,26 +230,29 @@ func delquote(ctx *commands.Context) error {
 	var total int
 	result.Scan(&total)
 	if total == 0 {
-		return ctx.RespondPrivate("There are no quotes. Use /addquote to add some.")
+		return ctx.RespondPrivate(ctx.T("quotes.none"))
+	}
+	var args struct {
+		Index int `option:"index,required"`
 	}
-	sel := int(ctx.ApplicationCommandData().Options[0].IntValue())
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	sel := args.Index
 	if sel < 0 {
-		perms, err := ctx.State.UserChannelPermissions(ctx.User.ID, ctx.ChannelID)
-		if err != nil {
-			return fmt.Errorf("failed to get permissions: %w", err)
-		}
-		if perms&discordgo.PermissionManageMessages == 0 {
-			return ctx.RespondPrivate("You need the Manage Messages permission to clear all quotes.")
+		if !ctx.HasPermission(discordgo.PermissionManageMessages) {
+			return ctx.RespondPrivate(ctx.T("quotes.needPerms"))
 		}
 		ctx.Database.Exec("DELETE FROM quotes WHERE gid=?001;", gid)
-		return ctx.RespondPrivate("All quotes removed.")
+		return ctx.RespondPrivate(ctx.T("quotes.cleared"))
 	}
 	if sel == 0 || sel > total {
-		return ctx.RespondPrivate("Index out of bounds, expected 1-" + strconv.Itoa(total))
+		return ctx.RespondPrivate(ctx.T("quotes.outOfBounds", total))
 	}
 	if sel == total {
 		ctx.Database.Exec("DELETE FROM quotes WHERE gid = ?001 AND ind = ?002;", gid, sel)
-		return ctx.RespondPrivate("Quote removed.")
+		return ctx.RespondPrivate(ctx.T("quotes.removed"))
 	}
 	tx, err := ctx.Database.Begin()
 	if err != nil {
@@ -222,7 +269,7 @@ func delquote(ctx *commands.Context) error {
 		return err
 	}
 	tx.Commit()
-	return ctx.RespondPrivate("Quote removed.")
+	return ctx.RespondPrivate(ctx.T("quotes.removed"))
 }
 
 func guildDelete(_ *discordgo.Session, event *discordgo.GuildDelete) {
@@ -232,36 +279,70 @@ func guildDelete(_ *discordgo.Session, event *discordgo.GuildDelete) {
 	}
 }
 
-// Init is defined in the command interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
-// Here, it also loads the quotes from disk.
-func Init(self *discordgo.Session) {
-	commands.PrepareCommand("quote", "Hopefully it's actually funny").Guild().Component(quoteReroll).Register(quote, []*discordgo.ApplicationCommandOption{
-		commands.NewCommandOption("index", "Index of quote to show, default random").AsInt().SetMinMax(1, quotes_max).Finalize(),
+type module struct{}
+
+func init() {
+	commands.RegisterModule(module{})
+}
+
+func (module) Name() string {
+	return "quotes"
+}
+
+func (module) Deps() []string {
+	return []string{"commands"}
+}
+
+// Init is defined in the Module interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
+func (module) Init(self commands.Session) error {
+	err := commands.LoadCatalog(catalog)
+	if err != nil {
+		return err
+	}
+	commands.PrepareCommand("quote", "Hopefully it's actually funny").Guild().
+		Localize(discordgo.SpanishES, "cita", "Ojalá que sea graciosa").Localize(discordgo.German, "zitat", "Hoffentlich ist es wirklich lustig").Cooldown(commands.CooldownUser, 3*time.Second, 5).Component(quoteReroll).AutoOption("index", quoteAuto).Register(quote, []*discordgo.ApplicationCommandOption{
+		commands.NewCommandOption("index", "Index of quote to show, default random").AsInt().
+			Localize(discordgo.SpanishES, "indice", "Número de la cita, al azar si se omite").Localize(discordgo.German, "index", "Nummer des Zitats, sonst zufällig").SetMinMax(1, quotes_max).Finalize(),
 	})
-	commands.PrepareCommand("quotes", "Show all quotes").Guild().Component(quotes).Register(quotes, nil)
-	commands.PrepareCommand("addquote", "Record that dumb thing your friend just said").Guild().Register(addquote, []*discordgo.ApplicationCommandOption{
-		commands.NewCommandOption("quote", "The thing, the funny thing").AsString().Required().Finalize(),
+	commands.PrepareCommand("quotes", "Show all quotes").Guild().
+		Localize(discordgo.SpanishES, "citas", "Muestra todas las citas").Localize(discordgo.German, "zitate", "Zeigt alle Zitate").Component(quotes.Respond).Register(quotes.Respond, nil)
+	commands.PrepareCommand("addquote", "Record that dumb thing your friend just said").Guild().
+		Localize(discordgo.SpanishES, "agregarcita", "Guarda esa tontería que acaba de decir tu amigo").Localize(discordgo.German, "zitathinzufügen", "Halte den Unsinn fest, den dein Freund gerade gesagt hat").Modal(addquoteModal).Register(addquote, []*discordgo.ApplicationCommandOption{
+		commands.NewCommandOption("quote", "The thing, the funny thing, leave out to type several lines").AsString().
+			Localize(discordgo.SpanishES, "cita", "Lo gracioso, omítelo para escribir varias líneas").Localize(discordgo.German, "zitat", "Das Lustige, weglassen um mehrere Zeilen zu schreiben").Finalize(),
 	})
-	commands.PrepareCommand("delquote", "Guess it wasn't funny").Guild().Register(delquote, []*discordgo.ApplicationCommandOption{
-		commands.NewCommandOption("index", "Index of quote to remove").AsInt().SetMinMax(1, quotes_max).Required().Finalize(),
+	commands.PrepareCommand("delquote", "Guess it wasn't funny").Guild().Alias("rmquote", "removequote").
+		Localize(discordgo.SpanishES, "borrarcita", "Parece que no era graciosa").Localize(discordgo.German, "zitatlöschen", "War wohl doch nicht lustig").AutoOption("index", quoteAuto).Register(delquote, []*discordgo.ApplicationCommandOption{
+		commands.NewCommandOption("index", "Index of quote to remove").AsInt().
+			Localize(discordgo.SpanishES, "indice", "Número de la cita a borrar").Localize(discordgo.German, "index", "Nummer des zu löschenden Zitats").SetMinMax(1, quotes_max).Required().Finalize(),
 	})
 	self.AddHandler(guildDelete)
 	db := commands.GetDatabase()
-	var err error
 	queryGetLen, err = db.Prepare("SELECT COUNT(*) FROM quotes WHERE gid=?001;")
 	if err != nil {
-		log.Error(err)
-		return
+		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	queryGetInd, err = db.Prepare("SELECT quote FROM quotes WHERE gid=?001 AND ind=?002;")
 	if err != nil {
-		log.Error(err)
+		queryGetLen.Close()
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	querySearch, err = db.Prepare(`SELECT ind, quote FROM quotes WHERE gid=?001 AND (quote LIKE '%' || ?002 || '%' ESCAPE '\' OR CAST(ind AS TEXT) LIKE ?002 || '%' ESCAPE '\') ORDER BY ind LIMIT 25;`)
+	if err != nil {
+		queryGetLen.Close()
+		queryGetInd.Close()
+		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
+	return nil
 }
 
-// Cleanup is defined in the command interface to clean up the module when the bot unloads.
-// Here, it saves the quotes to disk.
-func Cleanup(_ *discordgo.Session) {
+// Cleanup is defined in the Module interface to clean up the module when the bot unloads.
+func (module) Cleanup(_ commands.Session) {
 	queryGetLen.Close()
 	queryGetInd.Close()
+	querySearch.Close()
+}
+
+func (module) Health() error {
+	return nil
 }
@@ -0,0 +1,206 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package quotes
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/commands/fake"
+)
+
+var bot *fake.Session
+var owner = &discordgo.User{ID: "1", Username: "owner"}
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "quotes-test-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "persistent.db")
+	schema, err := os.ReadFile("../../dbGen.sql")
+	if err != nil {
+		panic(err)
+	}
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec(string(schema))
+	db.Close()
+	if err != nil {
+		panic(err)
+	}
+	commands.SetDatabaseFile(dbFile)
+	bot = fake.New(owner)
+	err = commands.StartModules(bot)
+	if err != nil {
+		panic(err)
+	}
+	defer commands.StopModules(bot)
+	return m.Run()
+}
+
+// newGuild adds a guild with one text channel, so that each test starts with no quotes.
+func newGuild(t *testing.T) (guildID, channelID string) {
+	guildID, channelID = bot.NewID(), bot.NewID()
+	bot.AddGuild(&discordgo.Guild{
+		ID:       guildID,
+		Name:     t.Name(),
+		Channels: []*discordgo.Channel{{ID: channelID, Name: "general", Type: discordgo.ChannelTypeGuildText}},
+		Members:  []*discordgo.Member{{User: owner}},
+	})
+	return guildID, channelID
+}
+
+func mustRun(t *testing.T, i *discordgo.Interaction) *fake.Response {
+	t.Helper()
+	err := bot.Run(i)
+	if err != nil {
+		t.Fatalf("%s: %v", i.ID, err)
+	}
+	resp := bot.LastResponse()
+	if resp == nil || resp.Interaction != i {
+		t.Fatal("no response")
+	}
+	return resp
+}
+
+func storedQuotes(t *testing.T, guildID string) []string {
+	t.Helper()
+	gid, _ := strconv.ParseUint(guildID, 10, 64)
+	rows, err := commands.GetDatabase().Query("SELECT ind, quote FROM quotes WHERE gid=?001 ORDER BY ind;", gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var ind int
+		var q string
+		rows.Scan(&ind, &q)
+		if ind != len(out)+1 {
+			t.Fatalf("quote %q has index %d, expected %d", q, ind, len(out)+1)
+		}
+		out = append(out, q)
+	}
+	return out
+}
+
+func TestAddQuoteThenQuote(t *testing.T) {
+	gid, cid := newGuild(t)
+	resp := mustRun(t, bot.Command(owner, gid, cid, "quote"))
+	if resp.Data.Content != "There are no quotes. Use /addquote to add some." || resp.Data.Flags&discordgo.MessageFlagsEphemeral == 0 {
+		t.Errorf("empty quote: %q, flags %d", resp.Data.Content, resp.Data.Flags)
+	}
+
+	for _, q := range []string{"first", "second"} {
+		resp = mustRun(t, bot.Command(owner, gid, cid, "addquote", fake.Option("quote", q)))
+		if resp.Data.Content != "Quote added." {
+			t.Errorf("addquote %s: %q", q, resp.Data.Content)
+		}
+	}
+	if got := storedQuotes(t, gid); len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Fatalf("stored %q", got)
+	}
+
+	i := bot.Command(owner, gid, cid, "quote", fake.Option("index", 2))
+	resp = mustRun(t, i)
+	if resp.Data.Content != "2. second" {
+		t.Errorf("quote 2: %q", resp.Data.Content)
+	}
+	resp = mustRun(t, bot.Command(owner, gid, cid, "quote", fake.Option("index", 3)))
+	if resp.Data.Content != "Index out of bounds, expected 1-2" {
+		t.Errorf("quote 3: %q", resp.Data.Content)
+	}
+}
+
+func TestReroll(t *testing.T) {
+	gid, cid := newGuild(t)
+	for _, q := range []string{"first", "second"} {
+		mustRun(t, bot.Command(owner, gid, cid, "addquote", fake.Option("quote", q)))
+	}
+	i := bot.Command(owner, gid, cid, "quote", fake.Option("index", 1))
+	mustRun(t, i)
+	msg := bot.Reply(i)
+	buttons := fake.Buttons(msg)
+	if len(buttons) != 1 {
+		t.Fatalf("expected a reroll button, got %d buttons", len(buttons))
+	}
+	// With two quotes, a reroll from the first has to land on the second
+	resp := mustRun(t, bot.Press(owner, msg, buttons[0].CustomID))
+	if resp.Type != discordgo.InteractionResponseUpdateMessage || resp.Data.Content != "2. second" {
+		t.Errorf("reroll: type %d, %q", resp.Type, resp.Data.Content)
+	}
+	if msg.Content != "2. second" {
+		t.Errorf("message not updated: %q", msg.Content)
+	}
+	resp = mustRun(t, bot.Press(owner, msg, fake.Buttons(msg)[0].CustomID))
+	if resp.Data.Content != "1. first" {
+		t.Errorf("second reroll: %q", resp.Data.Content)
+	}
+
+	_, err := rollState.Decode(commands.MakeContext(bot, bot.Press(owner, msg, "quote\atampered")))
+	if err == nil {
+		t.Error("tampered state was accepted")
+	}
+}
+
+func TestAddQuoteModal(t *testing.T) {
+	gid, cid := newGuild(t)
+	resp := mustRun(t, bot.Command(owner, gid, cid, "addquote"))
+	if resp.Type != discordgo.InteractionResponseModal {
+		t.Fatalf("expected a modal, got type %d", resp.Type)
+	}
+	resp = mustRun(t, bot.Submit(owner, gid, cid, resp.Data.CustomID, map[string]string{"quote": "line one\nline two"}))
+	if resp.Data.Content != "Quote added." {
+		t.Errorf("submit: %q", resp.Data.Content)
+	}
+	if got := storedQuotes(t, gid); len(got) != 1 || got[0] != "line one\nline two" {
+		t.Errorf("stored %q", got)
+	}
+}
+
+func TestDelQuoteRenumbers(t *testing.T) {
+	gid, cid := newGuild(t)
+	for _, q := range []string{"a", "b", "c"} {
+		mustRun(t, bot.Command(owner, gid, cid, "addquote", fake.Option("quote", q)))
+	}
+	resp := mustRun(t, bot.Command(owner, gid, cid, "delquote", fake.Option("index", 2)))
+	if resp.Data.Content != "Quote removed." {
+		t.Errorf("delquote: %q", resp.Data.Content)
+	}
+	// storedQuotes checks that the indices have no gap
+	if got := storedQuotes(t, gid); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Errorf("stored %q", got)
+	}
+	resp = mustRun(t, bot.Command(owner, gid, cid, "quote", fake.Option("index", 2)))
+	if resp.Data.Content != "2. c" {
+		t.Errorf("quote 2 after delete: %q", resp.Data.Content)
+	}
+}
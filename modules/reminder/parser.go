@@ -5,6 +5,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"jlortiz.org/jlort2/modules/clock"
 )
 
 var regRel = regexp.MustCompile(`(\d+) ?(m[io]?|[dhwy])[a-z]*`)
@@ -12,7 +14,7 @@ var regAbs = regexp.MustCompile(`^(?:([a-z]{3,}) (\d+)(?:[thndrs]+)?)? ?(?:(\d\d
 
 func parseTime(s string, zone *time.Location) (t time.Time) {
 	s = strings.ToLower(s)
-	t = time.Now().In(zone)
+	t = clock.Now().In(zone)
 	match := regRel.FindAllStringSubmatch(s, -1)
 	if len(match) > 0 {
 		var acc int
@@ -127,7 +129,7 @@ func parseTime(s string, zone *time.Location) (t time.Time) {
 	}
 	if hour != -1 {
 		t = time.Date(t.Year(), t.Month(), t.Day(), hour, 0, 0, 0, t.Location())
-		if t.Before(time.Now()) {
+		if t.Before(clock.Now()) {
 			t = t.AddDate(0, 0, 1)
 		}
 	}
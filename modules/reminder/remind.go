@@ -2,23 +2,40 @@ package reminder
 
 import (
 	"database/sql"
+	"embed"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
 	"jlortiz.org/jlort2/modules/commands"
 	"jlortiz.org/jlort2/modules/log"
+	"jlortiz.org/jlort2/modules/metrics"
 )
 
+//go:embed locales/*.json
+var catalog embed.FS
+
 var stmtIns, stmtSel, stmtSelU, stmtCount, stmtClean, stmtGetTz *sql.Stmt
 var channelCache map[string]string
 var runStopper chan struct{}
 
+// Closed when the runner has stopped
+var runDone chan struct{}
+
+var metricReminders = metrics.NewCounter("jlort_reminders_total", "Reminders that came due, by whether they were sent.", "result")
+
+// Set if the runner stopped on its own
+var runnerErr atomic.Pointer[error]
+
 const shortTsFormat = "Jan _2 3:04 PM"
 const tsFormat = shortTsFormat + " MST"
 const max_reminders_per_user = 32
+const reminders_paginate_amount = 10
 
 func loadTz(uid string) (*time.Location, bool, error) {
 	zone := time.Local
@@ -36,10 +53,29 @@ func loadTz(uid string) (*time.Location, bool, error) {
 }
 
 func remind(ctx *commands.Context) error {
-	when := ctx.ApplicationCommandData().Options[0].StringValue()
-	what := ctx.ApplicationCommandData().Options[1].StringValue()
+	var args struct {
+		When string `option:"when"`
+		What string `option:"what"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	if args.When == "" || args.What == "" {
+		return ctx.RespondModal(ctx.T("reminder.modalTitle"),
+			discordgo.TextInput{CustomID: "when", Label: ctx.T("reminder.when"), Style: discordgo.TextInputShort, Required: true, Value: args.When, Placeholder: "1d, 5h3m, 8pm, March 7th 5:55 AM"},
+			discordgo.TextInput{CustomID: "what", Label: ctx.T("reminder.what"), Style: discordgo.TextInputParagraph, Required: true, Value: args.What, MaxLength: 2000})
+	}
+	return setReminder(ctx, args.When, args.What)
+}
+
+func remindModal(ctx *commands.Context) error {
+	return setReminder(ctx, ctx.ModalValue("when"), ctx.ModalValue("what"))
+}
+
+func setReminder(ctx *commands.Context, when, what string) error {
 	if len(what) > 2000 {
-		return ctx.RespondPrivate("Reminder is too long, max 2000 chars")
+		return ctx.RespondPrivate(ctx.T("reminder.tooLong", 2000))
 	}
 	zone, hasZone, err := loadTz(ctx.Interaction.User.ID)
 	if err != nil {
@@ -48,47 +84,90 @@ func remind(ctx *commands.Context) error {
 	t := parseTime(when, zone)
 	if t.IsZero() {
 		log.Debug(when)
-		return ctx.RespondPrivate("Unable to parse time: " + when)
+		return ctx.RespondPrivate(ctx.T("reminder.badTime", when))
 	}
 	row := stmtCount.QueryRow(ctx.Interaction.User.ID)
 	var count int
 	row.Scan(&count)
 	if count >= max_reminders_per_user {
-		return ctx.RespondPrivate("Reached limit of " + strconv.Itoa(max_reminders_per_user) + " reminders")
+		return ctx.RespondPrivate(ctx.T("reminder.limit", max_reminders_per_user))
 	}
-	now := time.Now()
+	now := clock.Now()
 	stmtIns.Exec(t.In(time.Local), ctx.Interaction.User.ID, now, what)
-	msg := "I will remind you on " + t.Format(tsFormat) + ". To cancel, do /remindcancel " + strconv.Itoa(count+1)
+	msg := ctx.T("reminder.set", t.Format(tsFormat), count+1)
 	if !hasZone {
-		msg += "\nIf the above time zone is incorrect, use /settz to set it"
+		msg += "\n" + ctx.T("reminder.noZone")
 	}
 	return ctx.RespondPrivate(msg)
 }
 
 func remindcancel(ctx *commands.Context) error {
-	ind := ctx.ApplicationCommandData().Options[0].IntValue()
+	var args struct {
+		ID int `option:"id,required,min=1"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
 	row := stmtCount.QueryRow(ctx.User.ID)
 	var count int
 	row.Scan(&count)
-	if count < int(ind) {
-		return ctx.RespondPrivate("Index too large, expected < " + strconv.Itoa(count))
+	if count < args.ID {
+		return ctx.RespondPrivate(ctx.T("reminder.badIndex", count))
 	}
-	ctx.Database.Exec(`DELETE FROM reminders WHERE rowid IN (SELECT rowid FROM reminders WHERE uid = ?001 ORDER BY created ASC LIMIT 1 OFFSET ?002);`, ctx.User.ID, ind-1)
-	return ctx.RespondPrivate("Reminder has been removed.")
+	ctx.Database.Exec(`DELETE FROM reminders WHERE rowid IN (SELECT rowid FROM reminders WHERE uid = ?001 ORDER BY created ASC LIMIT 1 OFFSET ?002);`, ctx.User.ID, args.ID-1)
+	return ctx.RespondPrivate(ctx.T("reminder.removed"))
 }
 
-func reminders(ctx *commands.Context) error {
-	results, err := stmtSelU.Query(ctx.User.ID)
+// remindcancelAuto suggests the user's reminders, by number or by what they say.
+func remindcancelAuto(ctx *commands.Context) []*discordgo.ApplicationCommandOptionChoice {
+	_, typed := ctx.Focused()
+	typed = strings.ToLower(typed)
+	zone, _, err := loadTz(ctx.User.ID)
 	if err != nil {
-		return err
+		zone = time.Local
+	}
+	results, err := stmtSelU.Query(ctx.User.ID, max_reminders_per_user, 0)
+	if err != nil {
+		return nil
+	}
+	defer results.Close()
+	var out []*discordgo.ApplicationCommandOptionChoice
+	i := 0
+	var ts time.Time
+	var what string
+	for results.Next() {
+		i += 1
+		results.Scan(&ts, &what)
+		num := strconv.Itoa(i)
+		if typed != "" && !strings.HasPrefix(num, typed) && !strings.Contains(strings.ToLower(what), typed) {
+			continue
+		}
+		name := num + ts.In(zone).Format(". ["+shortTsFormat+"] ") + strings.ReplaceAll(what, "\n", " ")
+		out = append(out, &discordgo.ApplicationCommandOptionChoice{Name: commands.ChoiceName(name), Value: i})
+	}
+	return out
+}
+
+var reminders = &commands.Paginator{PageSize: reminders_paginate_amount, Fetch: remindersPage, Empty: "reminder.none", Private: true}
+
+func remindersPage(ctx *commands.Context, offset, limit int) (*discordgo.MessageEmbed, int, error) {
+	var total int
+	err := stmtCount.QueryRow(ctx.User.ID).Scan(&total)
+	if err != nil || total == 0 {
+		return nil, total, err
+	}
+	results, err := stmtSelU.Query(ctx.User.ID, limit, offset)
+	if err != nil {
+		return nil, 0, err
 	}
 	defer results.Close()
-	zone, _, err := loadTz(ctx.Interaction.User.ID)
+	zone, _, err := loadTz(ctx.User.ID)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	builder := new(strings.Builder)
-	var i int
+	i := offset
 	var ts time.Time
 	var what string
 	for results.Next() {
@@ -99,21 +178,25 @@ func reminders(ctx *commands.Context) error {
 		builder.WriteString(what)
 		builder.WriteByte('\n')
 	}
-	if builder.Len() == 0 {
-		return ctx.RespondPrivate("You have no reminders.")
-	}
 	output := new(discordgo.MessageEmbed)
-	output.Title = "Reminders"
-	output.Description = builder.String()[:builder.Len()-1]
+	output.Title = ctx.T("reminder.title")
+	output.Description = strings.TrimSuffix(builder.String(), "\n")
 	output.Color = 0x7289da
-	return ctx.RespondEmbed(output, true)
+	return output, total, nil
 }
 
 func settz(ctx *commands.Context) error {
-	where := strings.ToUpper(ctx.ApplicationCommandData().Options[0].StringValue())
+	var args struct {
+		Zone string `option:"zone,required"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	where := strings.ToUpper(args.Zone)
 	zoneS, ok := timezones[where]
 	if !ok {
-		return ctx.RespondPrivate("Time zone not recognized, use the abbrevation (GMT, PST, NZT, etc)")
+		return ctx.RespondPrivate(ctx.T("reminder.badZone"))
 	}
 	zone, err := time.LoadLocation(zoneS)
 	if err != nil {
@@ -124,101 +207,206 @@ func settz(ctx *commands.Context) error {
 	row.Scan(&rCount)
 	var suffix string
 	if rCount != 0 {
-		suffix = "\nCheck existing reminders with /reminders to ensure that the times are stil correct."
+		suffix = "\n" + ctx.T("reminder.checkTimes")
 	}
 	ctx.Database.Exec("INSERT OR REPLACE INTO userTz (uid, tz) VALUES (?001, ?002);", ctx.Interaction.User.ID, zoneS)
 	if where == zoneS {
-		return ctx.RespondPrivate("Set timezone to " + where + suffix)
+		return ctx.RespondPrivate(ctx.T("reminder.zoneSet", where) + suffix)
 	}
-	return ctx.RespondPrivate("Set timezone to " + where + ", aka " + zone.String() + suffix)
+	return ctx.RespondPrivate(ctx.T("reminder.zoneSetAka", where, zone.String()) + suffix)
 }
 
-func runner(self *discordgo.Session, stopper <-chan struct{}) {
-	timer := time.NewTicker(time.Minute)
-	var t time.Time
+// settzAuto suggests abbreviations that start with what has been typed, then ones whose zone name contains it.
+func settzAuto(ctx *commands.Context) []*discordgo.ApplicationCommandOptionChoice {
+	_, typed := ctx.Focused()
+	upper := strings.ToUpper(typed)
+	lower := strings.ToLower(typed)
+	var names, others []string
+	for k, v := range timezones {
+		if strings.HasPrefix(k, upper) {
+			names = append(names, k)
+		} else if strings.Contains(strings.ToLower(v), lower) {
+			others = append(others, k)
+		}
+	}
+	slices.Sort(names)
+	slices.Sort(others)
+	names = append(names, others...)
+	out := make([]*discordgo.ApplicationCommandOptionChoice, len(names))
+	for i, k := range names {
+		name := k
+		if timezones[k] != k {
+			name += " (" + timezones[k] + ")"
+		}
+		out[i] = &discordgo.ApplicationCommandOptionChoice{Name: name, Value: k}
+	}
+	return out
+}
+
+func runner(self commands.Session, stopper <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	tick := make(chan time.Time, 1)
 	for {
+		// Not a ticker, so that a replay's clock can move it along
+		timer := clock.AfterFunc(time.Minute, func() { tick <- clock.Now() })
+		var t time.Time
 		select {
-		case t = <-timer.C:
+		case t = <-tick:
 		case <-stopper:
+			timer.Stop()
 			return
 		}
-		rows, err := stmtSel.Query(t)
+		workDone, ok := commands.Track()
+		if !ok {
+			// Shutting down, these stay in the table until the next start
+			continue
+		}
+		err := sendDue(self, t)
+		workDone()
 		if err != nil {
-			log.Error(fmt.Errorf("failed to query reminder table: %w", err))
+			log.Error(err)
+			runnerErr.Store(&err)
 			return
 		}
-		defer rows.Close()
-		empty := true
-		var uid, what string
-		var created time.Time
-		var tzS string
-		for rows.Next() {
-			empty = false
-			tz := time.Local
-			rows.Scan(&uid, &created, &what, &tzS)
-			if tzS != "" {
-				tz, err = time.LoadLocation(tzS)
-				if err != nil {
-					tz = time.Local
-				}
-			}
-			chanId, ok := channelCache[uid]
-			if ok && chanId == "0" {
-				// we previously failed to create this channel, skip this one
-				continue
-			} else if !ok {
-				channel, err := self.UserChannelCreate(uid)
-				if err != nil {
-					log.Error(fmt.Errorf("failed to create dm channel: %w", err))
-					channelCache[uid] = "0"
-					continue
-				}
-				channelCache[uid] = channel.ID
-				chanId = channel.ID
+	}
+}
+
+// sendDue sends every reminder that is due by t and removes them.
+func sendDue(self commands.Session, t time.Time) error {
+	rows, err := stmtSel.Query(t)
+	if err != nil {
+		return fmt.Errorf("failed to query reminder table: %w", err)
+	}
+	empty := true
+	var uid, what string
+	var created time.Time
+	var tzS string
+	for rows.Next() {
+		empty = false
+		tz := time.Local
+		rows.Scan(&uid, &created, &what, &tzS)
+		if tzS != "" {
+			tz, err = time.LoadLocation(tzS)
+			if err != nil {
+				tz = time.Local
 			}
-			_, err = self.ChannelMessageSend(chanId, "A reminder for you, from "+created.In(tz).Format(shortTsFormat)+":\n\n"+what)
+		}
+		chanId, ok := channelCache[uid]
+		if ok && chanId == "0" {
+			// we previously failed to create this channel, skip this one
+			metricReminders.Inc("failed")
+			continue
+		} else if !ok {
+			channel, err := self.UserChannelCreate(uid)
 			if err != nil {
-				log.Error(fmt.Errorf("failed to send message: %w", err))
+				log.Error(fmt.Errorf("failed to create dm channel: %w", err))
 				channelCache[uid] = "0"
+				metricReminders.Inc("failed")
+				continue
 			}
+			channelCache[uid] = channel.ID
+			chanId = channel.ID
 		}
-		if !empty {
-			stmtClean.Exec(t)
+		// Reminders are sent long after the command, so there's no locale to go by
+		_, err = self.ChannelMessageSend(chanId, commands.Translate("", "reminder.due", created.In(tz).Format(shortTsFormat), what))
+		if err != nil {
+			log.Error(fmt.Errorf("failed to send message: %w", err))
+			channelCache[uid] = "0"
+			metricReminders.Inc("failed")
+		} else {
+			metricReminders.Inc("sent")
 		}
 	}
+	rows.Close()
+	if !empty {
+		stmtClean.Exec(t)
+	}
+	return nil
 }
 
-func Init(self *discordgo.Session) {
-	stmtIns, _ = commands.GetDatabase().Prepare(`INSERT INTO reminders (ts, uid, created, what) VALUES (?001, ?002, ?003, ?004);`)
-	stmtCount, _ = commands.GetDatabase().Prepare(`SELECT COUNT(*) FROM reminders WHERE uid = ?001;`)
-	stmtSel, _ = commands.GetDatabase().Prepare(`SELECT reminders.uid, reminders.created, reminders.what, userTz.tz
+type module struct{}
+
+func init() {
+	commands.RegisterModule(module{})
+}
+
+func (module) Name() string {
+	return "reminder"
+}
+
+func (module) Deps() []string {
+	return []string{"commands"}
+}
+
+func (module) Init(self commands.Session) error {
+	err := commands.LoadCatalog(catalog)
+	if err != nil {
+		return err
+	}
+	stmts := []struct {
+		dest  **sql.Stmt
+		query string
+	}{
+		{&stmtIns, `INSERT INTO reminders (ts, uid, created, what) VALUES (?001, ?002, ?003, ?004);`},
+		{&stmtCount, `SELECT COUNT(*) FROM reminders WHERE uid = ?001;`},
+		{&stmtSel, `SELECT reminders.uid, reminders.created, reminders.what, userTz.tz
 												 FROM reminders LEFT JOIN userTz ON reminders.uid = userTz.uid
-												 WHERE reminders.ts < ?001;`)
-	stmtSelU, _ = commands.GetDatabase().Prepare(`SELECT ts, what FROM reminders WHERE uid = ?001 ORDER BY created ASC;`)
-	stmtClean, _ = commands.GetDatabase().Prepare(`DELETE FROM reminders WHERE ts < ?001;`)
-	stmtGetTz, _ = commands.GetDatabase().Prepare("SELECT tz FROM userTz WHERE uid = ?001;")
+												 WHERE reminders.ts < ?001;`},
+		{&stmtSelU, `SELECT ts, what FROM reminders WHERE uid = ?001 ORDER BY created ASC LIMIT ?002 OFFSET ?003;`},
+		{&stmtClean, `DELETE FROM reminders WHERE ts < ?001;`},
+		{&stmtGetTz, "SELECT tz FROM userTz WHERE uid = ?001;"},
+	}
+	for i, x := range stmts {
+		var err error
+		*x.dest, err = commands.GetDatabase().Prepare(x.query)
+		if err != nil {
+			for _, y := range stmts[:i] {
+				(*y.dest).Close()
+			}
+			return fmt.Errorf("failed to prepare statement: %w", err)
+		}
+	}
 	channelCache = make(map[string]string)
-	commands.PrepareCommand("remind", "Set a reminder").Register(remind, []*discordgo.ApplicationCommandOption{
-		commands.NewCommandOption("when", "When to send the reminder, accepts \"1d\", \"5h3m\", \"8pm\", \"25th\", \"March 7th 5:55 AM\"").AsString().Required().Finalize(),
-		commands.NewCommandOption("what", "What to remind you about").AsString().Required().Finalize(),
+	commands.PrepareCommand("remind", "Set a reminder").Modal(remindModal).Register(remind, []*discordgo.ApplicationCommandOption{
+		commands.NewCommandOption("when", "When to send the reminder, accepts \"1d\", \"5h3m\", \"8pm\", \"25th\", \"March 7th 5:55 AM\"").AsString().Finalize(),
+		commands.NewCommandOption("what", "What to remind you about, leave out to type several lines").AsString().Finalize(),
 	})
-	commands.PrepareCommand("remindcancel", "Cancel a reminder").Register(remindcancel, []*discordgo.ApplicationCommandOption{
+	commands.PrepareCommand("remindcancel", "Cancel a reminder").AutoOption("id", remindcancelAuto).Register(remindcancel, []*discordgo.ApplicationCommandOption{
 		commands.NewCommandOption("id", "Index of reminder to cancel").AsInt().SetMinMax(1, max_reminders_per_user).Required().Finalize(),
 	})
-	commands.PrepareCommand("reminders", "See all your reminders").Register(reminders, nil)
-	commands.PrepareCommand("settz", "Set time zone").Register(settz, []*discordgo.ApplicationCommandOption{
+	commands.PrepareCommand("reminders", "See all your reminders").Component(reminders.Respond).Register(reminders.Respond, nil)
+	commands.PrepareCommand("settz", "Set time zone").AutoOption("zone", settzAuto).Register(settz, []*discordgo.ApplicationCommandOption{
 		commands.NewCommandOption("zone", "Time zone abbreviation (GMT, PST, NZT, etc)").AsString().Required().Finalize(),
 	})
 	runStopper = make(chan struct{})
-	go runner(self, runStopper)
+	runDone = make(chan struct{})
+	runnerErr.Store(nil)
+	go runner(self, runStopper, runDone)
+	return nil
 }
 
-func Cleanup(self *discordgo.Session) {
+// Cleanup is defined in the Module interface to clean up the module when the bot unloads.
+// Here, it lets the runner finish sending the reminders that are due first.
+func (module) Cleanup(self commands.Session) {
+	close(runStopper)
+	<-runDone
 	stmtIns.Close()
 	stmtCount.Close()
 	stmtSel.Close()
 	stmtSelU.Close()
 	stmtClean.Close()
 	stmtGetTz.Close()
-	close(runStopper)
+}
+
+func (module) Health() error {
+	if err := runnerErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (module) Status() string {
+	var count int
+	commands.GetDatabase().QueryRow("SELECT COUNT(*) FROM reminders;").Scan(&count)
+	return fmt.Sprintf("%d pending reminders", count)
 }
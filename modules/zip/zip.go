@@ -30,6 +30,7 @@ import (
 
 	"github.com/bwmarrin/discordgo"
 	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/metrics"
 )
 
 const tsFormat = "Jan _2 3:04 PM"
@@ -151,6 +152,8 @@ func chatlog(ctx *commands.Context) error {
 	return err
 }
 
+var metricArchiveBytes = metrics.NewCounter("jlort_archive_bytes_total", "Bytes downloaded into zip archives.")
+
 // ~!zip
 // @Alias archive
 // @Hidden
@@ -199,7 +202,18 @@ func archive(ctx *commands.Context) error {
 	defer f.Close()
 	buf := bufio.NewWriter(f)
 	zWriter := zip.NewWriter(buf)
+	zipped := 0
+	stopped := false
 	for _, fInfo := range files {
+		// Keep what has been downloaded so far, rather than holding up shutdown
+		select {
+		case <-commands.ShuttingDown():
+			stopped = true
+		default:
+		}
+		if stopped {
+			break
+		}
 		header := new(zip.FileHeader)
 		header.Name = fInfo.Filename
 		header.Modified = fInfo.Timestamp
@@ -214,15 +228,18 @@ func archive(ctx *commands.Context) error {
 		if err != nil {
 			return fmt.Errorf("failed to append to zip: %w", err)
 		}
-		resp, err := ctx.Bot.Client.Get(fInfo.URL)
+		resp, err := ctx.Bot.HTTPClient().Get(fInfo.URL)
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
-		_, err = io.Copy(fWriter, resp.Body)
+		n, err := io.Copy(fWriter, resp.Body)
+		resp.Body.Close()
+		metricArchiveBytes.Add(float64(n))
 		if err != nil {
 			return fmt.Errorf("failed to append to zip: %w", err)
 		}
+		zipped++
 	}
 	err = zWriter.Close()
 	if err != nil {
@@ -232,15 +249,37 @@ func archive(ctx *commands.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to close zip: %w", err)
 	}
+	if stopped {
+		return ctx.RespondEdit(fmt.Sprintf("Stopped early because the bot is shutting down, the zip has %d of %d files. Ask for %s", zipped, len(files), fName))
+	}
 	return ctx.RespondEdit("Zip complete! Ask for " + fName)
 }
 
-// Init is defined in the command interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
-func Init(self *discordgo.Session) {
-	commands.PrepareCommand("logall", "Log this channel to a file").Perms(discordgo.PermissionReadMessageHistory).Register(chatlog, nil)
-	commands.PrepareCommand("Log From Here", "Log messages starting from here").AsMsg().Perms(discordgo.PermissionReadMessageHistory).Register(chatlog, nil)
-	commands.PrepareCommand("zip", "Zip attachments").Guild().Gsm().Register(archive, nil)
+type module struct{}
+
+func init() {
+	commands.RegisterModule(module{})
 }
 
-// Cleanup is defined in the command interface to clean up the module when the bot unloads.
-func Cleanup(_ *discordgo.Session) {}
+func (module) Name() string {
+	return "zip"
+}
+
+func (module) Deps() []string {
+	return []string{"commands"}
+}
+
+// Init is defined in the Module interface to initalize a module. This includes registering commands, making structures, and loading persistent data.
+func (module) Init(self commands.Session) error {
+	commands.PrepareCommand("logall", "Log this channel to a file").Alias("chatlog").Perms(discordgo.PermissionReadMessageHistory).Cooldown(commands.CooldownChannel, 5*time.Minute, 1).Expensive().Register(chatlog, nil)
+	commands.PrepareCommand("Log From Here", "Log messages starting from here").AsMsg().Perms(discordgo.PermissionReadMessageHistory).Cooldown(commands.CooldownChannel, 5*time.Minute, 1).Expensive().Register(chatlog, nil)
+	commands.PrepareCommand("zip", "Zip attachments").Alias("archive").Guild().Gsm().Cooldown(commands.CooldownGuild, 30*time.Minute, 1).Expensive().Register(archive, nil)
+	return nil
+}
+
+// Cleanup is defined in the Module interface to clean up the module when the bot unloads.
+func (module) Cleanup(_ commands.Session) {}
+
+func (module) Health() error {
+	return nil
+}
@@ -23,16 +23,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"jlortiz.org/jlort2/modules/log"
 )
 
-func updatePfp(self *discordgo.Session) {
+func updatePfp(self *discordgo.Session, dir string) {
 	t := time.Tick(6 * time.Hour)
 	for {
-		f, err := os.Open("pfps" + string(os.PathSeparator) + "defs.dat")
+		f, err := os.Open(filepath.Join(dir, "defs.dat"))
 		if err != nil {
 			log.Error(err)
 			return
@@ -61,7 +62,7 @@ func updatePfp(self *discordgo.Session) {
 			// fmt.Println(buf, startts.Before(ts), endts.Before(ts), startts.Before(ots), endts.Before(ots))
 			if startts.Before(ts) && !endts.Before(ts) {
 				if dFlag || ots.Before(startts) {
-					avatar, err := os.ReadFile("pfps" + string(os.PathSeparator) + name)
+					avatar, err := os.ReadFile(filepath.Join(dir, name))
 					if err == nil {
 						_, err = self.UserUpdate("", "data:image/png;base64,"+base64.StdEncoding.EncodeToString(avatar), "")
 						if err != nil {
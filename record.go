@@ -0,0 +1,83 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+// recordedEvent is one line of a recording.
+type recordedEvent struct {
+	Time     time.Time       `json:"t"`
+	Sequence int64           `json:"s"`
+	Type     string          `json:"type"`
+	Data     json.RawMessage `json:"d"`
+}
+
+// recorder appends gateway events to a file as JSON lines.
+// Each line is written at once, so a recording cut off by a crash can still be replayed.
+type recorder struct {
+	lock   sync.Mutex
+	f      *os.File
+	enc    *json.Encoder
+	failed bool
+}
+
+// startRecording appends every gateway event self receives to the file at path until stop is called.
+// It should be started before connecting, so that the recording has the READY and GUILD_CREATE events that fill in the state.
+func startRecording(self *discordgo.Session, path string) (stop func() error, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	r := &recorder{f: f, enc: json.NewEncoder(f)}
+	remove := self.AddHandler(r.record)
+	log.Info("Recording gateway events to " + path)
+	return func() error {
+		remove()
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		f := r.f
+		r.f = nil
+		return f.Close()
+	}, nil
+}
+
+func (r *recorder) record(_ *discordgo.Session, event *discordgo.Event) {
+	if event.Type == "" {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		return
+	}
+	err := r.enc.Encode(recordedEvent{time.Now(), event.Sequence, event.Type, event.RawData})
+	if err != nil && !r.failed {
+		// Once is enough, it will most likely keep failing
+		r.failed = true
+		log.Error(fmt.Errorf("failed to record %s: %w", event.Type, err))
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/mattn/go-isatty"
+	"jlortiz.org/jlort2/modules/clickart"
+	"jlortiz.org/jlort2/modules/clock"
+	"jlortiz.org/jlort2/modules/commands"
+	"jlortiz.org/jlort2/modules/commands/fake"
+	"jlortiz.org/jlort2/modules/config"
+	"jlortiz.org/jlort2/modules/log"
+)
+
+func newEvent[T any]() interface{} {
+	return new(T)
+}
+
+// The events a replay can decode. Anything else in a recording is skipped.
+var replayEvents = map[string]func() interface{}{
+	"READY":                       newEvent[discordgo.Ready],
+	"RESUMED":                     newEvent[discordgo.Resumed],
+	"GUILD_CREATE":                newEvent[discordgo.GuildCreate],
+	"GUILD_UPDATE":                newEvent[discordgo.GuildUpdate],
+	"GUILD_DELETE":                newEvent[discordgo.GuildDelete],
+	"GUILD_MEMBER_ADD":            newEvent[discordgo.GuildMemberAdd],
+	"GUILD_MEMBER_UPDATE":         newEvent[discordgo.GuildMemberUpdate],
+	"GUILD_MEMBER_REMOVE":         newEvent[discordgo.GuildMemberRemove],
+	"GUILD_MEMBERS_CHUNK":         newEvent[discordgo.GuildMembersChunk],
+	"GUILD_ROLE_CREATE":           newEvent[discordgo.GuildRoleCreate],
+	"GUILD_ROLE_UPDATE":           newEvent[discordgo.GuildRoleUpdate],
+	"GUILD_ROLE_DELETE":           newEvent[discordgo.GuildRoleDelete],
+	"CHANNEL_CREATE":              newEvent[discordgo.ChannelCreate],
+	"CHANNEL_UPDATE":              newEvent[discordgo.ChannelUpdate],
+	"CHANNEL_DELETE":              newEvent[discordgo.ChannelDelete],
+	"MESSAGE_CREATE":              newEvent[discordgo.MessageCreate],
+	"MESSAGE_UPDATE":              newEvent[discordgo.MessageUpdate],
+	"MESSAGE_DELETE":              newEvent[discordgo.MessageDelete],
+	"MESSAGE_DELETE_BULK":         newEvent[discordgo.MessageDeleteBulk],
+	"MESSAGE_REACTION_ADD":        newEvent[discordgo.MessageReactionAdd],
+	"MESSAGE_REACTION_REMOVE":     newEvent[discordgo.MessageReactionRemove],
+	"MESSAGE_REACTION_REMOVE_ALL": newEvent[discordgo.MessageReactionRemoveAll],
+	"VOICE_STATE_UPDATE":          newEvent[discordgo.VoiceStateUpdate],
+	"INTERACTION_CREATE":          newEvent[discordgo.InteractionCreate],
+}
+
+// readRecording reads the events in a recording.
+// Handlers run concurrently, so events can be recorded out of order. Each connection's events are put back in the order Discord sent them.
+func readRecording(path string) ([]recordedEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var events []recordedEvent
+	// Sequence numbers start over with each READY
+	start := 0
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read recording: %w", err)
+		}
+		if len(bytes.TrimSpace(b)) != 0 {
+			var e recordedEvent
+			err2 := json.Unmarshal(b, &e)
+			if err2 != nil && err == io.EOF {
+				log.Warn(fmt.Sprintf("%s:%d is cut off, ignoring it", path, line))
+			} else if err2 != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err2)
+			} else {
+				if e.Type == "READY" {
+					sortEvents(events[start:])
+					start = len(events)
+				}
+				events = append(events, e)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	sortEvents(events[start:])
+	return events, nil
+}
+
+func sortEvents(events []recordedEvent) {
+	slices.SortStableFunc(events, func(a, b recordedEvent) int { return cmp.Compare(a.Sequence, b.Sequence) })
+}
+
+// snapshotDatabase copies the database into a new temporary directory, so that replays leave it alone.
+func snapshotDatabase(src string) (string, error) {
+	_, err := os.Stat(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to open database: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "jlort-replay-")
+	if err != nil {
+		return "", fmt.Errorf("failed to copy database: %w", err)
+	}
+	dst := filepath.Join(dir, filepath.Base(src))
+	db, err := sql.Open("sqlite3", src)
+	if err == nil {
+		_, err = db.Exec("VACUUM INTO ?;", dst)
+		db.Close()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to copy database: %w", err)
+	}
+	return dst, nil
+}
+
+const replayTimeFormat = "2006-01-02 15:04:05.000"
+
+// replay feeds a recording through the modules without connecting to Discord.
+// The time comes from the recording and REST requests are answered by a fake, so a recording plays out the same way every time.
+// Each request the bot makes is printed along with the event that caused it. It returns the exit status, which is 1 if a handler panicked.
+func replay(path string) int {
+	cfg, err := config.LoadOffline()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if level, ok := cfg.Level(); ok {
+		log.SetLevel(level)
+	} else if !isatty.IsTerminal(os.Stderr.Fd()) {
+		log.SetLevel(log.LevelWARN)
+	}
+	// Without log.Init, the log goes only to stderr, so the requests on stdout stay apart and a running bot's log is left alone
+	events, err := readRecording(path)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if len(events) == 0 {
+		log.Error(errors.New(path + " has no events"))
+		return 1
+	}
+	dbFile, err := snapshotDatabase(cfg.Database)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	commands.SetDatabaseFile(dbFile)
+	clickart.AssetDir = cfg.ClickartDir
+	clk := clock.NewVirtual(events[0].Time)
+	clock.Use(clk)
+
+	bot := fake.New(&discordgo.User{ID: "0", Username: "owner"})
+	bot.State.MaxMessageCount = 100
+	app := bot.State.Application
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	printed := 0
+	printRequests := func(cause string) {
+		bot.Lock()
+		reqs := bot.Requests[printed:]
+		printed = len(bot.Requests)
+		bot.Unlock()
+		for _, r := range reqs {
+			fmt.Fprintf(out, "%s %-28s %d %s /%s %s\n", r.Time.Format(replayTimeFormat), cause, r.Status, r.Method, r.Path, r.Body)
+		}
+	}
+
+	started := false
+	skipped, panicked := 0, 0
+	for n, e := range events {
+		clk.AdvanceTo(e.Time)
+		printRequests("(timer)")
+		newEv, ok := replayEvents[e.Type]
+		if !ok {
+			skipped++
+			continue
+		}
+		event := newEv()
+		err = json.Unmarshal(e.Data, event)
+		if err != nil {
+			log.Error(fmt.Errorf("failed to decode event %d, %s: %w", n+1, e.Type, err))
+			skipped++
+			continue
+		}
+		cause := fmt.Sprintf("#%d %s", n+1, e.Type)
+		err = bot.Dispatch(event)
+		if ready, ok := event.(*discordgo.Ready); ok {
+			// READY only has the application's ID, the rest is fetched by ready()
+			if ready.Application != nil {
+				app.ID = ready.Application.ID
+			}
+			bot.State.Lock()
+			bot.State.Application = app
+			bot.State.Unlock()
+			if !started {
+				started = true
+				err = errors.Join(err, startReplayModules(bot))
+			}
+		}
+		printRequests(cause)
+		if err != nil {
+			panicked++
+			fmt.Fprintf(out, "%s %-28s failed, see the log\n", clk.Now().Format(replayTimeFormat), cause)
+			log.Error(fmt.Errorf("event %d, %s: %w", n+1, e.Type, err))
+		}
+	}
+	// Let messages that were due to be deleted go
+	clk.Advance(time.Minute)
+	printRequests("(timer)")
+	if started {
+		commands.StopModules(bot.REST())
+	} else {
+		log.Warn("The recording has no READY event, so no modules were started")
+	}
+	out.Flush()
+	fmt.Fprintf(os.Stderr, "Replayed %d events from %s to %s, skipped %d\n", len(events)-skipped, events[0].Time.Format(replayTimeFormat), events[len(events)-1].Time.Format(replayTimeFormat), skipped)
+	fmt.Fprintf(os.Stderr, "The bot made %d requests, and %d events failed\n", printed, panicked)
+	fmt.Fprintln(os.Stderr, "The database after the replay is in "+dbFile)
+	if panicked != 0 {
+		return 1
+	}
+	return 0
+}
+
+// startReplayModules does what initModules and ready do for a live bot, without uploading commands.
+func startReplayModules(bot *fake.Session) error {
+	commands.Use(commands.Logging, commands.Recover)
+	err := commands.StartModules(bot.REST())
+	if err != nil {
+		log.Warn("Some modules are disabled:\n" + err.Error())
+	}
+	for _, m := range commands.ModuleStatuses() {
+		if m.Name == "commands" && !m.Running {
+			return fmt.Errorf("failed to start the commands module: %w", m.Err)
+		}
+	}
+	bot.AddHandler(interactionCreate)
+	bot.AddHandler(messageCreate)
+	bot.AddHandler(newGuild)
+	return nil
+}
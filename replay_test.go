@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2021-2023 jlortiz
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadRecording(t *testing.T) {
+	// Two connections, each written out of order by concurrent handlers, and a last line cut off by a crash
+	lines := []string{
+		`{"s":1,"type":"READY","d":{}}`,
+		`{"s":3,"type":"B","d":{}}`,
+		`{"s":2,"type":"A","d":{}}`,
+		``,
+		`{"s":4,"type":"C","d":{}}`,
+		`{"s":1,"type":"READY","d":{}}`,
+		`{"s":3,"type":"E","d":{}}`,
+		`{"s":2,"type":"D","d":{}}`,
+		`{"s":4,"type":"F","d":`,
+	}
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := readRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, fmt.Sprintf("%s%d", e.Type, e.Sequence))
+	}
+	want := []string{"READY1", "A2", "B3", "C4", "READY1", "D2", "E3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadRecordingBadLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	err := os.WriteFile(path, []byte("{\"s\":1,\"type\":\"READY\",\"d\":{}}\nnot json\n{\"s\":2,\"type\":\"A\",\"d\":{}}\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readRecording(path)
+	if err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("got %v, want an error on line 2", err)
+	}
+}
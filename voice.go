@@ -19,16 +19,22 @@ package main
 
 import (
 	"database/sql"
+	"embed"
 	"fmt"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"jlortiz.org/jlort2/modules/clock"
 	"jlortiz.org/jlort2/modules/commands"
 	"jlortiz.org/jlort2/modules/log"
+	"jlortiz.org/jlort2/modules/metrics"
 )
 
+//go:embed locales/*.json
+var catalog embed.FS
+
 var voiceCooldown map[string]time.Time = make(map[string]time.Time)
 var voicePrevious map[string]string = make(map[string]string)
 var voiceStatement *sql.Stmt
@@ -36,6 +42,8 @@ var voiceStateLock sync.Mutex
 
 const plusd = 3 * time.Second
 
+var metricAnnouncements = metrics.NewCounter("jlort_voice_announcements_total", "Voice channel announcements sent, by kind.", "kind")
+
 func voiceStateUpdate(self *discordgo.Session, event *discordgo.VoiceStateUpdate) {
 	voiceStateLock.Lock()
 	defer voiceStateLock.Unlock()
@@ -43,11 +51,11 @@ func voiceStateUpdate(self *discordgo.Session, event *discordgo.VoiceStateUpdate
 		if event.ChannelID == "" {
 			delete(voicePrevious, event.UserID)
 		}
-		voiceCooldown[event.UserID] = time.Now().Add(plusd)
+		voiceCooldown[event.UserID] = clock.Now().Add(plusd)
 		return
 	}
-	if tim := voiceCooldown[event.UserID]; tim.After(time.Now()) {
-		voiceCooldown[event.UserID] = time.Now().Add(plusd)
+	if tim := voiceCooldown[event.UserID]; tim.After(clock.Now()) {
+		voiceCooldown[event.UserID] = clock.Now().Add(plusd)
 		return
 	}
 	mem := event.Member
@@ -81,6 +89,7 @@ func voiceStateUpdate(self *discordgo.Session, event *discordgo.VoiceStateUpdate
 		return
 	}
 	var msg *discordgo.Message
+	var kind string
 	if event.ChannelID == guild.AfkChannelID && event.BeforeUpdate != nil {
 		if event.UserID == self.State.User.ID {
 			self.VoiceConnections[event.GuildID].Disconnect()
@@ -90,10 +99,12 @@ func voiceStateUpdate(self *discordgo.Session, event *discordgo.VoiceStateUpdate
 		// TODO: Maybe don't do this if the channels aren't the same
 		// Or add special handling to redirect to whatever the origin channel is if !specificVc?
 		msg, err = self.ChannelMessageSend(output, event.Member.DisplayName()+" is now AFK")
+		kind = "afk"
 	} else {
 		old, ok := voicePrevious[event.UserID]
 		if event.BeforeUpdate != nil && event.BeforeUpdate.ChannelID == guild.AfkChannelID && ok && event.ChannelID == old {
 			msg, err = self.ChannelMessageSend(output, event.Member.DisplayName()+" is no longer AFK")
+			kind = "back"
 		} else {
 			var vch *discordgo.Channel
 			vch, err = self.State.Channel(event.ChannelID)
@@ -102,14 +113,16 @@ func voiceStateUpdate(self *discordgo.Session, event *discordgo.VoiceStateUpdate
 				return
 			}
 			msg, err = self.ChannelMessageSend(output, event.Member.DisplayName()+" joined "+vch.Name)
+			kind = "join"
 		}
 	}
 	if err != nil {
 		log.Error(fmt.Errorf("voice message failed: %w", err))
 		return
 	}
-	voiceCooldown[event.UserID] = time.Now().Add(plusd)
-	time.AfterFunc(2*time.Second, func() { self.ChannelMessageDelete(output, msg.ID) })
+	metricAnnouncements.Inc(kind)
+	voiceCooldown[event.UserID] = clock.Now().Add(plusd)
+	clock.AfterFunc(2*time.Second, func() { self.ChannelMessageDelete(output, msg.ID) })
 }
 
 // ~!vachan [#channel]
@@ -119,23 +132,42 @@ func voiceStateUpdate(self *discordgo.Session, event *discordgo.VoiceStateUpdate
 // You must mention the channel to change the setting because I am lazy.
 // You can disable voice join annoucements by setting it to "none" without quotes or pound.
 func vachan(ctx *commands.Context) error {
-	args := ctx.ApplicationCommandData().Options
-	ch := args[0].ChannelValue(ctx.Bot)
-	if len(args) == 1 {
+	var args struct {
+		Channel *discordgo.Channel `option:"channel,required"`
+		Voice   *discordgo.Channel `option:"voice"`
+	}
+	err := ctx.Bind(&args)
+	if err != nil {
+		return err
+	}
+	ch := args.Channel
+	if args.Voice == nil {
 		if ch.Type != discordgo.ChannelTypeGuildText {
-			ctx.Database.Exec("DELETE FROM vachan WHERE gid=?;", ctx.GuildID)
-			return ctx.RespondPrivate("Voice announcements disabled on this server.")
+			_, err = ctx.Database.Exec("DELETE FROM vachan WHERE gid=?;", ctx.GuildID)
+			if err != nil {
+				return fmt.Errorf("failed to update vachan: %w", err)
+			}
+			return ctx.RespondPrivate(ctx.T("voice.disabledGuild"))
 		}
-		ctx.Database.Exec("INSERT OR REPLACE INTO vachan (gid, vid, cid) VALUES(?001, 0, ?002);", ctx.GuildID, ch.ID)
-		return ctx.RespondPrivate("Voice joins will be announced in <#" + ch.ID + "> by default")
+		_, err = ctx.Database.Exec("INSERT OR REPLACE INTO vachan (gid, vid, cid) VALUES(?001, 0, ?002);", ctx.GuildID, ch.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update vachan: %w", err)
+		}
+		return ctx.RespondPrivate(ctx.T("voice.defaultChannel", ch.ID))
 	}
-	vc := ctx.ApplicationCommandData().Options[1].ChannelValue(ctx.Bot)
+	vc := args.Voice
 	if ch.Type != discordgo.ChannelTypeGuildText {
-		ctx.Database.Exec("DELETE FROM vachan WHERE gid=?001 AND vid=?002;", ctx.GuildID, vc.ID)
-		return ctx.RespondPrivate("Voice announcements disabled for <#" + vc.ID + ">")
+		_, err = ctx.Database.Exec("DELETE FROM vachan WHERE gid=?001 AND vid=?002;", ctx.GuildID, vc.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update vachan: %w", err)
+		}
+		return ctx.RespondPrivate(ctx.T("voice.disabledChannel", vc.ID))
+	}
+	_, err = ctx.Database.Exec("INSERT OR REPLACE INTO vachan (gid, vid, cid) VALUES(?001, ?002, ?003);", ctx.GuildID, vc.ID, ch.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update vachan: %w", err)
 	}
-	ctx.Database.Exec("INSERT OR REPLACE INTO vachan (gid, vid, cid) VALUES(?001, ?002, ?003);", ctx.GuildID, vc.ID, ch.ID)
-	return ctx.RespondPrivate("Voice joins for <#" + vc.ID + "> will be announced in <#" + ch.ID + ">")
+	return ctx.RespondPrivate(ctx.T("voice.channel", vc.ID, ch.ID))
 }
 
 // TODO: Do I even need this anymore?
@@ -150,3 +182,43 @@ func oldGuild(self *discordgo.Session, event *discordgo.GuildDelete) {
 		commands.GetDatabase().Exec("DELETE FROM vachan WHERE gid=?;", gid)
 	}
 }
+
+type voiceModule struct{}
+
+func init() {
+	commands.RegisterModule(voiceModule{})
+}
+
+func (voiceModule) Name() string {
+	return "voice"
+}
+
+func (voiceModule) Deps() []string {
+	return []string{"commands"}
+}
+
+func (voiceModule) Init(self commands.Session) error {
+	err := commands.LoadCatalog(catalog)
+	if err != nil {
+		return err
+	}
+	voiceStatement, err = commands.GetDatabase().Prepare("SELECT cid FROM vachan WHERE gid=?001 AND vid=?002;")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	commands.PrepareCommand("vachan", "Change voice join announcer").Guild().Perms(discordgo.PermissionManageGuild).Register(vachan, []*discordgo.ApplicationCommandOption{
+		commands.NewCommandOption("channel", "Voice join announcements will be posted here, select a category to disable").AsChannel([]discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildCategory}).Required().Finalize(),
+		commands.NewCommandOption("voice", "Voice channel to modify announcements for, omit to modify for entire server").AsChannel([]discordgo.ChannelType{discordgo.ChannelTypeGuildVoice}).Finalize(),
+	})
+	self.AddHandler(voiceStateUpdate)
+	self.AddHandler(oldGuild)
+	return nil
+}
+
+func (voiceModule) Cleanup(_ commands.Session) {
+	voiceStatement.Close()
+}
+
+func (voiceModule) Health() error {
+	return nil
+}